@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/lockfile"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func init() {
+	var opts fetch.CleanOptions
+	var keepReferencedBy []string
+	cleanCmd := &cobra.Command{
+		Use:   "clean",
+		Short: "Removes entries from the bzlmod cache",
+		Long: `Removes downloads, shared repos and cached registry files from the bzlmod cache.
+At least one of --all, --older_than, --max_size and --keep_referenced_by must be
+given; an entry is removed if any of them selects it. Entries in use by an
+ongoing fetch are skipped. Vendor directories are never touched.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runClean(opts, keepReferencedBy); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(cleanCmd)
+	cleanCmd.Flags().BoolVar(&opts.All, "all", false, `Remove everything.`)
+	cleanCmd.Flags().DurationVar(&opts.OlderThan, "older_than", 0,
+		`Remove entries that haven't been used for longer than this (such as "720h").`)
+	cleanCmd.Flags().Int64Var(&opts.MaxSize, "max_size", 0,
+		`Remove the least recently used entries until the cache takes up at most this
+many bytes.`)
+	cleanCmd.Flags().StringSliceVar(&keepReferencedBy, "keep_referenced_by", nil,
+		`Remove all downloads and shared repos except those needed to fetch the repos in
+the given lockfiles. Cached registry files are kept, so that resolving offline
+still works.`)
+}
+
+func runClean(opts fetch.CleanOptions, keepReferencedBy []string) error {
+	if !opts.All && opts.OlderThan == 0 && opts.MaxSize == 0 && keepReferencedBy == nil {
+		return fmt.Errorf("nothing to do; specify at least one of --all, --older_than, --max_size and --keep_referenced_by")
+	}
+	if keepReferencedBy != nil {
+		opts.Keep = make(map[string]bool)
+		for _, path := range keepReferencedBy {
+			ws, err := lockfile.Load(path)
+			if err != nil {
+				return err
+			}
+			for name, repo := range ws.Repos {
+				entries, err := fetch.CacheEntries(repo.Fetcher)
+				if err != nil {
+					return fmt.Errorf("error finding cache entries of repo %v in %v: %v", name, path, err)
+				}
+				for _, entry := range entries {
+					opts.Keep[entry] = true
+				}
+			}
+		}
+	}
+	result, err := fetch.Clean(opts)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Cleaned the bzlmod cache: %v\n", result)
+	return nil
+}
@@ -15,17 +15,22 @@
 package cmd
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/bazelbuild/bzlmod/fetch"
 	"github.com/bazelbuild/bzlmod/lockfile"
 	"github.com/spf13/cobra"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 func init() {
 	var fetchAll bool
+	var jobs int
 	fetchCmd := &cobra.Command{
 		Use:   "fetch <repo> [<repo2> ...]",
 		Short: "Fetches the given repo(s)",
@@ -33,56 +38,157 @@ func init() {
 to the directory where the fetched contents reside will be written to stdout.
 If only 1 repo was requested to be fetched, the path is simply written out;
 otherwise, the output will be multiple lines, each in the format of
-"<repoName> <repoPath>" (without quotes).`,
+"<repoName> <repoPath>" (without quotes). Progress is reported on stderr.
+
+The first fetch of each repo records a hash of its contents in the lockfile,
+which "bzlmod verify" later checks the contents against.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := runFetch(fetchAll, args); err != nil {
-				_, _ = fmt.Fprintf(os.Stderr, "Error: %v", err)
+			if err := runFetch(fetchAll, jobs, args); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
 			}
 		},
 	}
 
 	rootCmd.AddCommand(fetchCmd)
 	fetchCmd.Flags().BoolVar(&fetchAll, "all", false, `Fetch all known repos.`)
+	fetchCmd.Flags().IntVar(&jobs, "jobs", runtime.NumCPU(), `The number of repos to fetch in parallel.`)
 }
 
-func runFetch(fetchAll bool, repos []string) error {
-	p, err := ioutil.ReadFile(lockfile.FileName)
-	if err != nil {
-		return err
+func runFetch(fetchAll bool, jobs int, repos []string) error {
+	if jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1, got %v", jobs)
 	}
-	ws := lockfile.NewWorkspace()
-	err = json.Unmarshal(p, ws)
+	ws, err := lockfile.Load(lockfile.FileName)
 	if err != nil {
 		return err
 	}
 	if fetchAll {
-		for name, repo := range ws.Repos {
-			err = singleFetch(name, repo, ws, true)
+		repos = nil
+		for name := range ws.Repos {
+			repos = append(repos, name)
 		}
+		sort.Strings(repos)
 	} else {
 		for _, name := range repos {
-			repo := ws.Repos[name]
-			if repo == nil {
+			if ws.Repos[name] == nil {
 				return fmt.Errorf("unknown repo: %v", name)
 			}
-			err = singleFetch(name, repo, ws, len(repos) > 1)
-			if err != nil {
-				return err
-			}
 		}
 	}
-	return nil
+	return fetchRepos(repos, ws, jobs, fetchAll || len(repos) > 1)
 }
 
-func singleFetch(name string, repo *lockfile.Repo, ws *lockfile.Workspace, writeName bool) error {
-	path, err := repo.Fetcher.Fetch(filepath.Join(ws.VendorDir, name))
-	if err != nil {
-		return fmt.Errorf("error fetching repo %v: %v", name, err)
+// repoVendorDir returns the vendor dir to pass to Fetcher.Fetch for the given repo; it's empty if we're not in
+// vendoring mode.
+func repoVendorDir(ws *lockfile.Workspace, name string) string {
+	if ws.VendorDir == "" {
+		return ""
 	}
-	if writeName {
-		fmt.Printf("%v %v\n", name, path)
-	} else {
-		fmt.Println(path)
+	return filepath.Join(ws.VendorDir, name)
+}
+
+// fetchRepos fetches the given repos using `jobs` workers, writing the path of each fetched repo to stdout as soon as
+// it's ready. Every repo is attempted even if some of them fail; the returned error then lists all failures. The tree
+// hashes of repos that don't have one yet are recorded in the lockfile.
+func fetchRepos(repos []string, ws *lockfile.Workspace, jobs int, writeName bool) error {
+	var mu sync.Mutex // guards stdout, stderr and everything below
+	done := 0
+	failures := map[string]error{}
+	treeHashes := map[string]string{}
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(repos); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				mu.Lock()
+				_, _ = fmt.Fprintf(os.Stderr, "Fetching %v...\n", name)
+				mu.Unlock()
+
+				repo := ws.Repos[name]
+				path, err := repo.Fetcher.Fetch(repoVendorDir(ws, name))
+				treeHash := ""
+				if err == nil && repo.TreeHash == "" {
+					treeHash, err = repoTreeHash(ws, name, path)
+				}
+
+				mu.Lock()
+				done++
+				if err != nil {
+					failures[name] = err
+					_, _ = fmt.Fprintf(os.Stderr, "[%v/%v] Failed to fetch %v\n", done, len(repos), name)
+				} else {
+					_, _ = fmt.Fprintf(os.Stderr, "[%v/%v] Fetched %v\n", done, len(repos), name)
+					if treeHash != "" {
+						treeHashes[name] = treeHash
+					}
+					if writeName {
+						fmt.Printf("%v %v\n", name, path)
+					} else {
+						fmt.Println(path)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, name := range repos {
+		names <- name
 	}
-	return nil
+	close(names)
+	wg.Wait()
+
+	if err := recordTreeHashes(ws, treeHashes); err != nil {
+		return fmt.Errorf("error recording tree hashes in the lockfile: %v", err)
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	failed := make([]string, 0, len(failures))
+	for name := range failures {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	var report strings.Builder
+	_, _ = fmt.Fprintf(&report, "failed to fetch %v of %v repos:", len(failed), len(repos))
+	for _, name := range failed {
+		_, _ = fmt.Fprintf(&report, "\n  %v: %v", name, failures[name])
+	}
+	return errors.New(report.String())
+}
+
+// repoTreeHash computes the tree hash of the given repo, which was fetched to `path`. It returns the empty string if
+// the contents aren't managed by bzlmod (like an unpatched local path).
+func repoTreeHash(ws *lockfile.Workspace, name string, path string) (string, error) {
+	fprint := ws.Repos[name].Fetcher.Fingerprint()
+	if fprint == "" {
+		return "", nil
+	}
+	dir, err := fetch.FetchedDir(fprint, repoVendorDir(ws, name))
+	if err != nil || dir != path {
+		return "", err
+	}
+	return fetch.TreeHash(path)
+}
+
+// recordTreeHashes writes the given tree hashes (keyed by repo name) to the lockfile. Another fetch may have updated
+// the lockfile in the meantime, so it's read again (under a lock) right before the update. Hashes for repos that have
+// since been re-resolved with a different fingerprint are dropped.
+func recordTreeHashes(ws *lockfile.Workspace, treeHashes map[string]string) error {
+	if len(treeHashes) == 0 {
+		return nil
+	}
+	return lockfile.Update(lockfile.FileName, func(current *lockfile.Workspace) error {
+		for name, treeHash := range treeHashes {
+			repo := current.Repos[name]
+			if repo == nil || repo.Fetcher.Fingerprint() != ws.Repos[name].Fetcher.Fingerprint() {
+				continue
+			}
+			repo.TreeHash = treeHash
+		}
+		return nil
+	})
 }
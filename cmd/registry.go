@@ -0,0 +1,175 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/registry"
+	"github.com/bazelbuild/bzlmod/resolve"
+	"github.com/hashicorp/go-version"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// registryCmd groups the commands for maintaining index registries.
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Maintains index registries",
+}
+
+func init() {
+	var opts registryAddOptions
+
+	addCmd := &cobra.Command{
+		Use:   "add --registry <dir> --url <archive>",
+		Short: "Adds a module version to a local index registry",
+		Long: `Downloads the given source archive, applies the given patches, and adds the
+module version declared by its MODULE.bazel file to the index registry in the
+given local directory (which is created if needed). The MODULE.bazel file,
+source.json (with the integrity of the archive) and patches are written to
+modules/<name>/<version>, and the version is appended to
+modules/<name>/metadata.json.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRegistryAdd(opts); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	addCmd.Flags().StringVar(&opts.registryDir, "registry", "", "The directory of the index registry.")
+	addCmd.Flags().StringVar(&opts.url, "url", "", "The URL of the source archive of the module version.")
+	addCmd.Flags().StringVar(&opts.stripPrefix, "strip_prefix", "",
+		"A directory prefix to strip from the files in the archive.")
+	addCmd.Flags().StringVar(&opts.archiveType, "archive_type", "",
+		`The type of the archive (such as "zip" or "tar.gz"), if it can't be detected
+from the URL.`)
+	addCmd.Flags().StringArrayVar(&opts.patches, "patch", nil,
+		"A patch file to apply to the archive. Can be given multiple times.")
+	addCmd.Flags().IntVar(&opts.patchStrip, "patch_strip", 0,
+		"The number of leading path components to strip from the file names in the patches.")
+	_ = addCmd.MarkFlagRequired("registry")
+	_ = addCmd.MarkFlagRequired("url")
+
+	var addr string
+	var generateMetadata bool
+	serveCmd := &cobra.Command{
+		Use:   "serve <dir>",
+		Short: "Serves a local index registry over HTTP",
+		Long: `Serves the index registry in the given local directory over HTTP, so that it
+can be used as "http://<host>:<port>/". Archives that the registry references
+with file:// URLs are served too, and the URLs in source.json files are
+rewritten to point to them.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRegistryServe(args[0], addr, generateMetadata); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	serveCmd.Flags().StringVar(&addr, "addr", ":8080", "The address to listen on.")
+	serveCmd.Flags().BoolVar(&generateMetadata, "generate_metadata", false,
+		`Generate the metadata.json file of modules that don't have one, listing the
+versions that have a MODULE.bazel file.`)
+
+	registryCmd.AddCommand(addCmd)
+	registryCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(registryCmd)
+}
+
+type registryAddOptions struct {
+	registryDir string
+	url         string
+	stripPrefix string
+	archiveType string
+	patches     []string
+	patchStrip  int
+}
+
+func runRegistryAdd(opts registryAddOptions) error {
+	// Always download the archive afresh: a copy cached under its URL may be stale, and publishing its integrity would
+	// break the module version for everyone else.
+	integ, err := fetch.DownloadFresh(opts.url)
+	if err != nil {
+		return err
+	}
+
+	var patches []fetch.Patch
+	for _, patchFile := range opts.patches {
+		abs, err := filepath.Abs(patchFile)
+		if err != nil {
+			return err
+		}
+		patches = append(patches, fetch.Patch{abs, opts.patchStrip})
+	}
+	archive := &fetch.Archive{
+		URLs:        []string{opts.url},
+		Integrity:   integ,
+		StripPrefix: opts.stripPrefix,
+		Patches:     patches,
+		Type:        opts.archiveType,
+	}
+	// Extract the archive into a temporary directory, rather than leaving a shared repo dir behind that nothing uses.
+	dir, cleanup, err := fetch.FetchFresh(archive)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	// The registry serves the MODULE.bazel file as patched, just like the fetched repo has it.
+	moduleBazel, err := ioutil.ReadFile(filepath.Join(dir, "MODULE.bazel"))
+	if err != nil {
+		return fmt.Errorf("can't read the MODULE.bazel file of the archive: %v", err)
+	}
+	key, err := resolve.ParseModuleKey(moduleBazel)
+	if err != nil {
+		return fmt.Errorf("error evaluating the MODULE.bazel file of the archive: %v", err)
+	}
+	if key.Name == "" || key.Version == "" {
+		return fmt.Errorf("the MODULE.bazel file of the archive must declare a name and a version, got %v", &key)
+	}
+	if _, err := version.NewVersion(key.Version); err != nil {
+		return fmt.Errorf("invalid version for module %v: %v", key.Name, err)
+	}
+
+	if err := registry.AddVersion(opts.registryDir, registry.NewVersion{
+		Key:         key,
+		ModuleBazel: moduleBazel,
+		URL:         opts.url,
+		Integrity:   integ,
+		StripPrefix: opts.stripPrefix,
+		Type:        opts.archiveType,
+		PatchFiles:  opts.patches,
+		PatchStrip:  opts.patchStrip,
+	}); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Added %v to registry %v\n", &key, opts.registryDir)
+	return nil
+}
+
+func runRegistryServe(dir string, addr string, generateMetadata bool) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Serving registry %v on %v\n", dir, addr)
+	return http.ListenAndServe(addr, &registry.Server{Dir: dir, GenerateMetadata: generateMetadata})
+}
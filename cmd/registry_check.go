@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/registry"
+	"github.com/bazelbuild/bzlmod/resolve"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	var modules []string
+
+	checkCmd := &cobra.Command{
+		Use:   "check <url>",
+		Short: "Checks the consistency of a registry",
+		Long: `Checks every version of every module in the given registry (or only those of the
+modules given by --modules, which is required for registries that can't be
+enumerated, such as HTTP registries). For each version, this checks that:
+
+  - the MODULE.bazel file declares the right name and version;
+  - the source URL and each mirror from bazel_registry.json serve contents
+    matching the integrity in source.json;
+  - the source can be fetched, and its patches apply;
+  - the MODULE.bazel file in the registry is the same as the one in the
+    (patched) source, if the source has one.
+
+A JSON report is written to stdout, and progress to stderr. The command fails if
+any problem is found.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRegistryCheck(args[0], modules); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	checkCmd.Flags().StringSliceVar(&modules, "modules", nil, "The modules to check (default all).")
+
+	registryCmd.AddCommand(checkCmd)
+}
+
+type registryCheckReport struct {
+	Registry string                 `json:"registry"`
+	OK       bool                   `json:"ok"`
+	Versions []checkedModuleVersion `json:"versions"`
+}
+
+type checkedModuleVersion struct {
+	Module  string `json:"module"`
+	Version string `json:"version"`
+	OK      bool   `json:"ok"`
+	// Problems is empty if OK is true.
+	Problems []registryCheckProblem `json:"problems,omitempty"`
+}
+
+type registryCheckProblem struct {
+	// Check is one of "metadata", "module", "source", "integrity", "mirror", "fetch" and "module_bazel".
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+func runRegistryCheck(url string, modules []string) error {
+	reg, err := registry.New(url)
+	if err != nil {
+		return err
+	}
+	// Only the registry's own mirrors are checked. The user's are restored afterwards, for anything else that runs in
+	// this process.
+	userMirrors := registry.UserMirrors
+	registry.UserMirrors = nil
+	defer func() { registry.UserMirrors = userMirrors }()
+	if len(modules) == 0 {
+		if modules, err = reg.ListModules(); err != nil {
+			if errors.Is(err, registry.ErrListingNotSupported) {
+				return fmt.Errorf("%v; please give the modules to check with --modules", err)
+			}
+			return err
+		}
+	}
+
+	report := registryCheckReport{Registry: reg.URL(), OK: true, Versions: []checkedModuleVersion{}}
+	for _, name := range modules {
+		metadata, err := reg.GetModuleMetadata(name)
+		if err != nil {
+			report.Versions = append(report.Versions, checkedModuleVersion{
+				Module:   name,
+				Problems: []registryCheckProblem{{"metadata", err.Error()}},
+			})
+			report.OK = false
+			continue
+		}
+		for _, version := range metadata.Versions {
+			key := common.ModuleKey{name, version}
+			_, _ = fmt.Fprintf(os.Stderr, "Checking %v...\n", &key)
+			checked := checkedModuleVersion{Module: name, Version: version}
+			checked.Problems, err = checkModuleVersion(reg, key)
+			if err != nil {
+				return fmt.Errorf("error checking %v: %v", &key, err)
+			}
+			checked.OK = len(checked.Problems) == 0
+			report.OK = report.OK && checked.OK
+			report.Versions = append(report.Versions, checked)
+		}
+	}
+
+	p, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(p))
+	if !report.OK {
+		bad := 0
+		for _, checked := range report.Versions {
+			if !checked.OK {
+				bad++
+			}
+		}
+		return fmt.Errorf("%v of %v module versions have problems", bad, len(report.Versions))
+	}
+	return nil
+}
+
+// checkModuleVersion checks a single module version in the registry, and returns the problems found. An error is only
+// returned if the check itself couldn't be performed.
+func checkModuleVersion(reg registry.Registry, key common.ModuleKey) ([]registryCheckProblem, error) {
+	var problems []registryCheckProblem
+	report := func(check string, format string, args ...interface{}) {
+		problems = append(problems, registryCheckProblem{check, fmt.Sprintf(format, args...)})
+	}
+
+	moduleBazel, err := reg.GetModuleBazel(key)
+	if err != nil {
+		report("module", "%v", err)
+	} else if declared, err := resolve.ParseModuleKey(moduleBazel); err != nil {
+		report("module", "error evaluating the MODULE.bazel file: %v", err)
+	} else if declared != key {
+		report("module", "the MODULE.bazel file declares %v", &declared)
+	}
+
+	fetcher, err := reg.GetFetcher(key)
+	if err != nil {
+		report("source", "%v", err)
+		return problems, nil
+	}
+	var urls []string
+	var integrity string
+	if d, ok := fetcher.(fetch.Downloader); ok {
+		urls, integrity = d.DownloadURLs()
+	}
+
+	if len(urls) > 0 && integrity == "" {
+		report("integrity", "source.json has no integrity")
+	} else {
+		// The source URL comes last, after the mirrors.
+		for i, url := range urls {
+			check := "mirror"
+			if i == len(urls)-1 {
+				check = "integrity"
+			}
+			if err := fetch.VerifyURL(url, integrity); err != nil {
+				report(check, "%v: %v", url, err)
+			}
+		}
+	}
+
+	dir, cleanup, err := fetch.FetchFresh(fetcher)
+	if err != nil {
+		report("fetch", "%v", err)
+		return problems, nil
+	}
+	defer cleanup()
+	if moduleBazel != nil {
+		// Sources without a MODULE.bazel file (such as single files, or projects that don't use bzlmod) are given one
+		// by the registry, so there's nothing to compare it with.
+		fetched, err := ioutil.ReadFile(filepath.Join(dir, "MODULE.bazel"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		} else if err == nil && !bytes.Equal(fetched, moduleBazel) {
+			report("module_bazel", "the MODULE.bazel file in the registry differs from the one in the source")
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCheckModuleVersion(t *testing.T) {
+	tempDir := t.TempDir()
+	fetch.TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { fetch.TestBzlmodDir = "" }()
+	regDir := filepath.Join(tempDir, "reg")
+
+	archives := map[string][]byte{}
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		if contents, ok := archives[r.URL.Path]; ok {
+			_, _ = w.Write(contents)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// addVersion serves an archive with the given MODULE.bazel file and an extra file, and adds it to the registry. The
+	// registry gets `registryModuleBazel` as the MODULE.bazel file if it's non-empty, and the integrity of
+	// `integrityOf` if that's non-nil.
+	addVersion := func(name string, moduleBazel string, registryModuleBazel string, integrityOf []byte, patchFiles ...string) {
+		archive := testutil.BuildZipArchive(t, map[string][]byte{
+			"MODULE.bazel": []byte(moduleBazel),
+			"file":         []byte("contents\n"),
+		})
+		archives["/"+name+".zip"] = archive
+		if registryModuleBazel == "" {
+			registryModuleBazel = moduleBazel
+		}
+		if integrityOf == nil {
+			integrityOf = archive
+		}
+		require.NoError(t, registry.AddVersion(regDir, registry.NewVersion{
+			Key:         common.ModuleKey{name, "1.0"},
+			ModuleBazel: []byte(registryModuleBazel),
+			URL:         server.URL + "/" + name + ".zip",
+			Integrity:   integrity.MustGenerate("sha256", integrityOf),
+			PatchFiles:  patchFiles,
+			PatchStrip:  1,
+		}))
+	}
+	moduleBazel := func(name string) string {
+		return fmt.Sprintf("module(name=%q, version=\"1.0\")\n", name)
+	}
+	goodPatch := filepath.Join(tempDir, "good.patch")
+	testutil.WriteFile(t, goodPatch, `--- a/file
++++ b/file
+@@ -1 +1 @@
+-contents
++patched
+`)
+	badPatch := filepath.Join(tempDir, "bad.patch")
+	testutil.WriteFile(t, badPatch, `--- a/file
++++ b/file
+@@ -1 +1 @@
+-something else
++patched
+`)
+	addVersion("good", moduleBazel("good"), "", nil, goodPatch)
+	addVersion("wrong_integrity", moduleBazel("wrong_integrity"), "", []byte("other contents"))
+	addVersion("different_module_bazel", moduleBazel("different_module_bazel"),
+		moduleBazel("different_module_bazel")+"bazel_dep(name=\"good\", version=\"1.0\")\n", nil)
+	addVersion("bad_patch", moduleBazel("bad_patch"), "", nil, badPatch)
+	addVersion("wrong_name", moduleBazel("wrong_name"), moduleBazel("other_name"), nil)
+
+	reg, err := registry.New("file://" + filepath.ToSlash(regDir))
+	require.NoError(t, err)
+	checks := func(name string) []string {
+		problems, err := checkModuleVersion(reg, common.ModuleKey{name, "1.0"})
+		require.NoError(t, err)
+		var checks []string
+		for _, problem := range problems {
+			checks = append(checks, problem.Check)
+		}
+		return checks
+	}
+	assert.Empty(t, checks("good"))
+	// The archive that was verified is the one that's fetched.
+	mu.Lock()
+	assert.Equal(t, 1, requests["/good.zip"])
+	mu.Unlock()
+	// The fetch fails too, as it checks the integrity as well.
+	assert.Equal(t, []string{"integrity", "fetch"}, checks("wrong_integrity"))
+	assert.Equal(t, []string{"module_bazel"}, checks("different_module_bazel"))
+	assert.Equal(t, []string{"fetch"}, checks("bad_patch"))
+	assert.Equal(t, []string{"module", "module_bazel"}, checks("wrong_name"))
+}
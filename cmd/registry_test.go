@@ -0,0 +1,47 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunRegistryAdd(t *testing.T) {
+	tempDir := t.TempDir()
+	fetch.TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { fetch.TestBzlmodDir = "" }()
+	archive := filepath.Join(tempDir, "a.zip")
+	testutil.WriteFileBytes(t, archive, testutil.BuildZipArchive(t, map[string][]byte{
+		"a-1.0/MODULE.bazel": []byte(`module(name="A", version="1.0")`),
+	}))
+	regDir := filepath.Join(tempDir, "reg")
+
+	require.NoError(t, runRegistryAdd(registryAddOptions{
+		registryDir: regDir,
+		url:         "file://" + filepath.ToSlash(archive),
+		stripPrefix: "a-1.0",
+	}))
+	testutil.AssertFileContents(t, filepath.Join(regDir, "modules", "A", "1.0", "MODULE.bazel"),
+		`module(name="A", version="1.0")`)
+	// The archive was only extracted to read its MODULE.bazel file, so no shared repo dir is left behind.
+	_, err := os.Stat(filepath.Join(fetch.TestBzlmodDir, "shared_repos"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -25,6 +25,7 @@ import (
 func init() {
 	var vendorDir string
 	var registries []string
+	var allowedYankedVersions []string
 
 	resolveCmd := &cobra.Command{
 		Use:   "resolve",
@@ -32,7 +33,7 @@ func init() {
 		Long: `Sets up the current Bazel workspace by reading the MODULE.bazel file,
 resolving transitive dependencies, and outputting a WORKSPACE file.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := resolve.Resolve(".", vendorDir, registries); err != nil {
+			if err := resolve.Resolve(".", vendorDir, registries, allowedYankedVersions); err != nil {
 				_, _ = fmt.Fprintf(os.Stderr, "Error: %v", err)
 			}
 		},
@@ -47,4 +48,8 @@ to be placed.`)
 	resolveCmd.Flags().StringSliceVar(&registries, "registries", nil,
 		`The list of Bazel registries to pull dependencies from. Earlier registries have
 higher priority.`)
+	resolveCmd.Flags().StringSliceVar(&allowedYankedVersions, "allow_yanked_versions", nil,
+		`Yanked module versions (as "<name>@<version>") that may be selected anyway.
+Resolution fails if any other yanked version is selected. Takes precedence over
+allow_yanked_versions in workspace_settings.`)
 }
@@ -16,6 +16,9 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/registry"
 	"github.com/spf13/cobra"
 	"os"
 
@@ -38,13 +41,21 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// The flags parsed fine, so the usage is no help with what's wrong.
+		cmd.SilenceUsage = true
+		if err := httpclient.FlagOptions.Validate(); err != nil {
+			return err
+		}
+		return fetch.DefaultLimits.Validate()
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	// Cobra has already printed the error to stderr.
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
 		os.Exit(1)
 	}
 }
@@ -57,6 +68,42 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.bzlmod.yaml)")
+	rootCmd.PersistentFlags().Int64Var(&fetch.DefaultLimits.MaxDownloadSize, "max_download_size",
+		fetch.DefaultLimits.MaxDownloadSize, "Maximum size in bytes of any downloaded file (0 for no limit).")
+	rootCmd.PersistentFlags().Int64Var(&fetch.DefaultLimits.MaxExtractedSize, "max_extracted_size",
+		fetch.DefaultLimits.MaxExtractedSize, "Maximum total size in bytes of the files extracted from an archive (0 for no limit).")
+	rootCmd.PersistentFlags().Int64Var(&fetch.DefaultLimits.MaxFileCount, "max_file_count",
+		fetch.DefaultLimits.MaxFileCount, "Maximum number of entries extracted from an archive (0 for no limit).")
+	rootCmd.PersistentFlags().Int64Var(&fetch.DefaultLimits.MaxCompressionRatio, "max_compression_ratio",
+		fetch.DefaultLimits.MaxCompressionRatio, "Maximum ratio between the extracted size and the size of an archive (0 for no limit).")
+	rootCmd.PersistentFlags().Var(&fetch.VendorCopyStrategy, "vendor_copy",
+		`How to copy repos from the shared cache into vendor dirs: "reflink" (a
+copy-on-write clone), "hardlink" (for read-only files, which must then never be
+made writable and modified, as that would modify the cached ones too; other
+files are copied), "copy", or "auto" (a reflink if the filesystem supports it, a
+hardlink for read-only files, and a copy otherwise). Falls back to a copy if the
+chosen method isn't supported.`)
+	// The HTTP flags default to unset, so that the values from workspace_settings apply unless they're given.
+	rootCmd.PersistentFlags().DurationVar(&httpclient.FlagOptions.ConnectTimeout, "http_connect_timeout", 0,
+		fmt.Sprintf("Timeout for establishing HTTP connections (default %v).", httpclient.DefaultOptions.ConnectTimeout))
+	rootCmd.PersistentFlags().DurationVar(&httpclient.FlagOptions.ReadTimeout, "http_read_timeout", 0,
+		fmt.Sprintf("Timeout for waiting on data from an HTTP server (default %v).", httpclient.DefaultOptions.ReadTimeout))
+	rootCmd.PersistentFlags().IntVar(&httpclient.FlagOptions.MaxAttempts, "http_max_attempts", 0,
+		fmt.Sprintf("Maximum number of attempts for HTTP requests that fail transiently (default %v).", httpclient.DefaultOptions.MaxAttempts))
+	rootCmd.PersistentFlags().DurationVar(&httpclient.FlagOptions.InitialBackoff, "http_initial_backoff", 0,
+		fmt.Sprintf("Delay before retrying a failed HTTP request, doubled after each attempt (default %v).", httpclient.DefaultOptions.InitialBackoff))
+	rootCmd.PersistentFlags().DurationVar(&httpclient.FlagOptions.MaxBackoff, "http_max_backoff", 0,
+		fmt.Sprintf("Maximum delay before retrying a failed HTTP request (default %v).", httpclient.DefaultOptions.MaxBackoff))
+
+	rootCmd.PersistentFlags().BoolVar(&httpclient.Offline, "offline", false,
+		`Never access the network. Registry files and archives are only served from local
+caches, file:// URLs and vendor directories.`)
+	rootCmd.PersistentFlags().StringSliceVar(&httpclient.CredentialHelpers, "credential_helper", nil,
+		`An executable that provides credentials for HTTP requests, using the same protocol
+as Bazel's --credential_helper. In the format "[<host>=]<path>", where <host> can
+start with "*." to match all subdomains. Can be given multiple times; the first
+match wins. Credentials can also be given per host under "credentials" in the
+config file, or in ~/.netrc.`)
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -83,8 +130,18 @@ func initConfig() {
 
 	viper.AutomaticEnv() // read in environment variables that match
 
-	// If a config file is found, read it in.
+	// If a config file is found, read it in. Stdout is reserved for the output of commands.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		_, _ = fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	}
+
+	// Per-host credentials, as a list of entries like {host: example.com, token: ...} (or username and password
+	// instead of token). This is a list rather than a map keyed by host, as viper would split the host names at dots.
+	if err := viper.UnmarshalKey("credentials", &httpclient.Credentials); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error: invalid credentials in config file:", err)
+		os.Exit(1)
 	}
+	// Mirror URL templates (in the same format as the mirrors in bazel_registry.json) applied to archives from all
+	// registries.
+	registry.UserMirrors = viper.GetStringSlice("mirrors")
 }
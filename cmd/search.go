@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/registry"
+	"github.com/bazelbuild/bzlmod/resolve"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+func init() {
+	var registries []string
+
+	searchCmd := &cobra.Command{
+		Use:   "search <substring>",
+		Short: "Searches the registries for modules by name",
+		Long: `Lists the modules whose names contain the given substring (ignoring case), along
+with their latest version that isn't yanked and the registry they come from. If
+several registries have a module, only the one with the highest priority is
+listed. Registries that can't be enumerated (such as HTTP registries) are
+skipped with a warning. The registries are the ones given by --registries, or
+else the ones in workspace_settings of the MODULE.bazel file in the current
+directory.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runSearch(args[0], registries); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(searchCmd)
+	searchCmd.Flags().StringSliceVar(&registries, "registries", nil,
+		`The list of Bazel registries to search. Earlier registries have higher priority.`)
+}
+
+func runSearch(substring string, registries []string) error {
+	registries, err := resolve.Registries(".", registries)
+	if err != nil {
+		return err
+	}
+	substring = strings.ToLower(substring)
+	seen := make(map[string]bool)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, url := range registries {
+		reg, err := registry.New(url)
+		if err != nil {
+			return fmt.Errorf("error creating registry from %q: %v", url, err)
+		}
+		names, err := reg.ListModules()
+		if errors.Is(err, registry.ErrListingNotSupported) {
+			_, _ = fmt.Fprintf(os.Stderr, "Warning: skipping registry %v, as it can't be searched\n", url)
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if seen[name] || !strings.Contains(strings.ToLower(name), substring) {
+				continue
+			}
+			seen[name] = true
+			latest := ""
+			metadata, err := reg.GetModuleMetadata(name)
+			if err == nil {
+				latest = metadata.LatestVersion()
+			} else if !errors.Is(err, registry.ErrNotFound) {
+				return err
+			}
+			if latest == "" {
+				latest = "(no versions)"
+			}
+			_, _ = fmt.Fprintf(w, "%v\t%v\t%v\n", name, latest, reg.URL())
+		}
+	}
+	return w.Flush()
+}
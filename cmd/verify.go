@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/bazelbuild/bzlmod/lockfile"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+)
+
+func init() {
+	verifyCmd := &cobra.Command{
+		Use:   "verify [<repo> ...]",
+		Short: "Checks the contents of fetched repos against the lockfile",
+		Long: `Recomputes the hash of the contents of each given repo (or of all repos, if none
+are given) and compares it with the one recorded in the lockfile by the first
+fetch. A mismatch means that the contents were modified locally, or that
+fetching the repo isn't reproducible. Repos that haven't been fetched yet, or
+have no recorded hash, are skipped. The result for each repo is written to
+stdout; the command fails if any repo doesn't match.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runVerify(args); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(verifyCmd)
+}
+
+func runVerify(repos []string) error {
+	ws, err := lockfile.Load(lockfile.FileName)
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		for name := range ws.Repos {
+			repos = append(repos, name)
+		}
+		sort.Strings(repos)
+	} else {
+		for _, name := range repos {
+			if ws.Repos[name] == nil {
+				return fmt.Errorf("unknown repo: %v", name)
+			}
+		}
+	}
+
+	mismatches := 0
+	for _, name := range repos {
+		result, ok, err := verifyRepo(ws, name)
+		if err != nil {
+			return fmt.Errorf("error verifying repo %v: %v", name, err)
+		}
+		if !ok {
+			mismatches++
+		}
+		fmt.Printf("%v: %v\n", name, result)
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%v of %v repos don't match the lockfile", mismatches, len(repos))
+	}
+	return nil
+}
+
+// verifyRepo checks the contents of the given repo. It returns a description of the result, and whether the repo is
+// fine (or can't be checked).
+func verifyRepo(ws *lockfile.Workspace, name string) (string, bool, error) {
+	repo := ws.Repos[name]
+	fprint := repo.Fetcher.Fingerprint()
+	if fprint == "" {
+		return "skipped (not managed by bzlmod)", true, nil
+	}
+	if repo.TreeHash == "" {
+		return "skipped (no tree hash recorded)", true, nil
+	}
+	dir, err := fetch.FetchedDir(fprint, repoVendorDir(ws, name))
+	if err != nil {
+		return "", false, err
+	}
+	if dir == "" {
+		return "skipped (not fetched)", true, nil
+	}
+	treeHash, err := fetch.TreeHash(dir)
+	if err != nil {
+		return "", false, err
+	}
+	if treeHash != repo.TreeHash {
+		return fmt.Sprintf("MISMATCH in %v (expected %v, got %v)", dir, repo.TreeHash, treeHash), false, nil
+	}
+	return "OK", true, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/registry"
+	"github.com/bazelbuild/bzlmod/resolve"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+func init() {
+	var registries []string
+
+	versionsCmd := &cobra.Command{
+		Use:   "versions <module>",
+		Short: "Lists the available versions of a module",
+		Long: `Lists the versions of the given module in each of the registries that have it,
+along with its homepage and maintainers. Yanked versions are marked with the
+reason why they were yanked. The registries are the ones given by --registries,
+or else the ones in workspace_settings of the MODULE.bazel file in the current
+directory.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runVersions(args[0], registries); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(versionsCmd)
+	versionsCmd.Flags().StringSliceVar(&registries, "registries", nil,
+		`The list of Bazel registries to look in. Earlier registries have higher priority.`)
+}
+
+func runVersions(name string, registries []string) error {
+	registries, err := resolve.Registries(".", registries)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, url := range registries {
+		reg, err := registry.New(url)
+		if err != nil {
+			return fmt.Errorf("error creating registry from %q: %v", url, err)
+		}
+		metadata, err := reg.GetModuleMetadata(name)
+		if errors.Is(err, registry.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		found = true
+		printModuleMetadata(name, reg, metadata)
+	}
+	if !found {
+		return fmt.Errorf("%w: %v in registries %q", registry.ErrNotFound, name, registries)
+	}
+	return nil
+}
+
+func printModuleMetadata(name string, reg registry.Registry, metadata *registry.ModuleMetadata) {
+	fmt.Printf("%v (from %v)\n", name, reg.URL())
+	if metadata.Homepage != "" {
+		fmt.Printf("  homepage: %v\n", metadata.Homepage)
+	}
+	if len(metadata.Maintainers) > 0 {
+		var maintainers []string
+		for _, m := range metadata.Maintainers {
+			maintainers = append(maintainers, formatMaintainer(m))
+		}
+		fmt.Printf("  maintainers: %v\n", strings.Join(maintainers, ", "))
+	}
+	fmt.Println("  versions:")
+	for _, version := range metadata.Versions {
+		if reason, yanked := metadata.YankedVersions[version]; yanked {
+			fmt.Printf("    %v (yanked: %v)\n", version, reason)
+		} else {
+			fmt.Printf("    %v\n", version)
+		}
+	}
+}
+
+func formatMaintainer(m registry.Maintainer) string {
+	var parts []string
+	if m.Name != "" {
+		parts = append(parts, m.Name)
+	}
+	if m.Email != "" {
+		parts = append(parts, "<"+m.Email+">")
+	}
+	if m.GitHub != "" {
+		parts = append(parts, "(@"+m.GitHub+")")
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,241 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Credential holds the credentials for a single host, as given in the bzlmod config file.
+type Credential struct {
+	Host string `mapstructure:"host"`
+	// Token is sent as a bearer token. If it's empty, Username and Password are used for basic authentication instead.
+	Token    string `mapstructure:"token"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+var (
+	// Credentials are the per-host credentials from the bzlmod config file. They take precedence over ~/.netrc.
+	Credentials []Credential
+	// CredentialHelpers are external programs that are asked for the credentials of each request, in the format
+	// "[<host>=]<path>". The host can start with "*." to match all of its subdomains; without a host, the helper applies
+	// to all requests. The first matching helper is used, and takes precedence over all other sources of credentials.
+	//
+	// The protocol is the same as that of Bazel's --credential_helper: the helper is run with the argument "get", is
+	// given {"uri": "<url>"} on stdin, and writes {"headers": {"<name>": ["<value>", ...]}} to stdout.
+	CredentialHelpers []string
+)
+
+// addCredentials adds the credentials for the request's URL to its headers, unless it already carries some.
+func addCredentials(req *http.Request) error {
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+	host := req.URL.Hostname()
+
+	if helper := findCredentialHelper(host); helper != "" {
+		headers, err := runCredentialHelper(helper, req.URL.String())
+		if err != nil {
+			return err
+		}
+		for name, values := range headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		return nil
+	}
+
+	for _, c := range Credentials {
+		if c.Host != host && c.Host != req.URL.Host {
+			continue
+		}
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		} else {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+		return nil
+	}
+
+	netrc, err := loadNetrc()
+	if err != nil {
+		return err
+	}
+	if entry, ok := netrc[host]; ok {
+		req.SetBasicAuth(entry.login, entry.password)
+	} else if entry, ok := netrc[""]; ok {
+		req.SetBasicAuth(entry.login, entry.password)
+	}
+	return nil
+}
+
+func findCredentialHelper(host string) string {
+	for _, spec := range CredentialHelpers {
+		i := strings.Index(spec, "=")
+		if i == -1 {
+			return spec
+		}
+		pattern := spec[:i]
+		if pattern == host || strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			return spec[i+1:]
+		}
+	}
+	return ""
+}
+
+var helperCache = struct {
+	sync.Mutex
+	headers map[string]map[string][]string
+}{headers: map[string]map[string][]string{}}
+
+// runCredentialHelper asks the given helper for the headers to send with a request to `url`. Results are cached for
+// the lifetime of the process, as a fetch can make many requests to the same URL (retries, resumed downloads).
+func runCredentialHelper(helper string, url string) (map[string][]string, error) {
+	helperCache.Lock()
+	defer helperCache.Unlock()
+	key := helper + "\x00" + url
+	if headers, ok := helperCache.headers[key]; ok {
+		return headers, nil
+	}
+
+	request, err := json.Marshal(struct {
+		URI string `json:"uri"`
+	}{url})
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(helper, "get")
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential helper %v failed for %v: %v: %s", helper, url, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var response struct {
+		Headers map[string][]string `json:"headers"`
+	}
+	// Don't include the output in the error message, as it might contain secrets.
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("credential helper %v returned malformed output for %v", helper, url)
+	}
+	helperCache.headers[key] = response.Headers
+	return response.Headers, nil
+}
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// loadNetrc reads the .netrc file at $NETRC, or in the home directory. The returned map is keyed by machine name; the
+// "default" entry, if any, has the empty key.
+func loadNetrc() (map[string]netrcEntry, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	defer f.Close()
+	entries, err := parseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", path, err)
+	}
+	return entries, nil
+}
+
+// parseNetrc parses the contents of a .netrc file, as described in
+// https://www.gnu.org/software/inetutils/manual/html_node/The-_002enetrc-file.html
+func parseNetrc(r io.Reader) (map[string]netrcEntry, error) {
+	entries := map[string]netrcEntry{}
+	scanner := bufio.NewScanner(r)
+	var tokens []string
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro definition ends at the first empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for _, field := range fields {
+			if strings.HasPrefix(field, "#") {
+				break
+			}
+			if field == "macdef" {
+				// Skip the macro name and body.
+				inMacro = true
+				break
+			}
+			tokens = append(tokens, field)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	machine := ""
+	var entry *netrcEntry
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine", "default":
+			if entry != nil {
+				if _, ok := entries[machine]; !ok {
+					// Only the first entry for a machine counts.
+					entries[machine] = *entry
+				}
+			}
+			entry = &netrcEntry{}
+			machine = ""
+			if tokens[i] == "machine" {
+				if i+1 == len(tokens) {
+					return nil, fmt.Errorf("missing machine name")
+				}
+				i++
+				machine = tokens[i]
+			}
+		case "login", "password", "account":
+			if entry == nil {
+				return nil, fmt.Errorf("%q outside of a machine entry", tokens[i])
+			}
+			if i+1 == len(tokens) {
+				return nil, fmt.Errorf("missing value for %q", tokens[i])
+			}
+			i++
+			if tokens[i-1] == "login" {
+				entry.login = tokens[i]
+			} else if tokens[i-1] == "password" {
+				entry.password = tokens[i]
+			}
+		default:
+			return nil, fmt.Errorf("unexpected token %q", tokens[i])
+		}
+	}
+	if entry != nil {
+		if _, ok := entries[machine]; !ok {
+			entries[machine] = *entry
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,157 @@
+package httpclient
+
+import (
+	"encoding/base64"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// authServer responds with the Authorization header of each request.
+func authServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+}
+
+func getAuth(t *testing.T, url string) string {
+	resp, err := Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func basicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// withCredentials sets up the given sources of credentials for the duration of a test. An empty netrc means no .netrc
+// file.
+func withCredentials(t *testing.T, netrc string, credentials []Credential, helpers []string) func() {
+	netrcPath := filepath.Join(t.TempDir(), "netrc")
+	if netrc != "" {
+		testutil.WriteFile(t, netrcPath, netrc)
+	}
+	oldNetrc, hadNetrc := os.LookupEnv("NETRC")
+	require.NoError(t, os.Setenv("NETRC", netrcPath))
+	Credentials, CredentialHelpers = credentials, helpers
+	return func() {
+		if hadNetrc {
+			_ = os.Setenv("NETRC", oldNetrc)
+		} else {
+			_ = os.Unsetenv("NETRC")
+		}
+		Credentials, CredentialHelpers = nil, nil
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	entries, err := parseNetrc(strings.NewReader(`
+# a comment
+machine a.com login alice password secret1
+machine b.com
+  login bob # trailing comment
+  account whatever
+  password secret2
+macdef init
+cd /pub
+machine c.com login mallory password not-a-real-entry
+
+machine a.com login alice2 password ignored
+default login anonymous password guest
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]netrcEntry{
+		"a.com": {"alice", "secret1"},
+		"b.com": {"bob", "secret2"},
+		"":      {"anonymous", "guest"},
+	}, entries)
+
+	_, err = parseNetrc(strings.NewReader("machine a.com login"))
+	assert.Error(t, err)
+	_, err = parseNetrc(strings.NewReader("login alice"))
+	assert.Error(t, err)
+}
+
+func TestCredentials_Netrc(t *testing.T) {
+	server := authServer()
+	defer server.Close()
+	defer withCredentials(t, "machine 127.0.0.1 login alice password secret\n", nil, nil)()
+
+	assert.Equal(t, basicAuth("alice", "secret"), getAuth(t, server.URL))
+}
+
+func TestCredentials_NetrcDefault(t *testing.T) {
+	server := authServer()
+	defer server.Close()
+	defer withCredentials(t, "machine example.com login alice password secret\ndefault login anon password guest\n", nil, nil)()
+
+	assert.Equal(t, basicAuth("anon", "guest"), getAuth(t, server.URL))
+}
+
+func TestCredentials_Config(t *testing.T) {
+	server := authServer()
+	defer server.Close()
+	defer withCredentials(t, "machine 127.0.0.1 login alice password secret\n", []Credential{
+		{Host: "example.com", Token: "wrong"},
+		{Host: "127.0.0.1", Token: "t0k3n"},
+	}, nil)()
+
+	// The config file takes precedence over .netrc.
+	assert.Equal(t, "Bearer t0k3n", getAuth(t, server.URL))
+
+	Credentials = []Credential{{Host: strings.TrimPrefix(server.URL, "http://"), Username: "bob", Password: "pw"}}
+	assert.Equal(t, basicAuth("bob", "pw"), getAuth(t, server.URL))
+}
+
+func TestCredentials_Helper(t *testing.T) {
+	server := authServer()
+	defer server.Close()
+	helper := filepath.Join(t.TempDir(), "helper.sh")
+	testutil.WriteFile(t, helper, `#!/bin/sh
+[ "$1" = get ] || exit 1
+uri=$(sed 's/.*"uri":"\([^"]*\)".*/\1/')
+echo "{\"headers\": {\"Authorization\": [\"Bearer for $uri\"]}}"
+`)
+	require.NoError(t, os.Chmod(helper, 0755))
+	defer withCredentials(t, "machine 127.0.0.1 login alice password secret\n", []Credential{
+		{Host: "127.0.0.1", Token: "t0k3n"},
+	}, []string{"example.com=/nonexistent", "127.0.0.1=" + helper})()
+
+	// The helper takes precedence over everything else.
+	assert.Equal(t, "Bearer for "+server.URL+"/file", getAuth(t, server.URL+"/file"))
+}
+
+func TestCredentials_HelperFails(t *testing.T) {
+	helper := filepath.Join(t.TempDir(), "helper.sh")
+	testutil.WriteFile(t, helper, `#!/bin/sh
+echo '{"headers": {"Authorization": ["Bearer sup3rs3cret"]'
+`)
+	require.NoError(t, os.Chmod(helper, 0755))
+	defer withCredentials(t, "", nil, []string{helper})()
+
+	_, err := Get("http://127.0.0.1:1/file")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "malformed output")
+		assert.NotContains(t, err.Error(), "sup3rs3cret")
+	}
+}
+
+func TestFindCredentialHelper(t *testing.T) {
+	CredentialHelpers = []string{"a.com=/helper/a", "*.b.com=/helper/b", "/helper/default"}
+	defer func() { CredentialHelpers = nil }()
+	assert.Equal(t, "/helper/a", findCredentialHelper("a.com"))
+	assert.Equal(t, "/helper/default", findCredentialHelper("sub.a.com"))
+	assert.Equal(t, "/helper/b", findCredentialHelper("x.y.b.com"))
+	assert.Equal(t, "/helper/default", findCredentialHelper("b.com"))
+	assert.Equal(t, "/helper/default", findCredentialHelper("c.com"))
+}
@@ -0,0 +1,287 @@
+// Package httpclient implements the HTTP client used for all network traffic: requests time out if the server stops
+// responding, and transient failures are retried with exponential backoff.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Options configures how requests are made. A zero field means that the option is unset, and a lower-priority value
+// applies instead (see Current).
+type Options struct {
+	// ConnectTimeout limits how long establishing a TCP connection may take.
+	ConnectTimeout time.Duration
+	// ReadTimeout limits how long we wait for the response headers, and for each subsequent read from the response
+	// body. There's no limit on the total duration of a request, as large downloads can legitimately take a while.
+	ReadTimeout time.Duration
+	// MaxAttempts is the maximum number of times a request is made before giving up on transient failures. Like for the
+	// other options, zero leaves it unset rather than disabling requests.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry; it doubles after every failed attempt, up to MaxBackoff. The
+	// actual delay is randomized to between half of that and all of it, so that clients don't retry in lockstep.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var (
+	// DefaultOptions apply unless they're overridden.
+	DefaultOptions = Options{
+		ConnectTimeout: 30 * time.Second,
+		ReadTimeout:    60 * time.Second,
+		MaxAttempts:    5,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+	// WorkspaceOptions are set from the workspace_settings of the root module, and override DefaultOptions.
+	WorkspaceOptions Options
+	// FlagOptions are set from command line flags, and override everything else.
+	FlagOptions Options
+
+	// Offline disables all network access: every request fails with ErrOffline. Callers are expected to fall back to
+	// whatever they have cached locally.
+	Offline bool
+)
+
+// ErrOffline is returned (wrapped) for attempts to access the network in offline mode.
+var ErrOffline = errors.New("network access is disabled in offline mode")
+
+// Merge returns a copy of `o` where the fields set in `other` are overridden.
+func (o Options) Merge(other Options) Options {
+	if other.ConnectTimeout != 0 {
+		o.ConnectTimeout = other.ConnectTimeout
+	}
+	if other.ReadTimeout != 0 {
+		o.ReadTimeout = other.ReadTimeout
+	}
+	if other.MaxAttempts != 0 {
+		o.MaxAttempts = other.MaxAttempts
+	}
+	if other.InitialBackoff != 0 {
+		o.InitialBackoff = other.InitialBackoff
+	}
+	if other.MaxBackoff != 0 {
+		o.MaxBackoff = other.MaxBackoff
+	}
+	return o
+}
+
+// Validate checks that no option is negative. Zero is allowed, and means that the option is unset. The options are
+// named after the flags and workspace_settings that set them.
+func (o Options) Validate() error {
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"http_connect_timeout", o.ConnectTimeout},
+		{"http_read_timeout", o.ReadTimeout},
+		{"http_initial_backoff", o.InitialBackoff},
+		{"http_max_backoff", o.MaxBackoff},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%v must not be negative, got %v", d.name, d.value)
+		}
+	}
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("http_max_attempts must not be negative, got %v", o.MaxAttempts)
+	}
+	return nil
+}
+
+// Current returns the options in effect, taking into account all overrides.
+func Current() Options {
+	return DefaultOptions.Merge(WorkspaceOptions).Merge(FlagOptions)
+}
+
+var transport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: Current().ConnectTimeout, KeepAlive: 30 * time.Second}
+		return dialer.DialContext(ctx, network, addr)
+	},
+	ForceAttemptHTTP2:     true,
+	TLSHandshakeTimeout:   10 * time.Second,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+var client = &http.Client{Transport: transport}
+
+// Get issues a GET request to the given URL. See Do.
+func Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Do(req)
+}
+
+// Do sends the given request, which must not have a body, and returns the response. In offline mode, it fails
+// immediately. Credentials for the host are added from the configured sources (see Credentials). Connection errors and
+// responses with a transient error status (such as 503) are retried according to the current Options, honoring any
+// Retry-After header sent by the server. If all attempts fail, the last response is returned if there was one, so that
+// the caller can inspect its status like for any other response. The caller must close the response body.
+func Do(req *http.Request) (*http.Response, error) {
+	if Offline {
+		return nil, fmt.Errorf("%w: can't fetch %v", ErrOffline, req.URL.Redacted())
+	}
+	if req.Body != nil {
+		return nil, errors.New("requests with a body can't be retried")
+	}
+	req = req.Clone(req.Context())
+	if err := addCredentials(req); err != nil {
+		return nil, err
+	}
+	opts := Current()
+	backoff := opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		resp, err := doOnce(req, opts.ReadTimeout)
+		if attempt >= opts.MaxAttempts || !isTransient(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+			// Drain the body (up to a point) so that the connection can be reused.
+			_, _ = io.CopyN(ioutil.Discard, resp.Body, 64<<10)
+			resp.Body.Close()
+		}
+		if delay > opts.MaxBackoff {
+			delay = opts.MaxBackoff
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+}
+
+// doOnce sends the request, cancelling it if the server is silent for longer than `readTimeout` while we wait for the
+// headers or read the body.
+func doOnce(req *http.Request, readTimeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := &idleTimer{cancel: cancel}
+	timer.t = time.AfterFunc(readTimeout, timer.fire)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		timer.t.Stop()
+		cancel()
+		if timer.fired() {
+			return nil, &timeoutError{fmt.Sprintf("no response within %v: %v", readTimeout, err)}
+		}
+		return nil, err
+	}
+	resp.Body = &idleTimeoutBody{resp.Body, timer, readTimeout}
+	return resp, nil
+}
+
+// timeoutError is returned when the server doesn't respond within the read timeout. It doesn't wrap the error of the
+// request, which is merely the cancellation that the timeout caused.
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string { return e.msg }
+func (e *timeoutError) Timeout() bool { return true }
+
+type idleTimer struct {
+	t      *time.Timer
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	done   bool
+}
+
+func (i *idleTimer) fire() {
+	i.mu.Lock()
+	i.done = true
+	i.mu.Unlock()
+	i.cancel()
+}
+
+func (i *idleTimer) fired() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.done
+}
+
+// idleTimeoutBody restarts the idle timer whenever data arrives, and releases it once the body is closed.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timer   *idleTimer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if err != nil && b.timer.fired() {
+		return n, fmt.Errorf("no data received for %v: %v", b.timeout, err)
+	}
+	b.timer.t.Reset(b.timeout)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.t.Stop()
+	err := b.body.Close()
+	b.timer.cancel()
+	return err
+}
+
+// isTransient reports whether a request that resulted in the given response or error is worth retrying.
+func isTransient(resp *http.Response, err error) bool {
+	if err != nil {
+		// Errors such as bad certificates or URLs, or the caller giving up, would only happen again.
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		// Timeouts and dropped connections may well go away. The transport reports a connection that was closed before
+		// the response arrived as io.EOF.
+		var timeout interface{ Timeout() bool }
+		return (errors.As(err, &timeout) && timeout.Timeout()) ||
+			errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
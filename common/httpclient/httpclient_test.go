@@ -0,0 +1,233 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func withOptions(opts Options) func() {
+	old := FlagOptions
+	FlagOptions = opts
+	return func() { FlagOptions = old }
+}
+
+// flakyServer fails the first `failures` requests with the given status, then serves "ok". The number of requests
+// received is counted in `requests`.
+func flakyServer(failures int32, status int, header http.Header, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(requests, 1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	var requests int32
+	server := flakyServer(2, http.StatusServiceUnavailable, nil, &requests)
+	defer server.Close()
+
+	resp, err := Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(3), requests)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	var requests int32
+	server := flakyServer(5, http.StatusBadGateway, nil, &requests)
+	defer server.Close()
+
+	// The last response is handed to the caller.
+	resp, err := Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, int32(3), requests)
+}
+
+func TestNoRetryOnPermanentStatus(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	var requests int32
+	server := flakyServer(1, http.StatusNotFound, nil, &requests)
+	defer server.Close()
+
+	resp, err := Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, int32(1), requests)
+}
+
+func TestRetryAfter(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Minute})()
+	var requests int32
+	server := flakyServer(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, &requests)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+func TestRetryAfterIsCapped(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	var requests int32
+	server := flakyServer(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}}, &requests)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetryConnectionError(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	_, err := Get(url)
+	assert.Error(t, err)
+}
+
+func TestNoRetryOnPermanentError(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})()
+	var connections int32
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// The server's certificate isn't trusted, which retrying won't change.
+	_, err := Get(server.URL)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: io.EOF}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: io.ErrUnexpectedEOF}, true},
+		{&timeoutError{"no response within 1s: context canceled"}, true},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Get", URL: "ftp://example.com", Err: errors.New(`unsupported protocol scheme "ftp"`)}, false},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: context.Canceled}, false},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: context.DeadlineExceeded}, false},
+	} {
+		assert.Equal(t, tc.transient, isTransient(nil, tc.err), tc.err.Error())
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	defer withOptions(Options{MaxAttempts: 1, ReadTimeout: 50 * time.Millisecond})()
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow_body" {
+			_, _ = w.Write([]byte("some"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	// The server never sends the headers.
+	_, err := Get(server.URL + "/slow_headers")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no response within 50ms")
+	}
+
+	// The server sends part of the body, then stalls.
+	resp, err := Get(server.URL + "/slow_body")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no data received for 50ms")
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.NoError(t, Options{}.Validate())
+	assert.NoError(t, DefaultOptions.Validate())
+	err := Options{InitialBackoff: -time.Second}.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "http_initial_backoff must not be negative")
+	}
+	assert.Error(t, Options{MaxAttempts: -1}.Validate())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	d, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 120*time.Second, d)
+
+	d, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, float64(time.Hour), float64(d), float64(5*time.Second))
+
+	d, ok = parseRetryAfter("Mon, 01 Jan 2001 00:00:00 GMT")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), d)
+
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("")
+	assert.False(t, ok)
+}
+
+func TestOffline(t *testing.T) {
+	Offline = true
+	defer func() { Offline = false }()
+	var requests int32
+	server := flakyServer(0, http.StatusOK, nil, &requests)
+	defer server.Close()
+
+	_, err := Get(server.URL + "/file")
+	if assert.True(t, errors.Is(err, ErrOffline)) {
+		assert.Contains(t, err.Error(), server.URL+"/file")
+	}
+	assert.Equal(t, int32(0), requests)
+}
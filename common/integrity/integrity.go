@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
@@ -47,7 +48,19 @@ func Check(r io.Reader, integrity string) (bool, error) {
 	return checker.Check(), nil
 }
 
+// Digest is a single hash value from integrity metadata, along with the name of the algorithm that produced it.
+type Digest struct {
+	Algorithm string
+	Value     []byte
+}
+
+// Hex returns the hash value as a lowercase hexadecimal string.
+func (d Digest) Hex() string {
+	return hex.EncodeToString(d.Value)
+}
+
 type subChecker struct {
+	algo   string
 	hash   hash.Hash
 	digest []byte
 }
@@ -83,6 +96,7 @@ func NewChecker(integrity string) (Checker, error) {
 				return nil, fmt.Errorf("%w: couldn't decode base64 payload: %s", ErrBadIntegrity, matches[2])
 			}
 			checker = append(checker, subChecker{
+				algo:   matches[1],
 				hash:   algo.fn(),
 				digest: digest,
 			})
@@ -96,6 +110,27 @@ func NewChecker(integrity string) (Checker, error) {
 	return checker, nil
 }
 
+// ParseDigests returns all digests in the given integrity metadata that use a recognized algorithm, regardless of
+// priority. This is useful for looking up content by a specific algorithm; to check content, use a Checker.
+func ParseDigests(integrity string) ([]Digest, error) {
+	var digests []Digest
+	for _, expr := range strings.Fields(integrity) {
+		matches := exprRegexp.FindStringSubmatch(expr)
+		if len(matches) != 4 {
+			return nil, fmt.Errorf("%w: couldn't parse hash-with-options: %s", ErrBadIntegrity, expr)
+		}
+		if algos[matches[1]].priority <= 0 {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(matches[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't decode base64 payload: %s", ErrBadIntegrity, matches[2])
+		}
+		digests = append(digests, Digest{matches[1], digest})
+	}
+	return digests, nil
+}
+
 // Write adds more data to the underlying running hash(es).
 func (c Checker) Write(p []byte) (n int, err error) {
 	for _, sub := range c {
@@ -112,13 +147,30 @@ func (c Checker) Check() bool {
 		// return true.
 		return true
 	}
+	// If any sub-checker passes, it should return true.
+	_, ok := c.Matched()
+	return ok
+}
+
+// Matched returns the digest that the data written so far (with Write) matches, if any. Unlike Check, an empty Checker
+// never matches.
+func (c Checker) Matched() (Digest, bool) {
 	for _, sub := range c {
-		// If any sub-checker passes, it should return true.
 		if bytes.Equal(sub.hash.Sum(nil), sub.digest) {
-			return true
+			return Digest{sub.algo, sub.digest}, true
 		}
 	}
-	return false
+	return Digest{}, false
+}
+
+// Digests returns the digests that the Checker checks against. Only digests using the strongest algorithm found in the
+// original integrity metadata are included, so this is empty if the integrity was empty.
+func (c Checker) Digests() []Digest {
+	var digests []Digest
+	for _, sub := range c {
+		digests = append(digests, Digest{sub.algo, sub.digest})
+	}
+	return digests
 }
 
 // Reset resets the Checker to its initial state, so that previously written data no longer counts.
@@ -140,6 +192,20 @@ func Generate(algorithm string, bytes []byte) string {
 	return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
+// GenerateFromReader is like Generate, but hashes everything read from the given reader, without holding it all in
+// memory.
+func GenerateFromReader(algorithm string, r io.Reader) (string, error) {
+	algo := algos[algorithm]
+	if algo.priority <= 0 {
+		return "", nil
+	}
+	h := algo.fn()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
 // MustGenerate behaves like Generate, except that an unrecognized or deprecated algortihm causes a panic.
 func MustGenerate(algorithm string, bytes []byte) string {
 	s := Generate(algorithm, bytes)
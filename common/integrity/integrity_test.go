@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -112,6 +113,58 @@ func TestCheckerWriteReset(t *testing.T) {
 	}
 }
 
+func TestDigestsAndMatched(t *testing.T) {
+	sha256Hash := sha256.Sum256(payload)
+	goodHash := sha512.Sum512(payload)
+	otherHash := sha512.Sum512(badPayload)
+	checker, err := NewChecker(fmt.Sprintf(
+		"sha256-%v sha512-%v sha512-%v",
+		base64.StdEncoding.EncodeToString(sha256Hash[:]),
+		base64.StdEncoding.EncodeToString(otherHash[:]),
+		base64.StdEncoding.EncodeToString(goodHash[:]),
+	))
+	if assert.NoError(t, err) {
+		// Only the strongest algorithm counts.
+		assert.Equal(t, []Digest{{"sha512", otherHash[:]}, {"sha512", goodHash[:]}}, checker.Digests())
+
+		_, _ = checker.Write(payload)
+		matched, ok := checker.Matched()
+		assert.True(t, ok)
+		assert.Equal(t, Digest{"sha512", goodHash[:]}, matched)
+		assert.Equal(t, hex.EncodeToString(goodHash[:]), matched.Hex())
+
+		checker.Reset()
+		_, _ = checker.Write([]byte("something else"))
+		_, ok = checker.Matched()
+		assert.False(t, ok)
+	}
+
+	checker, err = NewChecker("")
+	if assert.NoError(t, err) {
+		assert.Empty(t, checker.Digests())
+		_, ok := checker.Matched()
+		assert.False(t, ok)
+		assert.True(t, checker.Check())
+	}
+}
+
+func TestParseDigests(t *testing.T) {
+	sha256Hash := sha256.Sum256(payload)
+	sha512Hash := sha512.Sum512(payload)
+	digests, err := ParseDigests(fmt.Sprintf(
+		"sha512-%v md5-%v weirdalgo-%v sha256-%v?opt",
+		base64.StdEncoding.EncodeToString(sha512Hash[:]),
+		base64.StdEncoding.EncodeToString([]byte("md5")),
+		base64.StdEncoding.EncodeToString([]byte("weird")),
+		base64.StdEncoding.EncodeToString(sha256Hash[:]),
+	))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []Digest{{"sha512", sha512Hash[:]}, {"sha256", sha256Hash[:]}}, digests)
+	}
+	_, err = ParseDigests("sha256")
+	assert.Error(t, err)
+}
+
 func TestBadIntegrity(t *testing.T) {
 	_, err := NewChecker("sha512")
 	if err == nil {
@@ -137,3 +190,12 @@ func TestGenerate(t *testing.T) {
 	goodHash := sha512.Sum512(payload)
 	assert.Equal(t, "sha512-"+base64.StdEncoding.EncodeToString(goodHash[:]), Generate("sha512", payload))
 }
+
+func TestGenerateFromReader(t *testing.T) {
+	generated, err := GenerateFromReader("sha512", bytes.NewReader(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, Generate("sha512", payload), generated)
+	generated, err = GenerateFromReader("md5", bytes.NewReader(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, "", generated)
+}
@@ -1,26 +1,57 @@
 package testutil
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func StaticHttpServer(files map[string][]byte) *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	return httptest.NewServer(staticHandler(files))
+}
+
+func staticHandler(files map[string][]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
 		p, ok := files[req.URL.Path]
 		if ok {
 			_, _ = w.Write(p)
 		} else {
 			http.NotFound(w, req)
 		}
+	}
+}
+
+// FlakyHttpServer is like StaticHttpServer, but fails the first `failures` requests for each path with a "503 Service
+// Unavailable" status. The failures come with a "Retry-After: 0" header, so that retries don't slow down tests.
+func FlakyHttpServer(files map[string][]byte, failures int) *httptest.Server {
+	var mu sync.Mutex
+	failed := map[string]int{}
+	static := staticHandler(files)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		fail := failed[req.URL.Path] < failures
+		if fail {
+			failed[req.URL.Path]++
+		}
+		mu.Unlock()
+		if fail {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		static.ServeHTTP(w, req)
 	}))
 }
 
@@ -37,6 +68,48 @@ func BuildZipArchive(t *testing.T, files map[string][]byte) []byte {
 	return b.Bytes()
 }
 
+func BuildTarArchive(t *testing.T, files map[string][]byte) []byte {
+	b := &bytes.Buffer{}
+	w := tar.NewWriter(b)
+	for path, contents := range files {
+		require.NoError(t, w.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+		}), path)
+		_, err := w.Write(contents)
+		require.NoError(t, err, path)
+	}
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+// BuildGitRepo creates a bare Git repository at `dir` with one commit for each element of `commits`. Each commit
+// writes the given files on top of the previous commit. The hashes of the commits are returned in order.
+func BuildGitRepo(t *testing.T, dir string, commits ...map[string][]byte) []string {
+	workDir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=bzlmod", "-c", "user.email=bzlmod@bazel.build"}, args...)...)
+		cmd.Dir = workDir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "git %v: %s", args, out)
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "--quiet")
+	var hashes []string
+	for i, files := range commits {
+		for path, contents := range files {
+			WriteFileBytes(t, filepath.Join(workDir, filepath.FromSlash(path)), contents)
+		}
+		git("add", "--all")
+		git("commit", "--quiet", "--allow-empty", "-m", fmt.Sprintf("commit #%v", i))
+		hashes = append(hashes, git("rev-parse", "HEAD"))
+	}
+	git("clone", "--quiet", "--bare", workDir, dir)
+	return hashes
+}
+
 func WriteFile(t *testing.T, filename string, contents string) {
 	WriteFileBytes(t, filename, []byte(contents))
 }
@@ -1,12 +1,15 @@
 package testutil
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os/exec"
 	"path/filepath"
 	"testing"
 )
@@ -75,6 +78,55 @@ func TestBuildZipArchive(t *testing.T) {
 	assert.Empty(t, files)
 }
 
+func TestBuildTarArchive(t *testing.T) {
+	files := map[string][]byte{
+		"a":     []byte("a"),
+		"b/a":   []byte("ba"),
+		"c/b/a": []byte("cba"),
+	}
+	a := BuildTarArchive(t, files)
+	tr := tar.NewReader(bytes.NewReader(a))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		expected, ok := files[header.Name]
+		if assert.True(t, ok, header.Name) {
+			delete(files, header.Name)
+			actual, err := ioutil.ReadAll(tr)
+			if assert.NoError(t, err, header.Name) {
+				assert.Equal(t, string(expected), string(actual))
+			}
+		}
+	}
+	assert.Empty(t, files)
+}
+
+func TestBuildGitRepo(t *testing.T) {
+	repoDir := filepath.Join(t.TempDir(), "repo.git")
+	commits := BuildGitRepo(t, repoDir,
+		map[string][]byte{"a": []byte("a"), "b/a": []byte("ba")},
+		map[string][]byte{"a": []byte("aa")},
+	)
+	require.Len(t, commits, 2)
+	assert.NotEqual(t, commits[0], commits[1])
+
+	out, err := exec.Command("git", "--git-dir", repoDir, "show", commits[0]+":a").Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a", string(out))
+	}
+	out, err = exec.Command("git", "--git-dir", repoDir, "show", commits[1]+":a").Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "aa", string(out))
+	}
+	out, err = exec.Command("git", "--git-dir", repoDir, "show", commits[1]+":b/a").Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ba", string(out))
+	}
+}
+
 func TestWriteAssertFile(t *testing.T) {
 	dir := t.TempDir()
 	WriteFile(t, filepath.Join(dir, "a", "b", "c"), "ping pong")
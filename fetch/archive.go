@@ -1,13 +1,12 @@
 package fetch
 
 import (
-	"archive/zip"
+	"errors"
 	"fmt"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
 	integrities "github.com/bazelbuild/bzlmod/common/integrity"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	urls "net/url"
 	"os"
 	"path/filepath"
@@ -20,6 +19,10 @@ type Archive struct {
 	Integrity   string
 	StripPrefix string
 	Patches     []Patch
+	// Type is the type of the archive (such as "zip" or "tar.gz"). If empty, it's detected from the URL or the contents
+	// of the archive. It's encoded as "ArchiveType", since JSON keys are matched case-insensitively and "type" is the key
+	// of the Wrapper envelope.
+	Type string `json:"ArchiveType"`
 
 	// Fprint should be a hash computed from information that is enough to distinguish this archive fetch from
 	// others. It will be used as the name of the shared repo directory.
@@ -27,6 +30,10 @@ type Archive struct {
 	Fprint string
 }
 
+func init() {
+	RegisterType("archive", func() Fetcher { return &Archive{} })
+}
+
 func (a *Archive) Fingerprint() string {
 	return a.Fprint
 }
@@ -37,61 +44,31 @@ func (a *Archive) AppendPatches(patches []Patch) error {
 }
 
 func (a *Archive) Fetch(vendorDir string) (string, error) {
-	// If we're in vendoring mode and the vendorDir exists and has the right fingerprint, return immediately.
-	if vendorDir != "" && verifyFingerprintFile(vendorDir, a.Fprint) {
-		return filepath.Abs(vendorDir)
-	}
+	return fetchWithSharedRepoDir(a.Fprint, vendorDir, a.downloadExtractAndPatch)
+}
 
-	// Otherwise, check if the corresponding shared repo directory exists and has the right fingerprint (in which case
-	// we can skip the download).
-	// It might seem redundant to check for the fingerprint as the name of the directory is itself the fingerprint;
-	// however, the fingerprint file is only written if the download, extraction or patching didn't fail halfway.
-	sharedRepoDir, err := SharedRepoDir(a.Fprint)
-	if err != nil {
-		return "", err
-	}
-	sharedRepoDirReady := verifyFingerprintFile(sharedRepoDir, a.Fprint)
+func (a *Archive) fetchFresh(destDir string) error {
+	return a.downloadExtractAndPatch(destDir)
+}
 
-	// If we're not in vendoring mode, just prep the shared repo dir if it's not ready, and return that directory.
-	if vendorDir == "" {
-		if !sharedRepoDirReady {
-			if err := a.downloadExtractAndPatch(sharedRepoDir); err != nil {
-				return "", err
-			}
-			if err := writeFingerprintFile(sharedRepoDir, a.Fprint); err != nil {
-				return "", fmt.Errorf("can't write fingerprint file: %v", err)
-			}
-		}
-		return sharedRepoDir, nil
+func (a *Archive) CacheEntries() ([]string, error) {
+	downloads, err := downloadCacheEntries(a.URLs, a.Integrity)
+	if err != nil {
+		return nil, err
 	}
-
-	// If we're in vendoring mode, we should either copy from the shared repo dir if it's ready, or otherwise download
-	// straight into the vendor dir.
-	if sharedRepoDirReady {
-		// Copy the entire directory over. Note that the fingerprint file itself is explicitly not copied, so that we
-		// only write it in the end if the whole copy succeeded.
-		if err := copyDirWithoutFingerprintFile(sharedRepoDir, vendorDir); err != nil {
-			return "", fmt.Errorf("error copying shared repo dir to vendor dir: %v", err)
-		}
-	} else {
-		if err := a.downloadExtractAndPatch(vendorDir); err != nil {
-			return "", err
-		}
+	patches, err := patchCacheEntries(a.Patches)
+	if err != nil {
+		return nil, err
 	}
-	// Write the fingerprint file.
-	if err := writeFingerprintFile(vendorDir, a.Fprint); err != nil {
-		return "", fmt.Errorf("can't write fingerprint file: %v", err)
+	shared, err := sharedRepoCacheEntries(a.Fprint)
+	if err != nil {
+		return nil, err
 	}
-	return filepath.Abs(vendorDir)
-}
-
-func verifyFingerprintFile(dir string, fprint string) bool {
-	actualFprint, err := ioutil.ReadFile(filepath.Join(dir, "bzlmod.fingerprint"))
-	return err == nil && string(actualFprint) == fprint
+	return append(append(downloads, patches...), shared...), nil
 }
 
-func writeFingerprintFile(dir string, fprint string) error {
-	return ioutil.WriteFile(filepath.Join(dir, "bzlmod.fingerprint"), []byte(fprint), 0666)
+func (a *Archive) DownloadURLs() ([]string, string) {
+	return a.URLs, a.Integrity
 }
 
 func (a *Archive) downloadExtractAndPatch(destDir string) error {
@@ -100,80 +77,89 @@ func (a *Archive) downloadExtractAndPatch(destDir string) error {
 		return err
 	}
 
-	archivePath := ""
-	rawurl := ""
-	for _, rawurl = range a.URLs {
+	archivePath, rawurl, unlock, err := downloadFromURLs(a.URLs, integ, "archive")
+	if err != nil {
+		return err
+	}
+
+	// Now perform the extraction.
+	err = a.extract(archivePath, rawurl, destDir)
+	unlock()
+	if err != nil {
+		return err
+	}
+	return applyPatches(destDir, a.Patches)
+}
+
+func (a *Archive) extract(archivePath string, rawurl string, destDir string) error {
+	archiveType, err := detectArchiveType(a.Type, rawurl, archivePath)
+	if err != nil {
+		return err
+	}
+	if err := extractArchive(archivePath, archiveType, destDir, a.StripPrefix); err != nil {
+		return fmt.Errorf("error extracting archive downloaded from %v: %w", rawurl, err)
+	}
+	return nil
+}
+
+// downloadFromURLs returns the path to a local copy of the file that can be downloaded from any of the given URLs, along
+// with the URL that it came from. `what` describes the file in error messages. If the copy is in the cache, it stays
+// locked until the returned function is called.
+func downloadFromURLs(rawurls []string, integ integrities.Checker, what string) (string, string, func(), error) {
+	// An archive with the right digest may already be in the cache, even if it was downloaded from a URL that's not in
+	// the list (such as a mirror, or the old location of a moved file).
+	fp, unlock, err := lockedCASLookup(integ)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if fp != "" {
+		rawurl := ""
+		if len(rawurls) > 0 {
+			// Still useful for detecting the archive type.
+			rawurl = rawurls[0]
+		}
+		return fp, rawurl, unlock, nil
+	}
+
+	var offlineURLs []string
+	for _, rawurl := range rawurls {
 		url, err := urls.Parse(rawurl)
 		if err != nil {
 			log.Printf("failed to parse URL: %v\n", err)
 			continue
 		}
+		var fp string
+		unlock := func() {}
 		switch url.Scheme {
 		case "http", "https":
-			archivePath, err = cachedDownload(rawurl, integ)
+			fp, unlock, err = cachedDownload(rawurl, integ)
 		case "file":
-			archivePath = filepath.FromSlash(url.Path)
-			err = verifyIntegrity(archivePath, integ)
+			fp = filepath.FromSlash(url.Path)
+			err = verifyIntegrity(fp, integ)
 		default:
 			log.Printf("unrecognized scheme: %v\n", url.Scheme)
 			continue
 		}
 		if err == nil {
-			break
+			return fp, rawurl, unlock, nil
+		}
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			// Other URLs serve the same file, so they'd breach the limit just the same.
+			return "", "", nil, err
+		}
+		if errors.Is(err, httpclient.ErrOffline) {
+			offlineURLs = append(offlineURLs, rawurl)
+			continue
 		}
 		log.Printf("error fetching from %v: %v\n", rawurl, err)
 	}
-
-	if archivePath == "" {
-		// All our attempts to fetch from those URLs failed.
-		return fmt.Errorf("error downloading archive")
-	}
-
-	// Now perform the extraction.
-	// TODO: support other archive formats
-	if err := extractZipFile(archivePath, destDir, a.StripPrefix); err != nil {
-		return fmt.Errorf("error extracting archive downloaded from %v: %v", rawurl, err)
+	// All our attempts to fetch from those URLs failed.
+	if len(offlineURLs) > 0 {
+		return "", "", nil, fmt.Errorf("%w: %v isn't in the download cache, and can't be fetched from %v",
+			httpclient.ErrOffline, what, strings.Join(offlineURLs, ", "))
 	}
-	// TODO: patch
-	return nil
-}
-
-// Downloads the given URL into the central cache location and returns the file path.
-func cachedDownload(url string, integ integrities.Checker) (string, error) {
-	fp, err := HTTPCacheFilePath(url)
-	if err != nil {
-		return "", err
-	}
-	// TODO: deal with concurrent access. What if another `bzlmod fetch` is executed at the same time?
-	if verifyIntegrity(fp, integ) == nil {
-		// This file exists in the cache and matches the specified integrity. Return its path immediately.
-		return fp, nil
-	}
-	// The file doesn't exist in the cache, or doesn't match the given integrity. Re-download it.
-	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
-		return "", fmt.Errorf("can't create directories for http cache: %v", err)
-	}
-	f, err := os.Create(fp)
-	if err != nil {
-		return "", fmt.Errorf("can't create http cache file: %v", err)
-	}
-	defer f.Close()
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		return "", fmt.Errorf("got status: %v", resp.Status)
-	}
-	integ.Reset()
-	if _, err := io.Copy(io.MultiWriter(f, integ), resp.Body); err != nil {
-		return "", err
-	}
-	if !integ.Check() {
-		return "", fmt.Errorf("failed integrity check")
-	}
-	return fp, nil
+	return "", "", nil, fmt.Errorf("error downloading %v", what)
 }
 
 // Verifies the integrity of the file at path `fp` against the given integrity checker.
@@ -196,78 +182,3 @@ func verifyIntegrity(fp string, integ integrities.Checker) error {
 	}
 	return nil
 }
-
-func extractZipFile(archivePath string, destDir string, stripPrefix string) error {
-	if err := os.RemoveAll(destDir); err != nil {
-		return err
-	}
-	r, err := zip.OpenReader(archivePath)
-	if err != nil {
-		return err
-	}
-	defer r.Close()
-	for _, f := range r.File {
-		fr, err := f.Open()
-		if err != nil {
-			return fmt.Errorf("can't open file for reading %v: %v", f.Name, err)
-		}
-		defer fr.Close()
-		relPath := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(f.Name, stripPrefix)))
-		absPath := filepath.Join(destDir, relPath)
-		if err := os.MkdirAll(filepath.Dir(absPath), 0777); err != nil {
-			return fmt.Errorf("can't create directories for %v: %v", absPath, err)
-		}
-		w, err := os.Create(absPath)
-		if err != nil {
-			return fmt.Errorf("can't create file for writing %v: %v", absPath, err)
-		}
-		defer w.Close()
-		_, err = io.Copy(w, fr)
-		if err != nil {
-			return fmt.Errorf("error during I/O: %v", err)
-		}
-	}
-	return nil
-}
-
-func copyDirWithoutFingerprintFile(from string, to string) error {
-	if err := os.RemoveAll(to); err != nil {
-		return err
-	}
-	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		relpath, err := filepath.Rel(from, path)
-		if err != nil {
-			return err
-		}
-		if relpath == "bzlmod.fingerprint" {
-			// skip the fingerprint file itself.
-			return nil
-		}
-		r, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer r.Close()
-		topath := filepath.Join(to, relpath)
-		err = os.MkdirAll(filepath.Dir(topath), 0777)
-		if err != nil {
-			return err
-		}
-		w, err := os.Create(topath)
-		if err != nil {
-			return err
-		}
-		defer w.Close()
-		_, err = io.Copy(w, r)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
-}
@@ -1,7 +1,11 @@
 package fetch
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
 	"github.com/bazelbuild/bzlmod/common/integrity"
 	"github.com/bazelbuild/bzlmod/common/testutil"
 	"github.com/stretchr/testify/assert"
@@ -11,6 +15,12 @@ import (
 	"testing"
 )
 
+// casPath returns the path of the given contents in the content-addressable part of the HTTP cache.
+func casPath(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return filepath.Join(TestBzlmodDir, "http_cache", "cas", "sha256", hex.EncodeToString(sum[:]))
+}
+
 func TestArchive_SharedRepoDirReady(t *testing.T) {
 	TestBzlmodDir = t.TempDir()
 	defer func() { TestBzlmodDir = "" }()
@@ -83,7 +93,7 @@ func TestArchive_GoodContentsInHTTPCache(t *testing.T) {
 		Fprint:    "some_fingerprint",
 	}
 
-	testutil.WriteFileBytes(t, filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/a.zip")), zipArchive)
+	testutil.WriteFileBytes(t, casPath(zipArchive), zipArchive)
 
 	fp, err := a.Fetch("")
 	require.NoError(t, err)
@@ -112,8 +122,7 @@ func TestArchive_BadContentsInHTTPCache(t *testing.T) {
 		Fprint:    "some_fingerprint",
 	}
 
-	testutil.WriteFile(t, filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/a.zip")),
-		"wrong file contents which should fail integrity check")
+	testutil.WriteFile(t, casPath(zipArchive), "wrong file contents which should fail integrity check")
 
 	fp, err := a.Fetch("")
 	require.NoError(t, err)
@@ -159,7 +168,93 @@ func TestArchive_DownloadCascade(t *testing.T) {
 	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
 	testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
 
-	testutil.AssertFileContentsBytes(t, filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/good.zip")), zipArchive)
+	// The download is filed under the digest that it matched.
+	testutil.AssertFileContentsBytes(t, casPath(zipArchive), zipArchive)
+	_, err = os.Stat(casPath(anotherZipArchive))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchive_RetriesTransientFailures(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1": []byte(`file1contents`),
+	})
+	server := testutil.FlakyHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+	}, 2)
+	defer server.Close()
+
+	a := Archive{
+		URLs:      []string{server.URL + "/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+}
+
+func TestArchive_CASSharedBetweenURLs(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1": []byte(`file1contents`),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/old/a.zip": zipArchive,
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:      []string{server.URL + "/old/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	_, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContentsBytes(t, casPath(zipArchive), zipArchive)
+	// Downloads with a known integrity don't go into the URL-keyed part of the cache.
+	_, err = os.Stat(filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/old/a.zip")))
+	assert.True(t, os.IsNotExist(err))
+
+	// The file has since moved, and the new URL doesn't even work yet; the cached download should still be used.
+	b := Archive{
+		URLs:      []string{server.URL + "/new/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "another_fingerprint",
+	}
+	fp, err := b.Fetch("")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", "another_fingerprint"), fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+}
+
+func TestDownloadFromURLs_CachedFileStaysLocked(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := []byte("contents")
+	cached := writeCacheFile(t, "http_cache/cas/sha256/"+filepath.Base(casPath(contents)), 0, 0)
+	testutil.WriteFileBytes(t, cached, contents)
+	integ, err := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	require.NoError(t, err)
+
+	// The file is found in the cache, so the URL isn't even tried.
+	fp, _, unlock, err := downloadFromURLs([]string{"https://nonexistent.invalid/a"}, integ, "file")
+	require.NoError(t, err)
+	assert.Equal(t, cached, fp)
+	// Clean can't remove the file while it's in use.
+	result, err := Clean(CleanOptions{All: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.InUse)
+	assertExists(t, cached)
+
+	unlock()
+	_, err = Clean(CleanOptions{All: true})
+	require.NoError(t, err)
+	assertNotExist(t, cached)
 }
 
 func TestArchive_DownloadFails(t *testing.T) {
@@ -343,4 +438,46 @@ func TestArchive_Vendor_CopyFromSharedRepoDir(t *testing.T) {
 	testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
 }
 
-// TODO: test StripPrefix
+func TestArchive_Offline(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1": []byte(`file1contents`),
+	})
+	otherZipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file2": []byte(`file2contents`),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+		"/b.zip": otherZipArchive,
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:      []string{server.URL + "/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	_, err := a.Fetch("")
+	require.NoError(t, err)
+
+	httpclient.Offline = true
+	defer func() { httpclient.Offline = false }()
+
+	// The archive is in the download cache, so it can be extracted again.
+	a.Fprint = "another_fingerprint"
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+
+	b := Archive{
+		URLs:      []string{server.URL + "/b.zip"},
+		Integrity: integrity.MustGenerate("sha256", otherZipArchive),
+		Fprint:    "yet_another_fingerprint",
+	}
+	_, err = b.Fetch("")
+	if assert.True(t, errors.Is(err, httpclient.ErrOffline)) {
+		assert.Contains(t, err.Error(), server.URL+"/b.zip")
+	}
+}
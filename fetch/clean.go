@@ -0,0 +1,346 @@
+package fetch
+
+import (
+	"fmt"
+	integrities "github.com/bazelbuild/bzlmod/common/integrity"
+	"io/ioutil"
+	urls "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CleanOptions selects which entries of the bzlmod cache dir Clean removes. An entry is removed if any of the options
+// selects it.
+type CleanOptions struct {
+	// All removes everything.
+	All bool
+	// OlderThan removes entries that haven't been used for longer than this (if non-zero).
+	OlderThan time.Duration
+	// MaxSize removes the least recently used entries until the total size of the cache is at most this many bytes (if
+	// non-zero).
+	MaxSize int64
+	// Keep, if non-nil, removes all downloads and shared repos that aren't in this set. Use CacheEntries to find the
+	// entries that a fetcher uses. Registry files are left alone: resolving offline needs those of every module version
+	// that was considered, which lockfiles don't record.
+	Keep map[string]bool
+}
+
+// CleanResult summarizes what Clean did.
+type CleanResult struct {
+	Removed      int
+	RemovedBytes int64
+	// InUse counts the entries that should have been removed, but were skipped since a fetch was using them.
+	InUse int
+	// Remaining counts the entries left in the cache.
+	Remaining      int
+	RemainingBytes int64
+}
+
+// String formats the result for humans.
+func (r CleanResult) String() string {
+	s := fmt.Sprintf("removed %v entries (%v bytes); %v entries (%v bytes) remain", r.Removed, r.RemovedBytes,
+		r.Remaining, r.RemainingBytes)
+	if r.InUse > 0 {
+		s += fmt.Sprintf("; skipped %v entries in use", r.InUse)
+	}
+	return s
+}
+
+// staleTempAge is how old a temporary file without a lock must be before it's considered garbage.
+const staleTempAge = time.Hour
+
+// cacheEntry is a file or directory in the bzlmod cache dir that Clean can remove.
+type cacheEntry struct {
+	path string
+	// key is the path of the entry that this one belongs to, whose lock guards it and which decides whether it's kept.
+	// For a partial download or a temporary directory, that's the entry it's going to become; otherwise, it's the path
+	// of the entry itself.
+	key    string
+	locked bool
+	// registry is set for cached registry files, which Keep doesn't apply to.
+	registry bool
+	size     int64
+	lastUse  time.Time
+	temp     bool
+}
+
+// touchEntry records that the given cache entry was just used, for the purpose of evicting the least recently used
+// entries first. Access times can't be relied on, as many filesystems don't update them.
+func touchEntry(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// Clean removes entries from the bzlmod cache dir (downloads, shared repos, and cached registry files) according to
+// the given options. Entries that are locked by an ongoing fetch are skipped. The lock file of an entry is removed
+// along with it, while holding the lock; see lockCurrentFile for how waiters cope with that. Temporary files left
+// behind by crashed fetches are always removed.
+func Clean(opts CleanOptions) (CleanResult, error) {
+	var result CleanResult
+	bzlmodDir, err := BzlmodDir()
+	if err != nil {
+		return result, err
+	}
+	entries, err := listCacheEntries(bzlmodDir)
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := time.Now().Add(-opts.OlderThan)
+	var remaining []cacheEntry
+	for _, entry := range entries {
+		remove := opts.All ||
+			(opts.OlderThan != 0 && entry.lastUse.Before(cutoff)) ||
+			(opts.Keep != nil && !entry.registry && !opts.Keep[entry.key]) ||
+			(entry.temp && (entry.locked || time.Since(entry.lastUse) > staleTempAge))
+		if !remove || !removeEntry(entry, &result) {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	if opts.MaxSize != 0 {
+		var total int64
+		for _, entry := range remaining {
+			total += entry.size
+		}
+		// Evict the least recently used entries first.
+		sort.SliceStable(remaining, func(i, j int) bool { return remaining[i].lastUse.Before(remaining[j].lastUse) })
+		var kept []cacheEntry
+		for _, entry := range remaining {
+			if total > opts.MaxSize && removeEntry(entry, &result) {
+				total -= entry.size
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		remaining = kept
+	}
+
+	for _, entry := range remaining {
+		result.Remaining++
+		result.RemainingBytes += entry.size
+	}
+	return result, nil
+}
+
+// removeEntry removes the given entry unless it's in use, and records the outcome in `result`. It returns whether the
+// entry was removed.
+func removeEntry(entry cacheEntry, result *CleanResult) bool {
+	if entry.locked {
+		unlock, ok, err := tryLockEntry(entry.key)
+		if err != nil || !ok {
+			result.InUse++
+			return false
+		}
+		defer unlock()
+	}
+	if err := os.RemoveAll(entry.path); err != nil {
+		return false
+	}
+	if entry.locked {
+		// Partial downloads and temporary directories share the lock of the entry they're going to become, so the
+		// lock file is only removed once that's gone.
+		if _, err := os.Lstat(entry.key); os.IsNotExist(err) {
+			_ = os.Remove(entry.key + ".lock")
+		}
+	}
+	result.Removed++
+	result.RemovedBytes += entry.size
+	return true
+}
+
+// listCacheEntries lists all removable entries under the bzlmod cache dir.
+func listCacheEntries(bzlmodDir string) ([]cacheEntry, error) {
+	type cacheDir struct {
+		path   string
+		locked bool
+	}
+	httpCacheDir := filepath.Join(bzlmodDir, "http_cache")
+	registryCacheDir := filepath.Join(bzlmodDir, "registry_cache")
+	dirs := []cacheDir{
+		{httpCacheDir, true},
+		{filepath.Join(bzlmodDir, "shared_repos"), true},
+		// Registry files are replaced atomically, without locking.
+		{registryCacheDir, false},
+	}
+	// The content-addressable part of the HTTP cache has a subdirectory per hash algorithm.
+	algoDirs, err := ioutil.ReadDir(filepath.Join(httpCacheDir, "cas"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, algoDir := range algoDirs {
+		dirs = append(dirs, cacheDir{filepath.Join(httpCacheDir, "cas", algoDir.Name()), true})
+	}
+
+	var entries []cacheEntry
+
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if strings.HasSuffix(name, ".lock") || (dir.path == httpCacheDir && name == "cas") {
+				continue
+			}
+			entry := cacheEntry{
+				path:     filepath.Join(dir.path, name),
+				key:      filepath.Join(dir.path, name),
+				locked:   dir.locked,
+				registry: dir.path == registryCacheDir,
+				size:     info.Size(),
+				lastUse:  info.ModTime(),
+			}
+			switch {
+			case strings.HasPrefix(name, tempPrefix):
+				// Temporary names look like ".tmp-<entry>-<random>".
+				entry.temp = true
+				base := strings.TrimPrefix(name, tempPrefix)
+				if i := strings.LastIndex(base, "-"); i != -1 {
+					base = base[:i]
+				}
+				entry.key = filepath.Join(dir.path, base)
+			case strings.HasSuffix(name, partialSuffix):
+				entry.key = strings.TrimSuffix(entry.path, partialSuffix)
+			case strings.HasSuffix(name, partialSuffix+".json"):
+				entry.key = strings.TrimSuffix(entry.path, partialSuffix+".json")
+			case strings.HasSuffix(name, ".notfound"):
+				entry.key = strings.TrimSuffix(entry.path, ".notfound")
+			}
+			if info.IsDir() {
+				if entry.size, err = dirSize(entry.path); err != nil {
+					return nil, err
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// freshFetcher is implemented by the fetchers of this package that keep their contents in a shared repo dir.
+type freshFetcher interface {
+	// fetchFresh places the contents into destDir, bypassing the shared repo dir.
+	fetchFresh(destDir string) error
+}
+
+// FetchFresh fetches the contents of the given fetcher into a new temporary directory, and returns its path along with
+// a function that removes it. Unlike f.Fetch, it neither reuses nor populates a shared repo dir, so the result doesn't
+// depend on earlier fetches, and nothing is left behind. Downloads are still taken from the cache, as their integrity
+// is checked anyway. Fetchers of types defined outside this package are fetched with a vendor dir in the temporary
+// directory.
+func FetchFresh(f Fetcher) (string, func(), error) {
+	if w, ok := f.(Wrapper); ok {
+		f = w.Unwrap()
+	}
+	tempDir, err := ioutil.TempDir("", "bzlmod-fetch-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(tempDir) }
+	dir := tempDir
+	if ff, ok := f.(freshFetcher); ok {
+		err = ff.fetchFresh(dir)
+	} else {
+		dir, err = f.Fetch(filepath.Join(tempDir, "repo"))
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// CacheUser is implemented by fetchers that keep entries in the bzlmod cache dir, such as downloads or a shared repo
+// dir, so that Clean can be told to keep them.
+type CacheUser interface {
+	// CacheEntries returns the paths of the cache entries that the fetcher uses.
+	CacheEntries() ([]string, error)
+}
+
+// CacheEntries returns the paths of the cache entries that the given fetcher uses, so that Clean can be told to keep
+// them. Fetchers that don't implement CacheUser are assumed to only use the shared repo dir named after their
+// fingerprint.
+func CacheEntries(f Fetcher) ([]string, error) {
+	if w, ok := f.(Wrapper); ok {
+		f = w.Unwrap()
+	}
+	switch f := f.(type) {
+	case nil:
+		return nil, nil
+	case CacheUser:
+		return f.CacheEntries()
+	default:
+		return sharedRepoCacheEntries(f.Fingerprint())
+	}
+}
+
+// sharedRepoCacheEntries returns the path of the shared repo dir with the given fingerprint, if it's non-empty.
+func sharedRepoCacheEntries(fprint string) ([]string, error) {
+	if fprint == "" {
+		return nil, nil
+	}
+	dir, err := SharedRepoDir(fprint)
+	if err != nil {
+		return nil, err
+	}
+	return []string{dir}, nil
+}
+
+// patchCacheEntries returns the paths of the HTTP cache entries of the given patches that are downloaded.
+func patchCacheEntries(patches []Patch) ([]string, error) {
+	var entries []string
+	for _, patch := range patches {
+		if url, err := urls.Parse(patch.PatchFile); err == nil && (url.Scheme == "http" || url.Scheme == "https") {
+			fp, err := HTTPCacheFilePath(patch.PatchFile)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, fp)
+		}
+	}
+	return entries, nil
+}
+
+// downloadCacheEntries returns the paths of the HTTP cache entries of a download from the given URLs.
+func downloadCacheEntries(rawurls []string, integrity string) ([]string, error) {
+	integ, err := integrities.NewChecker(integrity)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := casEntries(integ.Digests())
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		for _, url := range rawurls {
+			fp, err := HTTPCacheFilePath(url)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, fp)
+		}
+	}
+	return entries, nil
+}
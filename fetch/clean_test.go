@@ -0,0 +1,227 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCacheFile writes a file of the given size into the bzlmod cache dir, last used `age` ago.
+func writeCacheFile(t *testing.T, relPath string, size int, age time.Duration) string {
+	path := filepath.Join(TestBzlmodDir, filepath.FromSlash(relPath))
+	testutil.WriteFileBytes(t, path, make([]byte, size))
+	setAge(t, path, age)
+	return path
+}
+
+func setAge(t *testing.T, path string, age time.Duration) {
+	then := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, then, then))
+}
+
+func assertExists(t *testing.T, path string) {
+	_, err := os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestClean_All(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	download := writeCacheFile(t, "http_cache/abc", 10, 0)
+	casDownload := writeCacheFile(t, "http_cache/cas/sha256/0123", 20, 0)
+	sharedRepo := writeCacheFile(t, "shared_repos/fprint/file", 30, 0)
+	registryFile := writeCacheFile(t, "registry_cache/def", 40, 0)
+	busy := writeCacheFile(t, "shared_repos/busy/file", 50, 0)
+
+	unlock, err := lockEntry(filepath.Dir(busy))
+	require.NoError(t, err)
+	defer unlock()
+
+	result, err := Clean(CleanOptions{All: true})
+	require.NoError(t, err)
+	assert.Equal(t, CleanResult{Removed: 4, RemovedBytes: 100, InUse: 1, Remaining: 1, RemainingBytes: 50}, result)
+	assertNotExist(t, download)
+	assertNotExist(t, casDownload)
+	assertNotExist(t, filepath.Dir(sharedRepo))
+	assertNotExist(t, registryFile)
+	assertExists(t, busy)
+	// Lock files are left alone.
+	assertExists(t, filepath.Dir(busy)+".lock")
+}
+
+func TestClean_OlderThan(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	old := writeCacheFile(t, "http_cache/cas/sha256/old", 10, 48*time.Hour)
+	recent := writeCacheFile(t, "http_cache/cas/sha256/recent", 10, time.Hour)
+	oldRepo := writeCacheFile(t, "shared_repos/old/file", 10, 0)
+	setAge(t, filepath.Dir(oldRepo), 48*time.Hour)
+
+	result, err := Clean(CleanOptions{OlderThan: 24 * time.Hour})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Removed)
+	assertNotExist(t, old)
+	assertNotExist(t, filepath.Dir(oldRepo))
+	assertExists(t, recent)
+}
+
+func TestClean_MaxSize(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	oldest := writeCacheFile(t, "http_cache/oldest", 100, 3*time.Hour)
+	older := writeCacheFile(t, "registry_cache/older", 100, 2*time.Hour)
+	newer := writeCacheFile(t, "http_cache/cas/sha256/newer", 100, time.Hour)
+	newest := writeCacheFile(t, "shared_repos/newest/file", 100, 0)
+
+	result, err := Clean(CleanOptions{MaxSize: 250})
+	require.NoError(t, err)
+	assert.Equal(t, CleanResult{Removed: 2, RemovedBytes: 200, Remaining: 2, RemainingBytes: 200}, result)
+	assertNotExist(t, oldest)
+	assertNotExist(t, older)
+	assertExists(t, newer)
+	assertExists(t, newest)
+}
+
+func TestClean_Keep(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := []byte("archive")
+	archive := &Archive{
+		URLs:      []string{"https://example.com/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", contents),
+		Patches:   []Patch{{"https://example.com/fix.patch", 1}},
+		Fprint:    "archive_fprint",
+	}
+	git := &Git{Repo: "https://example.com/repo.git", Commit: "abc"}
+	var keep []string
+	// customFetcher doesn't implement CacheUser, so only its shared repo dir is kept.
+	custom := &customFetcher{"custom_fprint"}
+	for _, f := range []Fetcher{Wrap(archive), git, &LocalPath{Path: "/some/path"}, custom} {
+		entries, err := CacheEntries(f)
+		require.NoError(t, err)
+		keep = append(keep, entries...)
+	}
+	casDownload := casPath(contents)
+	patchDownload, err := HTTPCacheFilePath("https://example.com/fix.patch")
+	require.NoError(t, err)
+	archiveRepo, err := SharedRepoDir("archive_fprint")
+	require.NoError(t, err)
+	gitRepo, err := SharedRepoDir(git.Fingerprint())
+	require.NoError(t, err)
+	customRepo, err := SharedRepoDir(custom.Fingerprint())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{casDownload, patchDownload, archiveRepo, gitRepo, customRepo}, keep)
+
+	testutil.WriteFileBytes(t, casDownload, contents)
+	testutil.WriteFile(t, casDownload+partialSuffix, "")
+	testutil.WriteFile(t, patchDownload, "patch")
+	testutil.WriteFile(t, filepath.Join(archiveRepo, "file"), "")
+	testutil.WriteFile(t, filepath.Join(gitRepo, "file"), "")
+	testutil.WriteFile(t, filepath.Join(customRepo, "file"), "")
+	unreferenced := writeCacheFile(t, "http_cache/unreferenced", 10, 0)
+	unreferencedPartial := writeCacheFile(t, "http_cache/cas/sha256/unreferenced"+partialSuffix, 10, 0)
+	unreferencedRepo := writeCacheFile(t, "shared_repos/unreferenced/file", 10, 0)
+	unlock, err := lockEntry(filepath.Dir(unreferencedRepo))
+	require.NoError(t, err)
+	unlock()
+	registryFile := writeCacheFile(t, "registry_cache/abc", 10, 0)
+
+	keepSet := map[string]bool{}
+	for _, entry := range keep {
+		keepSet[entry] = true
+	}
+	result, err := Clean(CleanOptions{Keep: keepSet})
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Removed)
+	assertNotExist(t, unreferenced)
+	assertNotExist(t, unreferencedPartial)
+	assertNotExist(t, filepath.Dir(unreferencedRepo))
+	assertNotExist(t, filepath.Dir(unreferencedRepo)+".lock")
+	for _, entry := range append(keep, casDownload+partialSuffix, registryFile) {
+		assertExists(t, entry)
+	}
+}
+
+func TestFetchFresh(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{"file": []byte("fresh")})
+	testutil.WriteFileBytes(t, filepath.Join(tempDir, "a.zip"), zipArchive)
+	a := &Archive{
+		URLs:      []string{"file://" + filepath.ToSlash(filepath.Join(tempDir, "a.zip"))},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	sharedRepo, err := a.Fetch("")
+	require.NoError(t, err)
+	// Pretend that the shared repo dir is left over from an earlier version of the archive.
+	require.NoError(t, os.Remove(filepath.Join(sharedRepo, "file")))
+	testutil.WriteFile(t, filepath.Join(sharedRepo, "file"), "stale")
+
+	fp, cleanup, err := FetchFresh(a)
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "fresh")
+	// The shared repo dir is left alone, and the fresh copy is removed afterwards.
+	testutil.AssertFileContents(t, filepath.Join(sharedRepo, "file"), "stale")
+	cleanup()
+	assertNotExist(t, fp)
+
+	// Nothing is created in the shared repo dir either.
+	b := &Archive{URLs: a.URLs, Integrity: a.Integrity, Fprint: "another_fingerprint"}
+	fp, cleanup, err = FetchFresh(b)
+	require.NoError(t, err)
+	defer cleanup()
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "fresh")
+	assertNotExist(t, filepath.Join(TestBzlmodDir, "shared_repos", "another_fingerprint"))
+}
+
+func TestClean_TempFiles(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	crashed := writeCacheFile(t, "shared_repos/"+tempPrefix+"fprint-123/file", 10, 0)
+	ongoing := writeCacheFile(t, "shared_repos/"+tempPrefix+"busy-456/file", 10, 0)
+	unlock, err := lockEntry(filepath.Join(TestBzlmodDir, "shared_repos", "busy"))
+	require.NoError(t, err)
+	defer unlock()
+	// Registry files aren't locked, so only old temporary files are known to be garbage.
+	oldRegistryTemp := writeCacheFile(t, "registry_cache/"+tempPrefix+"abc-789", 10, 2*time.Hour)
+	newRegistryTemp := writeCacheFile(t, "registry_cache/"+tempPrefix+"def-789", 10, 0)
+
+	// Temporary files are garbage regardless of the options.
+	_, err = Clean(CleanOptions{OlderThan: 24 * time.Hour})
+	require.NoError(t, err)
+	assertNotExist(t, filepath.Dir(crashed))
+	assertExists(t, ongoing)
+	assertNotExist(t, oldRegistryTemp)
+	assertExists(t, newRegistryTemp)
+}
+
+func TestClean_UseUpdatesLastUse(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{"file": []byte("contents")})
+	testutil.WriteFileBytes(t, casPath(zipArchive), zipArchive)
+	setAge(t, casPath(zipArchive), 48*time.Hour)
+
+	a := Archive{
+		URLs:      []string{"http://127.0.0.1:1/a.zip"}, // never reached
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	setAge(t, fp, 48*time.Hour)
+	_, err = a.Fetch("")
+	require.NoError(t, err)
+
+	_, err = Clean(CleanOptions{OlderThan: 24 * time.Hour})
+	require.NoError(t, err)
+	assertExists(t, casPath(zipArchive))
+	assertExists(t, fp)
+}
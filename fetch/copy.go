@@ -0,0 +1,141 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CopyStrategy selects how the files of a shared repo dir are copied into a vendor dir. Whatever the strategy, a
+// byte-for-byte copy is made if the chosen method isn't supported (for example, because the two directories are on
+// different filesystems).
+type CopyStrategy string
+
+const (
+	// CopyAuto makes a reflink (a copy-on-write clone) if the filesystem supports it, and otherwise hardlinks read-only
+	// files and copies the rest. Files in shared repo dirs are read-only once they're complete.
+	CopyAuto CopyStrategy = "auto"
+	// CopyReflink makes a reflink.
+	CopyReflink CopyStrategy = "reflink"
+	// CopyHardlink hardlinks read-only files, so that the vendor dir shares them with the shared repo dir, and copies
+	// writable ones (as writing to one of the links would modify the other as well). The vendored files must still never
+	// be made writable and modified.
+	CopyHardlink CopyStrategy = "hardlink"
+	// CopyBytes always makes a byte-for-byte copy.
+	CopyBytes CopyStrategy = "copy"
+)
+
+// VendorCopyStrategy is the strategy used to populate vendor dirs from shared repo dirs. It can be overridden by
+// command-line flags.
+var VendorCopyStrategy = CopyAuto
+
+// String implements pflag.Value.
+func (s *CopyStrategy) String() string {
+	return string(*s)
+}
+
+// Set implements pflag.Value.
+func (s *CopyStrategy) Set(value string) error {
+	switch strategy := CopyStrategy(value); strategy {
+	case CopyAuto, CopyReflink, CopyHardlink, CopyBytes:
+		*s = strategy
+		return nil
+	}
+	return fmt.Errorf("unknown copy strategy %q (must be one of auto, reflink, hardlink and copy)", value)
+}
+
+// Type implements pflag.Value.
+func (s *CopyStrategy) Type() string {
+	return "strategy"
+}
+
+// copyDirWithoutFingerprintFile replaces the directory `to` with a copy of `from`, preserving file modes, symlinks and
+// empty directories. The fingerprint file itself is not copied.
+func copyDirWithoutFingerprintFile(from string, to string, strategy CopyStrategy) error {
+	return copyTree(from, to, strategy, func(relpath string) bool { return relpath == "bzlmod.fingerprint" })
+}
+
+// copyTree replaces the directory `to` with a copy of `from`, leaving out the entries (given as slash-separated paths
+// relative to `from`) for which `skip` returns true.
+func copyTree(from string, to string, strategy CopyStrategy, skip func(relpath string) bool) error {
+	if err := os.RemoveAll(to); err != nil {
+		return err
+	}
+	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		if relpath != "." && skip(filepath.ToSlash(relpath)) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		topath := filepath.Join(to, relpath)
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(topath, 0777); err != nil {
+				return err
+			}
+			// Like during extraction, we always need to be able to write into the directory.
+			return os.Chmod(topath, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, topath)
+		case mode.IsRegular():
+			return copyFile(path, topath, mode, strategy)
+		default:
+			return fmt.Errorf("%v: unsupported file type %v", path, mode&os.ModeType)
+		}
+	})
+}
+
+// copyFile copies a single regular file with the given mode, using the given strategy.
+func copyFile(from string, to string, mode os.FileMode, strategy CopyStrategy) error {
+	if strategy == CopyAuto || strategy == CopyReflink {
+		if err := cloneFile(from, to, mode, reflink); err == nil {
+			return nil
+		}
+		_ = os.Remove(to)
+	}
+	if (strategy == CopyAuto || strategy == CopyHardlink) && mode&0222 == 0 {
+		if err := os.Link(from, to); err == nil {
+			return nil
+		}
+	}
+	return cloneFile(from, to, mode, func(dst *os.File, src *os.File) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+}
+
+// cloneFile creates the file `to` with the given mode, and uses `clone` to fill it with the contents of `from`.
+func cloneFile(from string, to string, mode os.FileMode, clone func(dst *os.File, src *os.File) error) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := clone(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// Set the mode explicitly, as OpenFile is subject to the umask.
+	return os.Chmod(to, mode.Perm())
+}
@@ -0,0 +1,83 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyDirWithoutFingerprintFile(t *testing.T) {
+	from := filepath.Join(t.TempDir(), "from")
+	testutil.WriteFile(t, filepath.Join(from, "bzlmod.fingerprint"), "fprint")
+	testutil.WriteFile(t, filepath.Join(from, "file"), "contents")
+	require.NoError(t, os.MkdirAll(filepath.Join(from, "dir", "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(from, "dir", "script"), []byte("#!/bin/sh"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(from, "dir", "readonly"), []byte("readonly"), 0444))
+	require.NoError(t, os.Symlink("dir/script", filepath.Join(from, "link")))
+	treeHash, err := TreeHash(from)
+	require.NoError(t, err)
+
+	for _, strategy := range []CopyStrategy{CopyAuto, CopyReflink, CopyHardlink, CopyBytes} {
+		t.Run(string(strategy), func(t *testing.T) {
+			to := filepath.Join(t.TempDir(), "to")
+			testutil.WriteFile(t, filepath.Join(to, "stale"), "stale")
+			require.NoError(t, copyDirWithoutFingerprintFile(from, to, strategy))
+
+			copiedTreeHash, err := TreeHash(to)
+			require.NoError(t, err)
+			assert.Equal(t, treeHash, copiedTreeHash)
+
+			_, err = os.Stat(filepath.Join(to, "bzlmod.fingerprint"))
+			assert.True(t, os.IsNotExist(err))
+			_, err = os.Stat(filepath.Join(to, "stale"))
+			assert.True(t, os.IsNotExist(err))
+			testutil.AssertFileContents(t, filepath.Join(to, "file"), "contents")
+			testutil.AssertFileContents(t, filepath.Join(to, "dir", "readonly"), "readonly")
+
+			info, err := os.Stat(filepath.Join(to, "dir", "empty"))
+			if assert.NoError(t, err) {
+				assert.True(t, info.IsDir())
+			}
+			info, err = os.Stat(filepath.Join(to, "dir", "script"))
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+			}
+			info, err = os.Stat(filepath.Join(to, "dir", "readonly"))
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.FileMode(0444), info.Mode().Perm())
+			}
+			target, err := os.Readlink(filepath.Join(to, "link"))
+			if assert.NoError(t, err) {
+				assert.Equal(t, "dir/script", target)
+			}
+
+			sameFile := func(relpath string) bool {
+				fromInfo, err := os.Stat(filepath.Join(from, relpath))
+				require.NoError(t, err)
+				toInfo, err := os.Stat(filepath.Join(to, relpath))
+				require.NoError(t, err)
+				return os.SameFile(fromInfo, toInfo)
+			}
+			// Writable files are never hardlinked.
+			assert.False(t, sameFile("file"))
+			// Both directories are under the same temp dir, so hardlinking works. The auto strategy prefers a reflink,
+			// which depends on the filesystem.
+			if strategy != CopyAuto {
+				assert.Equal(t, strategy == CopyHardlink, sameFile(filepath.Join("dir", "readonly")))
+			}
+		})
+	}
+}
+
+func TestCopyStrategy_Set(t *testing.T) {
+	var s CopyStrategy
+	require.NoError(t, s.Set("hardlink"))
+	assert.Equal(t, CopyHardlink, s)
+	assert.EqualError(t, s.Set("symlink"),
+		`unknown copy strategy "symlink" (must be one of auto, reflink, hardlink and copy)`)
+	assert.Equal(t, CopyHardlink, s)
+}
@@ -1,7 +1,10 @@
 package fetch
 
 import (
+	"fmt"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -41,3 +44,101 @@ func HTTPCacheFilePath(url string) (string, error) {
 	}
 	return filepath.Join(bzlmodDir, "http_cache", common.Hash(url)), nil
 }
+
+// CASFilePath returns the path under which a download with the given digest is placed in the content-addressable part
+// of the HTTP cache.
+func CASFilePath(d integrity.Digest) (string, error) {
+	bzlmodDir, err := BzlmodDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(bzlmodDir, "http_cache", "cas", d.Algorithm, d.Hex()), nil
+}
+
+// fetchWithSharedRepoDir implements the directory bookkeeping shared by fetchers whose contents are placed in a shared
+// repo directory named after the fingerprint `fprint`. `populate` is called to place the contents into the given
+// directory (which may be the shared repo dir or the vendor dir) if no up-to-date copy exists yet.
+func fetchWithSharedRepoDir(fprint string, vendorDir string, populate func(destDir string) error) (string, error) {
+	// If we're in vendoring mode and the vendorDir exists and has the right fingerprint, return immediately.
+	if vendorDir != "" && verifyFingerprintFile(vendorDir, fprint) {
+		return filepath.Abs(vendorDir)
+	}
+
+	// Otherwise, check if the corresponding shared repo directory exists and has the right fingerprint (in which case
+	// we can skip the download).
+	// It might seem redundant to check for the fingerprint as the name of the directory is itself the fingerprint;
+	// however, the fingerprint file is only written if the download, extraction or patching didn't fail halfway.
+	sharedRepoDir, err := SharedRepoDir(fprint)
+	if err != nil {
+		return "", err
+	}
+	// Hold the lock on the shared repo dir throughout, so that concurrent fetches of the same repo wait for each other
+	// instead of clobbering each other's output.
+	unlock, err := lockEntry(sharedRepoDir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	sharedRepoDirReady := verifyFingerprintFile(sharedRepoDir, fprint)
+	if sharedRepoDirReady {
+		touchEntry(sharedRepoDir)
+	}
+
+	// If we're not in vendoring mode, just prep the shared repo dir if it's not ready, and return that directory.
+	if vendorDir == "" {
+		if !sharedRepoDirReady {
+			if err := populateAtomically(sharedRepoDir, fprint, populate); err != nil {
+				return "", err
+			}
+		}
+		return sharedRepoDir, nil
+	}
+
+	// If we're in vendoring mode, we should either copy from the shared repo dir if it's ready, or otherwise fetch
+	// straight into the vendor dir.
+	if sharedRepoDirReady {
+		// Copy the entire directory over. Note that the fingerprint file itself is explicitly not copied, so that we
+		// only write it in the end if the whole copy succeeded.
+		if err := copyDirWithoutFingerprintFile(sharedRepoDir, vendorDir, VendorCopyStrategy); err != nil {
+			return "", fmt.Errorf("error copying shared repo dir to vendor dir: %v", err)
+		}
+	} else {
+		if err := populate(vendorDir); err != nil {
+			_ = os.RemoveAll(vendorDir)
+			return "", err
+		}
+	}
+	// Write the fingerprint file.
+	if err := writeFingerprintFile(vendorDir, fprint); err != nil {
+		return "", fmt.Errorf("can't write fingerprint file: %v", err)
+	}
+	return filepath.Abs(vendorDir)
+}
+
+// FetchedDir returns the directory where a previous fetch of the repo with the given fingerprint placed its contents,
+// or the empty string if there's no complete copy. `vendorDir` has the same meaning as for Fetcher.Fetch.
+func FetchedDir(fprint string, vendorDir string) (string, error) {
+	if vendorDir != "" {
+		if !verifyFingerprintFile(vendorDir, fprint) {
+			return "", nil
+		}
+		return filepath.Abs(vendorDir)
+	}
+	sharedRepoDir, err := SharedRepoDir(fprint)
+	if err != nil {
+		return "", err
+	}
+	if !verifyFingerprintFile(sharedRepoDir, fprint) {
+		return "", nil
+	}
+	return sharedRepoDir, nil
+}
+
+func verifyFingerprintFile(dir string, fprint string) bool {
+	actualFprint, err := ioutil.ReadFile(filepath.Join(dir, "bzlmod.fingerprint"))
+	return err == nil && string(actualFprint) == fprint
+}
+
+func writeFingerprintFile(dir string, fprint string) error {
+	return ioutil.WriteFile(filepath.Join(dir, "bzlmod.fingerprint"), []byte(fprint), 0666)
+}
@@ -0,0 +1,389 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	integrities "github.com/bazelbuild/bzlmod/common/integrity"
+	"io"
+	"io/ioutil"
+	"net/http"
+	urls "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// partialSuffix is appended to the path of a cache entry to get the path where an incomplete download of it is kept,
+// so that it can be resumed later.
+const partialSuffix = ".partial"
+
+// partialInfo is stored next to a partial download, and records what's needed to safely resume it.
+type partialInfo struct {
+	URL string
+	// Validator is the strong ETag or the Last-Modified date of the response that the partial download came from. It's
+	// sent as If-Range, so that the server only sends the rest of the file if the file hasn't changed since.
+	Validator string
+}
+
+// Downloads the given URL into the central cache location and returns the file path. If the integrity is known, the
+// file is stored in the content-addressable part of the cache so that all URLs serving it can share it; otherwise it's
+// keyed by the URL. The cache entry stays locked until the returned function is called, so that Clean can't remove it
+// while it's being read.
+func cachedDownload(url string, integ integrities.Checker) (string, func(), error) {
+	digests := integ.Digests()
+	var fp string
+	var entries []string
+	if len(digests) == 0 {
+		var err error
+		if fp, err = HTTPCacheFilePath(url); err != nil {
+			return "", nil, err
+		}
+		entries = []string{fp}
+	} else {
+		// The download ends up under whichever digest it matches, so lock the entries of all of them.
+		var err error
+		if entries, err = casEntries(digests); err != nil {
+			return "", nil, err
+		}
+		fp = entries[0]
+	}
+	// Hold the lock on the cache entries while we check and (re-)download the file, so that concurrent downloads of the
+	// same file wait for each other.
+	unlock, err := lockEntries(entries)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(digests) == 0 {
+		if verifyIntegrity(fp, integ) == nil {
+			// This file exists in the cache. Return its path immediately.
+			touchEntry(fp)
+			return fp, unlock, nil
+		}
+	} else if cached := casLookup(integ); cached != "" {
+		return cached, unlock, nil
+	}
+	// The file doesn't exist in the cache, or doesn't match the given integrity. Download it next to the entry
+	// (resuming an earlier attempt if there is one), and only move it into place once it's complete and verified.
+	partial := fp + partialSuffix
+	if err := download(url, partial, integ); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	if len(digests) > 0 {
+		// Several digests may have been given; file the download under the one it actually matched.
+		matched, _ := integ.Matched()
+		if fp, err = CASFilePath(matched); err != nil {
+			unlock()
+			return "", nil, err
+		}
+	}
+	if err := os.Rename(partial, fp); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	_ = os.Remove(partialInfoPath(partial))
+	return fp, unlock, nil
+}
+
+// Downloader is implemented by fetchers whose contents come from a single file that can be downloaded from any of
+// several equivalent URLs.
+type Downloader interface {
+	// DownloadURLs returns the URLs of the file, in the order that they're tried, and its integrity.
+	DownloadURLs() (rawurls []string, integrity string)
+}
+
+// VerifyURL downloads the file at the given URL afresh, bypassing the cache, and checks it against the given integrity.
+// This is useful to make sure that a URL (such as a mirror) still serves what it's supposed to. A download that passes
+// is filed in the content-addressable part of the cache, so that fetching it afterwards doesn't download it again.
+func VerifyURL(rawurl string, integrity string) error {
+	integ, err := integrities.NewChecker(integrity)
+	if err != nil {
+		return err
+	}
+	fp, cleanup, err := freshDownload(rawurl)
+	if err != nil {
+		return err
+	}
+	if cleanup == nil {
+		return verifyIntegrity(fp, integ)
+	}
+	defer cleanup()
+	if err := verifyIntegrity(fp, integ); err != nil {
+		return err
+	}
+	if matched, ok := integ.Matched(); ok {
+		return addToCAS(fp, matched)
+	}
+	return nil
+}
+
+// DownloadFresh downloads the file at the given URL afresh, bypassing the cache, and returns its sha256 integrity. The
+// file is hashed as it's read back from disk rather than held in memory, and is then filed in the content-addressable
+// part of the cache, so that fetching it with that integrity doesn't download it again. Files at file:// URLs are
+// hashed in place.
+func DownloadFresh(rawurl string) (string, error) {
+	fp, cleanup, err := freshDownload(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if cleanup != nil {
+		defer cleanup()
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", err
+	}
+	integrity, err := integrities.GenerateFromReader("sha256", f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if cleanup != nil {
+		digests, err := integrities.ParseDigests(integrity)
+		if err != nil {
+			return "", err
+		}
+		if err := addToCAS(fp, digests[0]); err != nil {
+			return "", err
+		}
+	}
+	return integrity, nil
+}
+
+// freshDownload downloads the file at the given URL into a temporary file, bypassing the cache, and returns its path
+// along with a function that removes it. For file:// URLs, the path of the file itself is returned, and the function
+// is nil.
+func freshDownload(rawurl string) (string, func(), error) {
+	url, err := urls.Parse(rawurl)
+	if err != nil {
+		return "", nil, err
+	}
+	switch url.Scheme {
+	case "http", "https":
+		dir, err := ioutil.TempDir("", "bzlmod-download-")
+		if err != nil {
+			return "", nil, err
+		}
+		cleanup := func() { _ = os.RemoveAll(dir) }
+		fp := filepath.Join(dir, "download")
+		if _, err := downloadToPartial(rawurl, fp, false); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		return fp, cleanup, nil
+	case "file":
+		return filepath.FromSlash(url.Path), nil, nil
+	default:
+		return "", nil, fmt.Errorf("unrecognized scheme: %v", url.Scheme)
+	}
+}
+
+// addToCAS files the file at `fp`, which is known to have the given digest, in the content-addressable part of the
+// cache. The file is moved if possible, and copied otherwise.
+func addToCAS(fp string, digest integrities.Digest) error {
+	dest, err := CASFilePath(digest)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockEntry(dest)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Rename(fp, dest); err == nil {
+		return nil
+	}
+	// The temporary file may be on another filesystem than the cache.
+	tmp := filepath.Join(filepath.Dir(dest), tempPrefix+filepath.Base(dest)+"-copy")
+	_ = os.Remove(tmp)
+	if err := copyFile(fp, tmp, 0644, CopyBytes); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// casEntries returns the paths of the entries in the content-addressable part of the cache of the given digests.
+func casEntries(digests []integrities.Digest) ([]string, error) {
+	var entries []string
+	for _, digest := range digests {
+		entry, err := CASFilePath(digest)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lockedCASLookup returns the path of a file in the content-addressable part of the cache that matches the given
+// integrity, or an empty string if there is none. If a file is found, the entries of all the digests stay locked until
+// the returned function is called, so that Clean can't remove the file while it's being read.
+func lockedCASLookup(integ integrities.Checker) (string, func(), error) {
+	entries, err := casEntries(integ.Digests())
+	if err != nil || len(entries) == 0 {
+		return "", nil, err
+	}
+	unlock, err := lockEntries(entries)
+	if err != nil {
+		return "", nil, err
+	}
+	if fp := casLookup(integ); fp != "" {
+		return fp, unlock, nil
+	}
+	unlock()
+	return "", nil, nil
+}
+
+// casLookup returns the path of a file in the content-addressable part of the cache that matches the given integrity,
+// or an empty string if there is none. The caller must hold the locks of the entries of all the digests.
+func casLookup(integ integrities.Checker) string {
+	for _, digest := range integ.Digests() {
+		fp, err := CASFilePath(digest)
+		if err == nil && verifyIntegrity(fp, integ) == nil {
+			touchEntry(fp)
+			return fp
+		}
+	}
+	return ""
+}
+
+// download downloads the given URL into the file at path `partial`, and makes sure that the complete file matches the
+// given integrity. If an earlier download from the same URL was interrupted, only the missing part is requested. The
+// partial file is kept if the download fails halfway, so that the next attempt can pick up where this one left off;
+// but it's removed if it turns out to be bad.
+func download(url string, partial string, integ integrities.Checker) error {
+	resumed, err := downloadToPartial(url, partial, true)
+	if err != nil {
+		return err
+	}
+	if verifyIntegrity(partial, integ) == nil {
+		return nil
+	}
+	if resumed {
+		// The file may have changed on the server without its validator changing. Try once more from scratch.
+		if _, err := downloadToPartial(url, partial, false); err != nil {
+			return err
+		}
+		if verifyIntegrity(partial, integ) == nil {
+			return nil
+		}
+	}
+	discardPartial(partial)
+	return fmt.Errorf("failed integrity check")
+}
+
+// downloadToPartial downloads the given URL into the file at path `partial`. If `resume` is true and the file holds the
+// beginning of an earlier download from the same URL, only the rest is requested; the returned boolean reports whether
+// that happened.
+func downloadToPartial(url string, partial string, resume bool) (bool, error) {
+	var offset int64
+	info, err := readPartialInfo(partial)
+	if resume && err == nil && info.URL == url {
+		if stat, err := os.Stat(partial); err == nil {
+			offset = stat.Size()
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", info.Validator)
+	}
+	resp, err := httpclient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_APPEND
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// There's nothing after the end of what we have, so the earlier download was in fact complete.
+		return true, nil
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("got status: %v", resp.Status)
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		// The server sent the rest of the file; append it to what we have.
+	case resp.StatusCode == http.StatusPartialContent:
+		discardPartial(partial)
+		return false, fmt.Errorf("unexpected Content-Range: %v", resp.Header.Get("Content-Range"))
+	default:
+		// The server sent the whole file, either because we didn't ask for a range, or because it doesn't support
+		// them or the file has changed. Start over, and record what's needed to resume this download later.
+		offset = 0
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if err := writePartialInfo(partial, partialInfo{url, responseValidator(resp)}); err != nil {
+			return false, err
+		}
+	}
+
+	maxSize := DefaultLimits.MaxDownloadSize
+	if maxSize > 0 && resp.ContentLength >= 0 && offset+resp.ContentLength > maxSize {
+		discardPartial(partial)
+		return false, &LimitError{"MaxDownloadSize", maxSize, url}
+	}
+	f, err := os.OpenFile(partial, flags, 0666)
+	if err != nil {
+		return false, fmt.Errorf("can't create http cache file: %v", err)
+	}
+	body := &limitedReader{r: resp.Body, n: offset, max: maxSize, source: url}
+	_, err = io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		discardPartial(partial)
+	}
+	return offset > 0, err
+}
+
+// responseValidator returns the value to send as If-Range when resuming a download of the given response, or an empty
+// string if the response can't be resumed safely.
+func responseValidator(resp *http.Response) string {
+	// Weak ETags can't be used in If-Range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+func partialInfoPath(partial string) string {
+	return partial + ".json"
+}
+
+func readPartialInfo(partial string) (partialInfo, error) {
+	var info partialInfo
+	p, err := ioutil.ReadFile(partialInfoPath(partial))
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(p, &info); err != nil {
+		return info, err
+	}
+	if info.Validator == "" {
+		return info, fmt.Errorf("partial download of %v can't be resumed", info.URL)
+	}
+	return info, nil
+}
+
+func writePartialInfo(partial string, info partialInfo) error {
+	p, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(partialInfoPath(partial), p, 0666)
+}
+
+// discardPartial removes a partial download along with its info file.
+func discardPartial(partial string) {
+	_ = os.Remove(partial)
+	_ = os.Remove(partialInfoPath(partial))
+}
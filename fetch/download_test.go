@@ -0,0 +1,195 @@
+package fetch
+
+import (
+	"bytes"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rangeServer serves `contents` with the given ETag, honoring Range and If-Range headers. The Range headers of all
+// requests are recorded in `ranges`.
+func rangeServer(contents []byte, etag string, ranges *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+	}))
+}
+
+// writePartial sets up a partial download of `contents` from the given URL, consisting of `partialContents`.
+func writePartial(t *testing.T, url string, contents []byte, partialContents []byte, validator string) string {
+	partial := casPath(contents) + partialSuffix
+	testutil.WriteFileBytes(t, partial, partialContents)
+	require.NoError(t, writePartialInfo(partial, partialInfo{url, validator}))
+	return partial
+}
+
+func assertDownloaded(t *testing.T, fp string, partial string, contents []byte) {
+	testutil.AssertFileContentsBytes(t, fp, contents)
+	assertNotExist(t, partial)
+	assertNotExist(t, partialInfoPath(partial))
+}
+
+func TestDownload_Resume(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := rangeServer(contents, `"v1"`, &ranges)
+	defer server.Close()
+
+	partial := writePartial(t, server.URL+"/a.zip", contents, contents[:len(contents)/2], `"v1"`)
+	integ, _ := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	fp, unlock, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.NoError(t, err)
+	unlock()
+	assertDownloaded(t, fp, partial, contents)
+	assert.Equal(t, []string{"bytes=" + strconv.Itoa(len(contents)/2) + "-"}, ranges)
+}
+
+func TestDownload_FileChanged(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := rangeServer(contents, `"v2"`, &ranges)
+	defer server.Close()
+
+	// The validator doesn't match, so the server should send the whole file.
+	partial := writePartial(t, server.URL+"/a.zip", contents, bytes.Repeat([]byte("x"), 100), `"v1"`)
+	integ, _ := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	fp, unlock, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.NoError(t, err)
+	unlock()
+	assertDownloaded(t, fp, partial, contents)
+	assert.Equal(t, []string{"bytes=100-"}, ranges)
+}
+
+func TestDownload_BadPartial(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := rangeServer(contents, `"v1"`, &ranges)
+	defer server.Close()
+
+	// The partial download claims to be from the same version of the file, but is corrupt. The resumed download fails
+	// the integrity check, and we should start over.
+	corrupt := append([]byte("x"), contents[1:len(contents)/2]...)
+	partial := writePartial(t, server.URL+"/a.zip", contents, corrupt, `"v1"`)
+	integ, _ := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	fp, unlock, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.NoError(t, err)
+	unlock()
+	assertDownloaded(t, fp, partial, contents)
+	assert.Equal(t, []string{"bytes=" + strconv.Itoa(len(contents)/2) + "-", ""}, ranges)
+}
+
+func TestDownload_RangesNotSupported(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(contents)
+	}))
+	defer server.Close()
+
+	partial := writePartial(t, server.URL+"/a.zip", contents, contents[:len(contents)/2], `"v1"`)
+	integ, _ := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	fp, unlock, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.NoError(t, err)
+	unlock()
+	assertDownloaded(t, fp, partial, contents)
+}
+
+func TestDownload_InterruptedAndResumed(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	interrupt := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if interrupt {
+			// Promise the whole file, but drop the connection halfway through.
+			w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+			_, _ = w.Write(contents[:3000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer server.Close()
+
+	integ, _ := integrity.NewChecker(integrity.MustGenerate("sha256", contents))
+	_, _, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.Error(t, err)
+	fp := casPath(contents)
+	partial := fp + partialSuffix
+	testutil.AssertFileContentsBytes(t, partial, contents[:3000])
+	assertNotExist(t, fp)
+
+	interrupt = false
+	fp, unlock, err := cachedDownload(server.URL+"/a.zip", integ)
+	require.NoError(t, err)
+	unlock()
+	assertDownloaded(t, fp, partial, contents)
+	assert.Equal(t, []string{"", "bytes=3000-"}, ranges)
+}
+
+func TestVerifyURL(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := []byte("archive")
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip":     contents,
+		"/wrong.zip": []byte("something else"),
+	})
+	defer server.Close()
+	integ := integrity.MustGenerate("sha256", contents)
+
+	assert.NoError(t, VerifyURL(server.URL+"/a.zip", integ))
+	// The verified download is filed in the CAS.
+	testutil.AssertFileContents(t, casPath(contents), "archive")
+	assert.EqualError(t, VerifyURL(server.URL+"/wrong.zip", integ), "failed integrity check")
+	assert.Error(t, VerifyURL(server.URL+"/missing.zip", integ))
+
+	// The cache is bypassed, even if it has the file.
+	testutil.WriteFileBytes(t, casPath(contents), contents)
+	assert.Error(t, VerifyURL(server.URL+"/missing.zip", integ))
+}
+
+func TestDownloadFresh(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	contents := []byte("archive")
+	server := testutil.StaticHttpServer(map[string][]byte{"/a.zip": contents})
+	defer server.Close()
+	// A stale copy cached under the URL is ignored.
+	stale, err := HTTPCacheFilePath(server.URL + "/a.zip")
+	require.NoError(t, err)
+	testutil.WriteFile(t, stale, "stale")
+
+	integ, err := DownloadFresh(server.URL + "/a.zip")
+	require.NoError(t, err)
+	assert.Equal(t, integrity.MustGenerate("sha256", contents), integ)
+	// The download is filed in the CAS, so that fetching it doesn't download it again.
+	testutil.AssertFileContents(t, casPath(contents), "archive")
+
+	local := filepath.Join(tempDir, "local.zip")
+	testutil.WriteFile(t, local, "local")
+	integ, err = DownloadFresh("file://" + filepath.ToSlash(local))
+	require.NoError(t, err)
+	assert.Equal(t, integrity.MustGenerate("sha256", []byte("local")), integ)
+}
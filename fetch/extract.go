@@ -0,0 +1,450 @@
+package fetch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	urls "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveExtensions maps file name extensions to the type of archive they signify. Longer extensions must be checked
+// first, so that ".tar.gz" isn't mistaken for plain gzip (which we don't support anyway).
+var archiveExtensions = []struct {
+	ext         string
+	archiveType string
+}{
+	{".tar.gz", "tar.gz"},
+	{".tar.xz", "tar.xz"},
+	{".tar.bz2", "tar.bz2"},
+	{".tar.zst", "tar.zst"},
+	{".tgz", "tar.gz"},
+	{".txz", "tar.xz"},
+	{".tbz", "tar.bz2"},
+	{".tbz2", "tar.bz2"},
+	{".tzst", "tar.zst"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+	{".jar", "zip"},
+	{".war", "zip"},
+	{".aar", "zip"},
+}
+
+// archiveMagic maps the magic bytes at the start of a file to the type of archive they signify. Compressed files are
+// assumed to be tarballs.
+var archiveMagic = []struct {
+	magic       []byte
+	archiveType string
+}{
+	{[]byte("PK\x03\x04"), "zip"},
+	{[]byte("PK\x05\x06"), "zip"}, // empty zip file
+	{[]byte("\x1f\x8b"), "tar.gz"},
+	{[]byte("\xfd7zXZ\x00"), "tar.xz"},
+	{[]byte("BZh"), "tar.bz2"},
+	{[]byte("\x28\xb5\x2f\xfd"), "tar.zst"},
+}
+
+type tarDecompressor func(r io.Reader) (io.ReadCloser, error)
+
+var tarDecompressors = map[string]tarDecompressor{
+	"tar": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(r), nil
+	},
+	"tar.gz": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"tar.xz": func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	},
+	"tar.bz2": func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	},
+	"tar.zst": func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	},
+}
+
+// detectArchiveType determines the type of the archive at `archivePath`, which was fetched from `rawurl`. An explicitly
+// specified type always wins; otherwise we look at the extension of the URL, and then at the contents of the file.
+func detectArchiveType(explicitType string, rawurl string, archivePath string) (string, error) {
+	if explicitType != "" {
+		if explicitType != "zip" && tarDecompressors[explicitType] == nil {
+			return "", fmt.Errorf("unsupported archive type: %v", explicitType)
+		}
+		return explicitType, nil
+	}
+
+	urlPath := rawurl
+	if url, err := urls.Parse(rawurl); err == nil {
+		urlPath = url.Path
+	}
+	urlPath = strings.ToLower(urlPath)
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(urlPath, e.ext) {
+			return e.archiveType, nil
+		}
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("can't read archive %v: %v", archivePath, err)
+	}
+	header = header[:n]
+	for _, m := range archiveMagic {
+		if bytes.HasPrefix(header, m.magic) {
+			return m.archiveType, nil
+		}
+	}
+	// Uncompressed tarballs have the "ustar" magic at offset 257 of the first header.
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return "tar", nil
+	}
+	return "", fmt.Errorf("can't determine the type of the archive downloaded from %v", rawurl)
+}
+
+// extractArchive extracts the archive at `archivePath`, of type `archiveType`, into `destDir`. Existing contents of
+// `destDir` are removed first.
+func extractArchive(archivePath string, archiveType string, destDir string, stripPrefix string) error {
+	if err := os.RemoveAll(destDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return err
+	}
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	e := &extractor{
+		destDir:     destDir,
+		stripPrefix: stripPrefix,
+		budget:      &extractionBudget{limits: DefaultLimits, archiveSize: info.Size(), source: archivePath},
+	}
+	if archiveType == "zip" {
+		err = e.extractZipFile(archivePath)
+	} else if decompress := tarDecompressors[archiveType]; decompress != nil {
+		err = e.extractTarFile(archivePath, decompress)
+	} else {
+		return fmt.Errorf("unsupported archive type: %v", archiveType)
+	}
+	if err == nil && e.stripPrefix != "" && !e.matchedPrefix {
+		return fmt.Errorf("strip prefix %q was given, but no entries of the archive are under it", e.stripPrefix)
+	}
+	return err
+}
+
+// extractor places the entries of an archive under destDir. It refuses to place anything outside of destDir, whether
+// through ".." components, absolute paths or symlinks, and stops once the budget is exhausted.
+type extractor struct {
+	destDir     string
+	stripPrefix string
+	budget      *extractionBudget
+	// matchedPrefix records whether any entry was under the strip prefix.
+	matchedPrefix bool
+}
+
+func (e *extractor) extractZipFile(archivePath string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if _, ok := e.strip(f.Name); !ok {
+			continue
+		}
+		if err := e.budget.addFile(); err != nil {
+			return err
+		}
+		if err := e.extractZipEntry(f); err != nil {
+			return fmt.Errorf("error extracting %v: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (e *extractor) extractZipEntry(f *zip.File) error {
+	mode := f.Mode()
+	if mode.IsDir() {
+		return e.writeDir(f.Name, mode)
+	}
+	fr, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	if mode&os.ModeSymlink != 0 {
+		// The target of a symlink is stored as the contents of the entry.
+		target, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return err
+		}
+		return e.writeSymlink(f.Name, string(target))
+	}
+	return e.writeFile(f.Name, mode, fr)
+}
+
+func (e *extractor) extractTarFile(archivePath string, decompress tarDecompressor) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dr, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("can't decompress archive: %v", err)
+	}
+	defer dr.Close()
+	tr := tar.NewReader(dr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading archive: %v", err)
+		}
+		if _, ok := e.strip(header.Name); !ok {
+			continue
+		}
+		if err := e.budget.addFile(); err != nil {
+			return err
+		}
+		if err := e.extractTarEntry(header, tr); err != nil {
+			return fmt.Errorf("error extracting %v: %w", header.Name, err)
+		}
+	}
+}
+
+func (e *extractor) extractTarEntry(header *tar.Header, r io.Reader) error {
+	mode := header.FileInfo().Mode()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return e.writeDir(header.Name, mode)
+	case tar.TypeReg, tar.TypeRegA:
+		return e.writeFile(header.Name, mode, r)
+	case tar.TypeSymlink:
+		return e.writeSymlink(header.Name, header.Linkname)
+	case tar.TypeLink:
+		return e.writeHardlink(header.Name, header.Linkname, mode)
+	default:
+		// Device files, FIFOs and the like have no business being in a source archive; global and extended headers
+		// are handled by archive/tar itself.
+		return nil
+	}
+}
+
+// entryPath returns the absolute path under destDir corresponding to the archive entry named `name` (after stripping
+// the prefix), and the path relative to destDir. It returns an error if the entry would end up outside of destDir.
+func (e *extractor) entryPath(name string) (string, string, error) {
+	name, ok := e.strip(name)
+	if !ok {
+		return "", "", fmt.Errorf("%q is not under the strip prefix %q", name, e.stripPrefix)
+	}
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(filepath.FromSlash(name)) {
+		return "", "", fmt.Errorf("absolute paths are not allowed")
+	}
+	relPath := filepath.Clean(filepath.FromSlash(name))
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("path escapes the destination directory")
+	}
+	absPath := filepath.Join(e.destDir, relPath)
+	if err := e.checkParentDirs(relPath); err != nil {
+		return "", "", err
+	}
+	return absPath, relPath, nil
+}
+
+// strip returns the name of an archive entry with the strip prefix removed, and whether the entry is under the prefix
+// at all. The prefix is a directory, which may or may not be given with a trailing slash; entries outside of it are
+// skipped, like Bazel does.
+func (e *extractor) strip(name string) (string, bool) {
+	if e.stripPrefix == "" {
+		return name, true
+	}
+	prefix := strings.TrimSuffix(e.stripPrefix, "/")
+	switch {
+	case name == prefix || name == prefix+"/":
+		e.matchedPrefix = true
+		return "", true
+	case strings.HasPrefix(name, prefix+"/"):
+		e.matchedPrefix = true
+		return name[len(prefix)+1:], true
+	default:
+		return name, false
+	}
+}
+
+// checkParentDirs makes sure that none of the existing parent directories of `relPath` is a symlink, so that we never
+// write anything through a symlink.
+func (e *extractor) checkParentDirs(relPath string) error {
+	cur := e.destDir
+	parts := strings.Split(filepath.Dir(relPath), string(filepath.Separator))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		cur = filepath.Join(cur, part)
+		info, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("refusing to write through symlink %v", cur)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", cur)
+		}
+	}
+	return nil
+}
+
+// prepareEntry creates the parent directories of an entry and removes anything already at its path (other than
+// directories), so that a duplicate entry can't be used to write through a symlink.
+func prepareEntry(absPath string) error {
+	if err := os.MkdirAll(filepath.Dir(absPath), 0777); err != nil {
+		return fmt.Errorf("can't create directories for %v: %v", absPath, err)
+	}
+	if info, err := os.Lstat(absPath); err == nil && !info.IsDir() {
+		return os.Remove(absPath)
+	}
+	return nil
+}
+
+func (e *extractor) writeDir(name string, mode os.FileMode) error {
+	absPath, _, err := e.entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := prepareEntry(absPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(absPath, 0777); err != nil {
+		return err
+	}
+	// We always need to be able to write into the directory, for example to apply patches.
+	return os.Chmod(absPath, mode.Perm()|0700)
+}
+
+func (e *extractor) writeFile(name string, mode os.FileMode, r io.Reader) error {
+	absPath, _, err := e.entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := prepareEntry(absPath); err != nil {
+		return err
+	}
+	// Files are always readable and writable by the owner, so that they can be patched; other permission bits
+	// (notably the executable bits) are preserved.
+	perm := mode.Perm() | 0600
+	w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(w, e.budget), r); err != nil {
+		w.Close()
+		return fmt.Errorf("error during I/O: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The mode given to OpenFile is subject to the umask.
+	return os.Chmod(absPath, perm)
+}
+
+func (e *extractor) writeSymlink(name string, target string) error {
+	absPath, relPath, err := e.entryPath(name)
+	if err != nil {
+		return err
+	}
+	if err := checkSymlinkTarget(relPath, target); err != nil {
+		return err
+	}
+	if err := prepareEntry(absPath); err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(target), absPath)
+}
+
+// checkSymlinkTarget makes sure that a symlink at `relPath` (relative to the destination directory) pointing to
+// `target` stays within the destination directory. To make this hold regardless of what other symlinks exist, we only
+// accept relative targets where all ".." components come first: the parents of an entry are always real directories
+// (see checkParentDirs), so walking up is purely lexical, and walking down from within the destination directory can
+// only lead elsewhere through another symlink, which is subject to the same check.
+func checkSymlinkTarget(relPath string, target string) error {
+	if target == "" || strings.HasPrefix(target, "/") || filepath.IsAbs(filepath.FromSlash(target)) {
+		return fmt.Errorf("symlink target %q must be a relative path", target)
+	}
+	depth := len(strings.Split(filepath.Dir(relPath), string(filepath.Separator)))
+	if filepath.Dir(relPath) == "." {
+		depth = 0
+	}
+	seenName := false
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if seenName {
+				return fmt.Errorf("symlink target %q may only have \"..\" components at the start", target)
+			}
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("symlink target %q points outside of the destination directory", target)
+			}
+		default:
+			seenName = true
+		}
+	}
+	return nil
+}
+
+// writeHardlink handles a hard link entry in a tarball, whose target is another entry in the same archive. We simply
+// copy the target, which must be a regular file extracted earlier.
+func (e *extractor) writeHardlink(name string, target string, mode os.FileMode) error {
+	targetPath, _, err := e.entryPath(target)
+	if err != nil {
+		return fmt.Errorf("bad hard link target %q: %v", target, err)
+	}
+	info, err := os.Lstat(targetPath)
+	if err != nil {
+		return fmt.Errorf("bad hard link target %q: %v", target, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("hard link target %q is not a regular file", target)
+	}
+	r, err := os.Open(targetPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if mode.Perm() == 0 {
+		mode = info.Mode()
+	}
+	return e.writeFile(name, mode, r)
+}
@@ -0,0 +1,371 @@
+package fetch
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// compress compresses the given bytes into the format used by the given archive type.
+func compress(t *testing.T, archiveType string, p []byte) []byte {
+	b := &bytes.Buffer{}
+	var w io.WriteCloser
+	var err error
+	switch archiveType {
+	case "tar":
+		return p
+	case "tar.gz":
+		w = gzip.NewWriter(b)
+	case "tar.xz":
+		w, err = xz.NewWriter(b)
+	case "tar.zst":
+		w, err = zstd.NewWriter(b)
+	case "tar.bz2":
+		// The standard library can't write bzip2; use the command-line tool if available.
+		if _, err := exec.LookPath("bzip2"); err != nil {
+			t.Skip("bzip2 not available")
+		}
+		cmd := exec.Command("bzip2", "-c")
+		cmd.Stdin = bytes.NewReader(p)
+		out, err := cmd.Output()
+		require.NoError(t, err)
+		return out
+	default:
+		t.Fatalf("unknown archive type %v", archiveType)
+	}
+	require.NoError(t, err)
+	_, err = w.Write(p)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestDetectArchiveType(t *testing.T) {
+	dir := t.TempDir()
+	tarball := testutil.BuildTarArchive(t, map[string][]byte{"file": []byte("contents")})
+	testutil.WriteFileBytes(t, filepath.Join(dir, "tar"), tarball)
+	testutil.WriteFileBytes(t, filepath.Join(dir, "tar.gz"), compress(t, "tar.gz", tarball))
+	testutil.WriteFileBytes(t, filepath.Join(dir, "tar.xz"), compress(t, "tar.xz", tarball))
+	testutil.WriteFileBytes(t, filepath.Join(dir, "tar.zst"), compress(t, "tar.zst", tarball))
+	testutil.WriteFileBytes(t, filepath.Join(dir, "zip"), testutil.BuildZipArchive(t, map[string][]byte{"file": []byte("contents")}))
+	testutil.WriteFile(t, filepath.Join(dir, "garbage"), "definitely not an archive")
+
+	testCases := []struct {
+		explicitType string
+		url          string
+		file         string
+		expected     string
+	}{
+		// The extension of the URL is used if no type is specified.
+		{"", "https://example.com/a.zip", "garbage", "zip"},
+		{"", "https://example.com/a.JAR", "garbage", "zip"},
+		{"", "https://example.com/a.tar.gz?query=1", "garbage", "tar.gz"},
+		{"", "https://example.com/a.tgz", "garbage", "tar.gz"},
+		{"", "https://example.com/a.tar.xz", "garbage", "tar.xz"},
+		{"", "https://example.com/a.tar.bz2", "garbage", "tar.bz2"},
+		{"", "https://example.com/a.tar.zst", "garbage", "tar.zst"},
+		{"", "https://example.com/a.tar", "garbage", "tar"},
+		// Otherwise, the contents are used.
+		{"", "https://example.com/download?id=1", "zip", "zip"},
+		{"", "https://example.com/download?id=1", "tar", "tar"},
+		{"", "https://example.com/download?id=1", "tar.gz", "tar.gz"},
+		{"", "https://example.com/download?id=1", "tar.xz", "tar.xz"},
+		{"", "https://example.com/download?id=1", "tar.zst", "tar.zst"},
+		// The explicit type trumps everything.
+		{"tar.gz", "https://example.com/a.zip", "zip", "tar.gz"},
+	}
+	for _, tc := range testCases {
+		msg := fmt.Sprintf("%+v", tc)
+		actual, err := detectArchiveType(tc.explicitType, tc.url, filepath.Join(dir, tc.file))
+		if assert.NoError(t, err, msg) {
+			assert.Equal(t, tc.expected, actual, msg)
+		}
+	}
+
+	_, err := detectArchiveType("", "https://example.com/download", filepath.Join(dir, "garbage"))
+	assert.Error(t, err)
+	_, err = detectArchiveType("rar", "https://example.com/a.rar", filepath.Join(dir, "garbage"))
+	assert.Error(t, err)
+}
+
+func TestArchive_TarFormats(t *testing.T) {
+	for _, archiveType := range []string{"tar", "tar.gz", "tar.xz", "tar.bz2", "tar.zst"} {
+		t.Run(archiveType, func(t *testing.T) {
+			TestBzlmodDir = t.TempDir()
+			defer func() { TestBzlmodDir = "" }()
+
+			archive := compress(t, archiveType, testutil.BuildTarArchive(t, map[string][]byte{
+				"pkg-1.0/file1":     []byte(`file1contents`),
+				"pkg-1.0/dir/file2": []byte(`file2contents`),
+			}))
+			server := testutil.StaticHttpServer(map[string][]byte{
+				"/a." + archiveType: archive,
+			})
+			defer server.Close()
+
+			a := Archive{
+				URLs:        []string{server.URL + "/a." + archiveType},
+				Integrity:   integrity.MustGenerate("sha256", archive),
+				StripPrefix: "pkg-1.0/",
+				Fprint:      "some_fingerprint",
+			}
+			fp, err := a.Fetch("")
+			require.NoError(t, err)
+			testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+			testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
+		})
+	}
+}
+
+func TestArchive_ExplicitType(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	archive := compress(t, "tar.gz", testutil.BuildTarArchive(t, map[string][]byte{
+		"file1": []byte(`file1contents`),
+	}))
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/download": archive,
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:      []string{server.URL + "/download"},
+		Integrity: integrity.MustGenerate("sha256", archive),
+		Type:      "tar.gz",
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+}
+
+func TestArchive_StripPrefix(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"prefix/file1":     []byte(`file1contents`),
+		"prefix/dir/file2": []byte(`file2contents`),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:        []string{server.URL + "/a.zip"},
+		Integrity:   integrity.MustGenerate("sha256", zipArchive),
+		StripPrefix: "prefix/",
+		Fprint:      "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+	testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
+}
+
+type testEntry struct {
+	name     string
+	mode     os.FileMode
+	contents string // the link target for symlinks
+}
+
+func buildTestZip(t *testing.T, entries []testEntry) []byte {
+	b := &bytes.Buffer{}
+	w := zip.NewWriter(b)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name}
+		header.SetMode(entry.mode)
+		fw, err := w.CreateHeader(header)
+		require.NoError(t, err, entry.name)
+		_, err = fw.Write([]byte(entry.contents))
+		require.NoError(t, err, entry.name)
+	}
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func buildTestTar(t *testing.T, entries []testEntry) []byte {
+	b := &bytes.Buffer{}
+	w := tar.NewWriter(b)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: int64(entry.mode.Perm())}
+		switch {
+		case entry.mode.IsDir():
+			header.Typeflag = tar.TypeDir
+		case entry.mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.contents
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(entry.contents))
+		}
+		require.NoError(t, w.WriteHeader(header), entry.name)
+		if header.Typeflag == tar.TypeReg {
+			_, err := w.Write([]byte(entry.contents))
+			require.NoError(t, err, entry.name)
+		}
+	}
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+// extractTestArchives builds the given entries into both a zip file and a tarball, and runs `check` after extracting
+// each of them.
+func extractTestArchives(t *testing.T, entries []testEntry, check func(t *testing.T, destDir string, err error)) {
+	for archiveType, archive := range map[string][]byte{
+		"zip": buildTestZip(t, entries),
+		"tar": buildTestTar(t, entries),
+	} {
+		t.Run(archiveType, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, "archive")
+			testutil.WriteFileBytes(t, archivePath, archive)
+			destDir := filepath.Join(dir, "dest")
+			check(t, destDir, extractArchive(archivePath, archiveType, destDir, "prefix/"))
+		})
+	}
+}
+
+func TestExtract_ModesAndDirectories(t *testing.T) {
+	extractTestArchives(t, []testEntry{
+		{"prefix/", os.ModeDir | 0755, ""},
+		{"prefix/script.sh", 0755, "#!/bin/sh\n"},
+		{"prefix/data", 0644, "data"},
+		{"prefix/readonly", 0444, "can't touch this"},
+		{"prefix/empty/", os.ModeDir | 0755, ""},
+	}, func(t *testing.T, destDir string, err error) {
+		require.NoError(t, err)
+		testutil.AssertFileContents(t, filepath.Join(destDir, "script.sh"), "#!/bin/sh\n")
+		info, err := os.Stat(filepath.Join(destDir, "script.sh"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		}
+		info, err = os.Stat(filepath.Join(destDir, "data"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+		}
+		// Read-only files are made writable by the owner, so that they can be patched.
+		info, err = os.Stat(filepath.Join(destDir, "readonly"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+		}
+		info, err = os.Stat(filepath.Join(destDir, "empty"))
+		if assert.NoError(t, err) {
+			assert.True(t, info.IsDir())
+		}
+	})
+}
+
+func TestExtract_Symlinks(t *testing.T) {
+	extractTestArchives(t, []testEntry{
+		{"prefix/dir/file", 0644, "contents"},
+		{"prefix/link", os.ModeSymlink | 0777, "dir/file"},
+		{"prefix/dir/sub/uplink", os.ModeSymlink | 0777, "../../dir/./file"},
+	}, func(t *testing.T, destDir string, err error) {
+		require.NoError(t, err)
+		target, err := os.Readlink(filepath.Join(destDir, "link"))
+		if assert.NoError(t, err) {
+			assert.Equal(t, filepath.FromSlash("dir/file"), target)
+		}
+		testutil.AssertFileContents(t, filepath.Join(destDir, "link"), "contents")
+		testutil.AssertFileContents(t, filepath.Join(destDir, "dir", "sub", "uplink"), "contents")
+	})
+}
+
+func TestExtract_StripPrefixWithoutSlash(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive")
+	testutil.WriteFileBytes(t, archivePath, buildTestZip(t, []testEntry{
+		{"prefix/", os.ModeDir | 0755, ""},
+		{"prefix/dir/file", 0644, "contents"},
+	}))
+	destDir := filepath.Join(dir, "dest")
+	require.NoError(t, extractArchive(archivePath, "zip", destDir, "prefix"))
+	testutil.AssertFileContents(t, filepath.Join(destDir, "dir", "file"), "contents")
+}
+
+func TestExtract_StripPrefixBoundary(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive")
+	testutil.WriteFileBytes(t, archivePath, buildTestZip(t, []testEntry{
+		{"foo/file", 0644, "inside"},
+		{"foobar/file", 0644, "sibling"},
+		{"README", 0644, "outside"},
+	}))
+	destDir := filepath.Join(dir, "dest")
+	require.NoError(t, extractArchive(archivePath, "zip", destDir, "foo"))
+	testutil.AssertFileContents(t, filepath.Join(destDir, "file"), "inside")
+	// Entries outside of the prefix are skipped.
+	for _, name := range []string{"bar", "README"} {
+		_, err := os.Lstat(filepath.Join(destDir, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	err := extractArchive(archivePath, "zip", destDir, "fo")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `strip prefix "fo" was given, but no entries of the archive are under it`)
+	}
+}
+
+func TestExtract_Escapes(t *testing.T) {
+	testCases := map[string][]testEntry{
+		"dotdot":   {{"prefix/../evil", 0644, "boo"}},
+		"absolute": {{"/tmp/evil", 0644, "boo"}},
+		"absolute symlink": {
+			{"prefix/link", os.ModeSymlink | 0777, "/etc/passwd"},
+		},
+		"escaping symlink": {
+			{"prefix/dir/link", os.ModeSymlink | 0777, "../../evil"},
+		},
+		"symlink with inner dotdot": {
+			{"prefix/self", os.ModeSymlink | 0777, "."},
+			{"prefix/link", os.ModeSymlink | 0777, "self/../evil"},
+		},
+		"write through symlink": {
+			{"prefix/dir/", os.ModeDir | 0755, ""},
+			{"prefix/link", os.ModeSymlink | 0777, "dir"},
+			{"prefix/link/file", 0644, "boo"},
+		},
+	}
+	for name, entries := range testCases {
+		t.Run(name, func(t *testing.T) {
+			extractTestArchives(t, entries, func(t *testing.T, destDir string, err error) {
+				assert.Error(t, err)
+				_, err = os.Lstat(filepath.Join(filepath.Dir(destDir), "evil"))
+				assert.True(t, os.IsNotExist(err))
+				_, err = os.Lstat(filepath.Join(destDir, "dir", "file"))
+				assert.True(t, os.IsNotExist(err))
+			})
+		})
+	}
+}
+
+func TestExtract_DuplicateEntryReplacesSymlink(t *testing.T) {
+	// A later entry with the same name as a symlink must replace the symlink rather than write through it.
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "archive.tar")
+	testutil.WriteFileBytes(t, archivePath, buildTestTar(t, []testEntry{
+		{"target", 0644, "original"},
+		{"link", os.ModeSymlink | 0777, "target"},
+		{"link", 0644, "replaced"},
+	}))
+	destDir := filepath.Join(dir, "dest")
+	require.NoError(t, extractArchive(archivePath, "tar", destDir, ""))
+	testutil.AssertFileContents(t, filepath.Join(destDir, "target"), "original")
+	testutil.AssertFileContents(t, filepath.Join(destDir, "link"), "replaced")
+}
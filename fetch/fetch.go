@@ -1,6 +1,14 @@
 package fetch
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
 
 // Fetcher contains all the information needed to "fetch" a repo. "Fetch" here is simply defined as making the contents
 // of a repo available in a local directory through some means.
@@ -21,63 +29,163 @@ type Fetcher interface {
 	AppendPatches(patches []Patch) error
 }
 
-// Wrapper wraps all known implementations of the Fetcher interface and acts as a multiplexer (only 1 member should be
-// non-nil). It's useful in JSON marshalling/unmarshalling.
-type Wrapper struct {
-	Archive   *Archive   `json:",omitempty"`
-	Git       *Git       `json:",omitempty"`
-	LocalPath *LocalPath `json:",omitempty"`
-}
+var fetcherTypes = struct {
+	sync.RWMutex
+	byName map[string]func() Fetcher
+	names  map[reflect.Type]string
+}{byName: map[string]func() Fetcher{}, names: map[reflect.Type]string{}}
 
-func Wrap(f Fetcher) Wrapper {
-	switch ft := f.(type) {
-	case *Archive:
-		return Wrapper{Archive: ft}
-	case *Git:
-		return Wrapper{Git: ft}
-	case *LocalPath:
-		return Wrapper{LocalPath: ft}
-	}
-	return Wrapper{}
+// RegisterType makes a Fetcher implementation known under the given type name, so that it can be stored in lockfiles
+// (see Wrapper). `newFetcher` must return a pointer to a new, empty fetcher of the type, which JSON is decoded into;
+// the fetcher is encoded and decoded with encoding/json, so it should implement json.Marshaler and json.Unmarshaler if
+// it needs a custom format. Its JSON form must be an object, and must not have a "type" key. RegisterType is meant to
+// be called from init functions; it panics if the type name or the type was already registered.
+func RegisterType(name string, newFetcher func() Fetcher) {
+	fetcherTypes.Lock()
+	defer fetcherTypes.Unlock()
+	t := reflect.TypeOf(newFetcher())
+	if _, ok := fetcherTypes.byName[name]; ok {
+		panic(fmt.Sprintf("fetcher type %q registered twice", name))
+	}
+	if other, ok := fetcherTypes.names[t]; ok {
+		panic(fmt.Sprintf("%v already registered as fetcher type %q", t, other))
+	}
+	fetcherTypes.byName[name] = newFetcher
+	fetcherTypes.names[t] = name
 }
 
-func (w Wrapper) Unwrap() Fetcher {
-	if w.Archive != nil {
-		return w.Archive
-	}
-	if w.Git != nil {
-		return w.Git
+// Types returns the names of all registered fetcher types, in sorted order.
+func Types() []string {
+	fetcherTypes.RLock()
+	defer fetcherTypes.RUnlock()
+	names := make([]string, 0, len(fetcherTypes.byName))
+	for name := range fetcherTypes.byName {
+		names = append(names, name)
 	}
-	return w.LocalPath
+	sort.Strings(names)
+	return names
 }
 
-func (w Wrapper) Fetch(vendorDir string) (string, error) {
-	return w.Unwrap().Fetch(vendorDir)
+// legacyTypeNames maps the keys that identified fetchers in lockfiles written before the type registry existed (as
+// in {"Archive": {...}}) to their type names.
+var legacyTypeNames = map[string]string{
+	"Archive":   "archive",
+	"Git":       "git",
+	"LocalPath": "local_path",
 }
 
-func (w Wrapper) Fingerprint() string {
-	return w.Unwrap().Fingerprint()
+// Wrapper holds a Fetcher of any registered type, and is useful in JSON marshalling/unmarshalling: it's encoded as the
+// fetcher's own JSON object, with an added "type" key holding the type name, as in {"type": "git", "Repo": "...",
+// "Commit": "..."}. The legacy format {"Archive": {...}} (with one of the keys Archive, Git or LocalPath) is still accepted.
+type Wrapper struct {
+	Fetcher
 }
 
-func (w Wrapper) AppendPatches(patches []Patch) error {
-	return w.Unwrap().AppendPatches(patches)
+func Wrap(f Fetcher) Wrapper {
+	if w, ok := f.(Wrapper); ok {
+		return w
+	}
+	return Wrapper{f}
 }
 
-// LocalPath represents a locally available unpacked directory.
-type LocalPath struct {
-	Path string
+func (w Wrapper) Unwrap() Fetcher {
+	return w.Fetcher
+}
+
+func (w Wrapper) MarshalJSON() ([]byte, error) {
+	if w.Fetcher == nil {
+		return []byte("null"), nil
+	}
+	fetcherTypes.RLock()
+	name, ok := fetcherTypes.names[reflect.TypeOf(w.Fetcher)]
+	fetcherTypes.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unregistered fetcher type %T", w.Fetcher)
+	}
+	fields, err := json.Marshal(w.Fetcher)
+	if err != nil {
+		return nil, err
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(fields, &probe); err != nil || probe == nil {
+		return nil, fmt.Errorf("fetcher type %q isn't encoded as a JSON object", name)
+	}
+	// JSON keys are matched case-insensitively when decoding, so "Type" would be just as ambiguous.
+	for key := range probe {
+		if strings.EqualFold(key, "type") {
+			return nil, fmt.Errorf("fetcher type %q has a key %q colliding with the reserved \"type\" key", name, key)
+		}
+	}
+	typeField, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"type":`)
+	b.Write(typeField)
+	if len(probe) > 0 {
+		fields = bytes.TrimSpace(fields)
+		b.WriteString(",")
+		b.Write(fields[1:])
+	} else {
+		b.WriteString("}")
+	}
+	return b.Bytes(), nil
 }
 
-func (lp *LocalPath) Fetch(vendorDir string) (string, error) {
-	// Return the local path as-is, even in vendoring mode.
-	return lp.Path, nil
+func (w *Wrapper) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		// null
+		w.Fetcher = nil
+		return nil
+	}
+	typeField, ok := fields["type"]
+	if !ok {
+		return w.unmarshalLegacy(fields)
+	}
+	var name string
+	if err := json.Unmarshal(typeField, &name); err != nil {
+		return fmt.Errorf("invalid fetcher type: %v", err)
+	}
+	// The type key is matched case-sensitively, unlike the fetcher's own fields; make sure that it doesn't end up in
+	// one of them.
+	delete(fields, "type")
+	rest, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return w.decode(name, rest)
 }
 
-func (lp *LocalPath) Fingerprint() string {
-	// The local path never needs to be re-fetched.
-	return ""
+func (w *Wrapper) unmarshalLegacy(fields map[string]json.RawMessage) error {
+	for key, value := range fields {
+		name, ok := legacyTypeNames[key]
+		if !ok || string(value) == "null" {
+			continue
+		}
+		if len(fields) > 1 {
+			return fmt.Errorf("more than one fetcher given")
+		}
+		return w.decode(name, value)
+	}
+	return fmt.Errorf(`no fetcher type given (expected a "type" key)`)
 }
 
-func (lp *LocalPath) AppendPatches(patches []Patch) error {
-	return fmt.Errorf("LocalPath fetcher does not support patches")
+func (w *Wrapper) decode(name string, data []byte) error {
+	fetcherTypes.RLock()
+	newFetcher, ok := fetcherTypes.byName[name]
+	fetcherTypes.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown fetcher type %q", name)
+	}
+	f := newFetcher()
+	if err := json.Unmarshal(data, f); err != nil {
+		return fmt.Errorf("invalid fetcher of type %q: %v", name, err)
+	}
+	w.Fetcher = f
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"reflect"
 	"testing"
 )
 
@@ -16,12 +17,37 @@ func TestWrapper_JSONRoundtrip(t *testing.T) {
 			StripPrefix: "",
 			Patches:     nil,
 		},
+		&Archive{
+			URLs:        []string{"https://bazel.build/a"},
+			Integrity:   "sha256-blah",
+			StripPrefix: "a-1.0",
+			Type:        "tar.gz",
+			Fprint:      "fprint",
+		},
 		&Git{
 			Repo:    "https://github.com/bazelbuild/bzlmod",
 			Commit:  "123456abcdef",
 			Patches: []Patch{{"file1", 1}, {"file2", 0}},
 		},
-		&LocalPath{"heh"},
+		&LocalPath{Path: "heh"},
+		&LocalPath{
+			Path:           "heh",
+			Fingerprinting: FingerprintContents,
+			Ignore:         []string{".git"},
+			Patches:        []Patch{{"file1", 1}},
+		},
+		&File{
+			URLs:       []string{"https://bazel.build/tool"},
+			Integrity:  "sha256-blah",
+			Executable: true,
+			Fprint:     "fprint",
+		},
+		&Plugin{
+			URL:       "corp://artifacts/a/1.0",
+			Integrity: "sha256-blah",
+			Patches:   []Patch{{"file1", 1}},
+			Fprint:    "fprint",
+		},
 	}
 
 	for i, fetcher := range testCases {
@@ -33,3 +59,91 @@ func TestWrapper_JSONRoundtrip(t *testing.T) {
 		assert.Equal(t, fetcher, wrapper.Unwrap(), msg)
 	}
 }
+
+func TestWrapper_Envelope(t *testing.T) {
+	bytes, err := json.Marshal(Wrap(&Archive{URLs: []string{"https://bazel.build/a.zip"}, Type: "zip"}))
+	require.NoError(t, err)
+	assert.Equal(t,
+		`{"type":"archive","URLs":["https://bazel.build/a.zip"],"Integrity":"","StripPrefix":"","Patches":null,"ArchiveType":"zip","Fprint":""}`,
+		string(bytes))
+
+	// The type key doesn't clash with the Type field of Archive, even though keys are matched case-insensitively.
+	var w Wrapper
+	require.NoError(t, json.Unmarshal(bytes, &w))
+	assert.Equal(t, &Archive{URLs: []string{"https://bazel.build/a.zip"}, Type: "zip"}, w.Unwrap())
+}
+
+func TestWrapper_LegacyFormat(t *testing.T) {
+	var w Wrapper
+	require.NoError(t, json.Unmarshal([]byte(`{"Git": {"Repo": "https://github.com/bazelbuild/bzlmod", "Commit": "abc"}}`), &w))
+	assert.Equal(t, &Git{Repo: "https://github.com/bazelbuild/bzlmod", Commit: "abc"}, w.Unwrap())
+
+	require.NoError(t, json.Unmarshal([]byte(`{"LocalPath": {"Path": "heh"}}`), &w))
+	assert.Equal(t, &LocalPath{Path: "heh"}, w.Unwrap())
+}
+
+func TestWrapper_Errors(t *testing.T) {
+	for input, expectedErr := range map[string]string{
+		`{}`:                                 `no fetcher type given (expected a "type" key)`,
+		`{"type": "svn"}`:                    `unknown fetcher type "svn"`,
+		`{"type": "git", "Commit": 1}`:       `invalid fetcher of type "git": json: cannot unmarshal number into Go struct field Git.Commit of type string`,
+		`{"Git": {}, "LocalPath": {}}`:       `more than one fetcher given`,
+		`{"type": 1}`:                        `invalid fetcher type: json: cannot unmarshal number into Go value of type string`,
+		`{"type": "local_path", "Path": []}`: `invalid fetcher of type "local_path": json: cannot unmarshal array into Go struct field LocalPath.Path of type string`,
+	} {
+		var w Wrapper
+		assert.EqualError(t, json.Unmarshal([]byte(input), &w), expectedErr, input)
+	}
+}
+
+type customFetcher struct {
+	URL string
+}
+
+func (c *customFetcher) Fetch(vendorDir string) (string, error) { return "", nil }
+func (c *customFetcher) Fingerprint() string                    { return c.URL }
+func (c *customFetcher) AppendPatches(patches []Patch) error    { return nil }
+
+// unregisterType undoes RegisterType, so that tests registering types can be run repeatedly.
+func unregisterType(name string) {
+	fetcherTypes.Lock()
+	defer fetcherTypes.Unlock()
+	delete(fetcherTypes.names, reflect.TypeOf(fetcherTypes.byName[name]()))
+	delete(fetcherTypes.byName, name)
+}
+
+func TestRegisterType(t *testing.T) {
+	RegisterType("test_custom", func() Fetcher { return &customFetcher{} })
+	t.Cleanup(func() { unregisterType("test_custom") })
+	assert.Contains(t, Types(), "test_custom")
+
+	bytes, err := json.Marshal(Wrap(&customFetcher{"svn://example.com"}))
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"test_custom","URL":"svn://example.com"}`, string(bytes))
+	var w Wrapper
+	require.NoError(t, json.Unmarshal(bytes, &w))
+	assert.Equal(t, &customFetcher{"svn://example.com"}, w.Unwrap())
+
+	assert.Panics(t, func() { RegisterType("test_custom", func() Fetcher { return &Git{} }) })
+	assert.Panics(t, func() { RegisterType("test_other", func() Fetcher { return &customFetcher{} }) })
+
+	_, err = json.Marshal(Wrap(&struct{ customFetcher }{}))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unregistered fetcher type *struct { fetch.customFetcher }")
+	}
+}
+
+type typedFetcher struct {
+	customFetcher
+	Type string
+}
+
+func TestWrapper_TypeKeyCollision(t *testing.T) {
+	RegisterType("test_typed", func() Fetcher { return &typedFetcher{} })
+	t.Cleanup(func() { unregisterType("test_typed") })
+
+	_, err := json.Marshal(Wrap(&typedFetcher{Type: "x"}))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `fetcher type "test_typed" has a key "Type" colliding with the reserved "type" key`)
+	}
+}
@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"fmt"
+	integrities "github.com/bazelbuild/bzlmod/common/integrity"
+	"io/ioutil"
+	urls "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// File represents a single file (such as a binary or a .jar) to be fetched from one of multiple equivalent URLs. Unlike
+// an Archive, it's not extracted. Like Bazel's http_file, the repo contains the file in a "file" directory, along with
+// a BUILD file that exposes it as the target "//file".
+type File struct {
+	URLs      []string
+	Integrity string
+	// FileName is the name of the file in the repo. If empty, it's taken from the path of the first URL.
+	FileName   string `json:",omitempty"`
+	Executable bool   `json:",omitempty"`
+
+	// Fprint is used as the name of the shared repo directory, like Archive.Fprint.
+	Fprint string
+}
+
+func init() {
+	RegisterType("file", func() Fetcher { return &File{} })
+}
+
+const fileBuildTemplate = `# This file is automatically generated by bzlmod
+package(default_visibility = ["//visibility:public"])
+
+exports_files([%[1]q])
+
+filegroup(
+    name = "file",
+    srcs = [%[1]q],
+)
+`
+
+func (f *File) Fetch(vendorDir string) (string, error) {
+	return fetchWithSharedRepoDir(f.Fprint, vendorDir, f.download)
+}
+
+func (f *File) fetchFresh(destDir string) error {
+	return f.download(destDir)
+}
+
+func (f *File) Fingerprint() string {
+	return f.Fprint
+}
+
+func (f *File) AppendPatches(patches []Patch) error {
+	return fmt.Errorf("File fetcher does not support patches")
+}
+
+func (f *File) CacheEntries() ([]string, error) {
+	downloads, err := downloadCacheEntries(f.URLs, f.Integrity)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedRepoCacheEntries(f.Fprint)
+	if err != nil {
+		return nil, err
+	}
+	return append(downloads, shared...), nil
+}
+
+func (f *File) DownloadURLs() ([]string, string) {
+	return f.URLs, f.Integrity
+}
+
+// fileName returns the name of the file in the repo.
+func (f *File) fileName() (string, error) {
+	name := f.FileName
+	if name == "" && len(f.URLs) > 0 {
+		if u, err := urls.Parse(f.URLs[0]); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	switch {
+	case name == "" || name == "." || name == "/":
+		return "", fmt.Errorf("can't determine a file name from %v; please specify one", f.URLs)
+	case name == ".." || strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("invalid file name %q", name)
+	case name == "BUILD" || name == "BUILD.bazel":
+		return "", fmt.Errorf("the file name %q is reserved for the generated BUILD file", name)
+	}
+	return name, nil
+}
+
+func (f *File) download(destDir string) error {
+	name, err := f.fileName()
+	if err != nil {
+		return err
+	}
+	integ, err := integrities.NewChecker(f.Integrity)
+	if err != nil {
+		return err
+	}
+	fp, _, unlock, err := downloadFromURLs(f.URLs, integ, "file")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.RemoveAll(destDir); err != nil {
+		return err
+	}
+	fileDir := filepath.Join(destDir, "file")
+	if err := os.MkdirAll(fileDir, 0777); err != nil {
+		return fmt.Errorf("can't create directory %v: %v", fileDir, err)
+	}
+	var mode os.FileMode = 0644
+	if f.Executable {
+		mode = 0755
+	}
+	// Never hardlink from the download cache: changing the mode would change the cached file as well.
+	if err := copyFile(fp, filepath.Join(fileDir, name), mode, CopyReflink); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(fileDir, "BUILD.bazel"), []byte(fmt.Sprintf(fileBuildTemplate, name)), 0644)
+}
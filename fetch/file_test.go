@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	contents := []byte("#!/bin/sh\necho hi\n")
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/dl/tool-1.0": contents,
+	})
+	defer server.Close()
+
+	f := &File{
+		URLs:       []string{server.URL + "/dl/tool-1.0"},
+		Integrity:  integrity.MustGenerate("sha256", contents),
+		FileName:   "tool",
+		Executable: true,
+		Fprint:     "some_fingerprint",
+	}
+	fp, err := f.Fetch("")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", "some_fingerprint"), fp)
+	testutil.AssertFileContentsBytes(t, filepath.Join(fp, "file", "tool"), contents)
+	// Files in shared repo dirs are read-only.
+	info, err := os.Stat(filepath.Join(fp, "file", "tool"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0555), info.Mode().Perm())
+	}
+	testutil.AssertFileContents(t, filepath.Join(fp, "file", "BUILD.bazel"), `# This file is automatically generated by bzlmod
+package(default_visibility = ["//visibility:public"])
+
+exports_files(["tool"])
+
+filegroup(
+    name = "file",
+    srcs = ["tool"],
+)
+`)
+
+	// The cached download itself isn't made executable.
+	info, err = os.Stat(casPath(contents))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0), info.Mode().Perm()&0111)
+	}
+}
+
+func TestFile_DefaultFileName(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/dl/lib-1.0.jar": []byte("jar"),
+	})
+	defer server.Close()
+
+	f := &File{
+		URLs:      []string{server.URL + "/dl/lib-1.0.jar?download=1"},
+		Integrity: integrity.MustGenerate("sha256", []byte("jar")),
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := f.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file", "lib-1.0.jar"), "jar")
+	info, err := os.Stat(filepath.Join(fp, "file", "lib-1.0.jar"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0444), info.Mode().Perm())
+	}
+}
+
+func TestFile_Errors(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	for fileName, expectedErr := range map[string]string{
+		"BUILD":  `the file name "BUILD" is reserved for the generated BUILD file`,
+		"a/b":    `invalid file name "a/b"`,
+		"..":     `invalid file name ".."`,
+		"BUILD2": "error downloading file",
+	} {
+		f := &File{URLs: []string{"file:///nonexistent"}, FileName: fileName, Fprint: "fprint"}
+		_, err := f.Fetch("")
+		assert.EqualError(t, err, expectedErr, fileName)
+	}
+
+	f := &File{URLs: []string{"https://example.com/"}, Fprint: "fprint"}
+	_, err := f.Fetch("")
+	assert.EqualError(t, err, "can't determine a file name from [https://example.com/]; please specify one")
+
+	assert.EqualError(t, f.AppendPatches([]Patch{{"a.patch", 1}}), "File fetcher does not support patches")
+}
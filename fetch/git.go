@@ -1,6 +1,15 @@
 package fetch
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
 
 // Git represents a Git repository.
 type Git struct {
@@ -9,15 +18,108 @@ type Git struct {
 	Patches []Patch
 }
 
+func init() {
+	RegisterType("git", func() Fetcher { return &Git{} })
+}
+
 func (g *Git) Fetch(vendorDir string) (string, error) {
-	return "", fmt.Errorf("git fetch unimplemented")
+	return fetchWithSharedRepoDir(g.Fingerprint(), vendorDir, g.checkoutAndPatch)
+}
+
+func (g *Git) fetchFresh(destDir string) error {
+	return g.checkoutAndPatch(destDir)
 }
 
 func (g *Git) Fingerprint() string {
-	return "TODO" // TODO
+	// The commit pins down the exact contents of the repo, so together with the patches it's all we need.
+	return common.Hash("git", g.Repo, g.Commit, g.Patches)
 }
 
 func (g *Git) AppendPatches(patches []Patch) error {
 	g.Patches = append(g.Patches, patches...)
 	return nil
 }
+
+func (g *Git) CacheEntries() ([]string, error) {
+	patches, err := patchCacheEntries(g.Patches)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedRepoCacheEntries(g.Fingerprint())
+	if err != nil {
+		return nil, err
+	}
+	return append(patches, shared...), nil
+}
+
+func (g *Git) checkoutAndPatch(destDir string) error {
+	remote, err := resolveRepo(g.Repo)
+	if err != nil {
+		return err
+	}
+	if httpclient.Offline && !isLocalRepo(remote) {
+		return fmt.Errorf("%w: can't clone %v", httpclient.ErrOffline, g.Repo)
+	}
+	if err := os.RemoveAll(destDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return fmt.Errorf("can't create directory %v: %v", destDir, err)
+	}
+	if err := runGit(destDir, "init", "--quiet"); err != nil {
+		return err
+	}
+	if err := runGit(destDir, "remote", "add", "origin", remote); err != nil {
+		return err
+	}
+	// Try to fetch only the commit we need first. Some servers refuse to serve commits that aren't advertised, in which
+	// case we fall back to fetching everything.
+	if err := runGit(destDir, "fetch", "--quiet", "--depth=1", "origin", g.Commit); err != nil {
+		if err := runGit(destDir, "fetch", "--quiet", "origin"); err != nil {
+			return fmt.Errorf("error fetching from %v: %v", g.Repo, err)
+		}
+	}
+	if err := runGit(destDir, "checkout", "--quiet", "--detach", g.Commit); err != nil {
+		return fmt.Errorf("error checking out commit %v of %v: %v", g.Commit, g.Repo, err)
+	}
+	// The repo's history is of no interest to anyone; drop it so that the fetched contents look the same as those of an
+	// extracted archive.
+	if err := os.RemoveAll(filepath.Join(destDir, ".git")); err != nil {
+		return err
+	}
+	return applyPatches(destDir, g.Patches)
+}
+
+// resolveRepo returns the URL to fetch the given git repo from. Like git, it takes anything that's neither a URL (as in
+// "https://host/path") nor scp-like (as in "host:path", with no slash before the colon) to be a path on the local
+// filesystem. Relative paths are made absolute, since git runs in another directory but they're meant relative to our
+// working directory.
+func resolveRepo(repo string) (string, error) {
+	if strings.Contains(repo, "://") || filepath.IsAbs(repo) {
+		return repo, nil
+	}
+	if i := strings.Index(repo, ":"); i != -1 && !strings.Contains(repo[:i], "/") {
+		return repo, nil
+	}
+	return filepath.Abs(repo)
+}
+
+// isLocalRepo returns whether the given git repo URL, as returned by resolveRepo, refers to the local filesystem.
+func isLocalRepo(repo string) bool {
+	return strings.HasPrefix(repo, "file://") || filepath.IsAbs(repo)
+}
+
+// runGit runs git with the given arguments in the directory `dir`. The error returned (if any) includes what git wrote
+// to stderr.
+func runGit(dir string, args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Never let git prompt for credentials; there's nobody to answer.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package fetch
+
+import (
+	"errors"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGit_Fetch(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	commits := testutil.BuildGitRepo(t, repoDir,
+		map[string][]byte{
+			"file1":     []byte("file1contents"),
+			"dir/file2": []byte("file2contents"),
+		},
+		map[string][]byte{
+			"file1": []byte("newer file1contents"),
+		},
+	)
+
+	// Fetch the first commit, which is not the tip of any branch.
+	g := &Git{
+		Repo:   "file://" + filepath.ToSlash(repoDir),
+		Commit: commits[0],
+	}
+	fp, err := g.Fetch("")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", g.Fingerprint()), fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "bzlmod.fingerprint"), g.Fingerprint())
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+	testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
+	// The .git directory should not be left behind.
+	_, err = os.Stat(filepath.Join(fp, ".git"))
+	if !assert.True(t, os.IsNotExist(err)) {
+		t.Logf("expected NotExist, got: %v", err)
+	}
+
+	// A different commit is a different fingerprint, and thus a different directory.
+	g2 := &Git{
+		Repo:   "file://" + filepath.ToSlash(repoDir),
+		Commit: commits[1],
+	}
+	assert.NotEqual(t, g.Fingerprint(), g2.Fingerprint())
+	fp2, err := g2.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp2, "file1"), "newer file1contents")
+	testutil.AssertFileContents(t, filepath.Join(fp2, "dir", "file2"), "file2contents")
+}
+
+func TestGit_RelativePath(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	repoDir := filepath.Join(tempDir, "repo.git")
+	commits := testutil.BuildGitRepo(t, repoDir, map[string][]byte{"file": []byte("contents")})
+
+	// The path is relative to our working directory, not to wherever git runs.
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	relPath, err := filepath.Rel(wd, repoDir)
+	require.NoError(t, err)
+	g := &Git{Repo: "." + string(filepath.Separator) + relPath, Commit: commits[0]}
+	fp, err := g.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "contents")
+}
+
+func TestGit_BareRelativePath(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	commits := testutil.BuildGitRepo(t, filepath.Join(tempDir, "sub", "repo"), map[string][]byte{"file": []byte("contents")})
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(tempDir))
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+	// A local repo can be fetched offline.
+	httpclient.Offline = true
+	defer func() { httpclient.Offline = false }()
+
+	g := &Git{Repo: "sub/repo", Commit: commits[0]}
+	fp, err := g.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "contents")
+}
+
+func TestResolveRepo(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	for repo, expected := range map[string]string{
+		"https://github.com/bazelbuild/bzlmod": "https://github.com/bazelbuild/bzlmod",
+		"file:///src/repo":                     "file:///src/repo",
+		"git@github.com:bazelbuild/bzlmod.git": "git@github.com:bazelbuild/bzlmod.git",
+		"sub/repo":                             filepath.Join(wd, "sub", "repo"),
+		"./repo":                               filepath.Join(wd, "repo"),
+		"sub/repo:with-colon":                  filepath.Join(wd, "sub", "repo:with-colon"),
+	} {
+		resolved, err := resolveRepo(repo)
+		if assert.NoError(t, err, repo) {
+			assert.Equal(t, expected, resolved, repo)
+		}
+	}
+}
+
+func TestGit_Vendor(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	commits := testutil.BuildGitRepo(t, repoDir, map[string][]byte{
+		"file1": []byte("file1contents"),
+	})
+	g := &Git{
+		Repo:   "file://" + filepath.ToSlash(repoDir),
+		Commit: commits[0],
+	}
+
+	vendorDir := filepath.Join(tempDir, "vendor")
+	testutil.WriteFile(t, filepath.Join(vendorDir, "random_file"), "something")
+	fp, err := g.Fetch(vendorDir)
+	require.NoError(t, err)
+	require.Equal(t, vendorDir, fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "bzlmod.fingerprint"), g.Fingerprint())
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+	// "random_file" should have been deleted.
+	_, err = os.Stat(filepath.Join(fp, "random_file"))
+	if !assert.True(t, os.IsNotExist(err)) {
+		t.Logf("expected NotExist, got: %v", err)
+	}
+}
+
+func TestGit_Patches(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	commits := testutil.BuildGitRepo(t, repoDir, map[string][]byte{
+		"file1": []byte("line1\nline2\n"),
+	})
+	testutil.WriteFile(t, filepath.Join(tempDir, "fix.patch"), `--- a/file1
++++ b/file1
+@@ -1,2 +1,2 @@
+ line1
+-line2
++line2 patched
+`)
+	g := &Git{
+		Repo:    "file://" + filepath.ToSlash(repoDir),
+		Commit:  commits[0],
+		Patches: []Patch{{"file://" + filepath.ToSlash(filepath.Join(tempDir, "fix.patch")), 1}},
+	}
+
+	fp, err := g.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "line1\nline2 patched\n")
+
+	// Patches are part of the fingerprint.
+	unpatched := &Git{Repo: g.Repo, Commit: g.Commit}
+	assert.NotEqual(t, unpatched.Fingerprint(), g.Fingerprint())
+}
+
+func TestGit_BadCommit(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	repoDir := filepath.Join(tempDir, "repo.git")
+	testutil.BuildGitRepo(t, repoDir, map[string][]byte{
+		"file1": []byte("file1contents"),
+	})
+	g := &Git{
+		Repo:   "file://" + filepath.ToSlash(repoDir),
+		Commit: "0123456789abcdef0123456789abcdef01234567",
+	}
+	_, err := g.Fetch("")
+	require.Error(t, err)
+	// A failed fetch shouldn't leave a directory that looks ready.
+	sharedRepoDir, err := SharedRepoDir(g.Fingerprint())
+	require.NoError(t, err)
+	assert.False(t, verifyFingerprintFile(sharedRepoDir, g.Fingerprint()))
+}
+
+func TestGit_Offline(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	httpclient.Offline = true
+	defer func() { httpclient.Offline = false }()
+
+	g := Git{Repo: "https://example.com/repo.git", Commit: "0123456789abcdef0123456789abcdef01234567"}
+	_, err := g.Fetch("")
+	if assert.True(t, errors.Is(err, httpclient.ErrOffline)) {
+		assert.Contains(t, err.Error(), "https://example.com/repo.git")
+	}
+}
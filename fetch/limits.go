@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits caps the resources a single fetch may consume, to protect against malicious or broken archives (such as
+// decompression bombs). A zero value for any field means no limit.
+type Limits struct {
+	// MaxDownloadSize is the maximum size in bytes of any single downloaded file.
+	MaxDownloadSize int64
+	// MaxExtractedSize is the maximum total size in bytes of the files extracted from a single archive.
+	MaxExtractedSize int64
+	// MaxFileCount is the maximum number of entries extracted from a single archive.
+	MaxFileCount int64
+	// MaxCompressionRatio is the maximum ratio between the total size of the files extracted from an archive and the
+	// size of the archive itself. It's only enforced once more than compressionRatioThreshold bytes have been
+	// extracted, since tiny archives routinely have absurd ratios.
+	MaxCompressionRatio int64
+}
+
+const compressionRatioThreshold = 16 << 20
+
+// Validate checks that no limit is negative. The limits are named after the flags that set them.
+func (l Limits) Validate() error {
+	limits := []struct {
+		name  string
+		value int64
+	}{
+		{"max_download_size", l.MaxDownloadSize},
+		{"max_extracted_size", l.MaxExtractedSize},
+		{"max_file_count", l.MaxFileCount},
+		{"max_compression_ratio", l.MaxCompressionRatio},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 {
+			return fmt.Errorf("%v must not be negative, got %v", limit.name, limit.value)
+		}
+	}
+	return nil
+}
+
+// DefaultLimits are the limits applied to all fetches. They can be overridden by command-line flags.
+var DefaultLimits = Limits{
+	MaxDownloadSize:     8 << 30,
+	MaxExtractedSize:    32 << 30,
+	MaxFileCount:        1000000,
+	MaxCompressionRatio: 1000,
+}
+
+// LimitError is the error returned when a fetch is aborted because it breached one of the Limits.
+type LimitError struct {
+	// Limit is the name of the field in Limits that was breached.
+	Limit string
+	// Max is the value of that field.
+	Max int64
+	// Source is the URL or archive that breached the limit.
+	Source string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v exceeds the limit %v=%v", e.Source, e.Limit, e.Max)
+}
+
+// limitedReader reads from r, but fails with a LimitError once more than max bytes have been read.
+type limitedReader struct {
+	r      io.Reader
+	n      int64
+	max    int64
+	source string
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.max > 0 && l.n > l.max {
+		return n, &LimitError{"MaxDownloadSize", l.max, l.source}
+	}
+	return n, err
+}
+
+// extractionBudget keeps track of how much an extraction has written so far against the limits.
+type extractionBudget struct {
+	limits      Limits
+	archiveSize int64
+	source      string
+	files       int64
+	bytes       int64
+}
+
+func (b *extractionBudget) addFile() error {
+	b.files++
+	if b.limits.MaxFileCount > 0 && b.files > b.limits.MaxFileCount {
+		return &LimitError{"MaxFileCount", b.limits.MaxFileCount, b.source}
+	}
+	return nil
+}
+
+func (b *extractionBudget) addBytes(n int64) error {
+	b.bytes += n
+	if b.limits.MaxExtractedSize > 0 && b.bytes > b.limits.MaxExtractedSize {
+		return &LimitError{"MaxExtractedSize", b.limits.MaxExtractedSize, b.source}
+	}
+	if b.limits.MaxCompressionRatio > 0 && b.bytes > compressionRatioThreshold &&
+		b.bytes > b.limits.MaxCompressionRatio*b.archiveSize {
+		return &LimitError{"MaxCompressionRatio", b.limits.MaxCompressionRatio, b.source}
+	}
+	return nil
+}
+
+// Write lets the budget be used as the destination of an io.MultiWriter.
+func (b *extractionBudget) Write(p []byte) (int, error) {
+	if err := b.addBytes(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,127 @@
+package fetch
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func withLimits(limits Limits) func() {
+	old := DefaultLimits
+	DefaultLimits = limits
+	return func() { DefaultLimits = old }
+}
+
+func assertLimitError(t *testing.T, err error, limit string) {
+	var limitErr *LimitError
+	if assert.True(t, errors.As(err, &limitErr), "expected LimitError, got: %v", err) {
+		assert.Equal(t, limit, limitErr.Limit)
+	}
+}
+
+func assertNotExist(t *testing.T, path string) {
+	_, err := os.Stat(path)
+	if !assert.True(t, os.IsNotExist(err)) {
+		t.Logf("expected NotExist for %v, got: %v", path, err)
+	}
+}
+
+func TestLimits_DownloadSize(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	defer withLimits(Limits{MaxDownloadSize: 100})()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1": bytes.Repeat([]byte("x"), 1000),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+		"/b.zip": zipArchive,
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:   []string{server.URL + "/a.zip", server.URL + "/b.zip"},
+		Fprint: "some_fingerprint",
+	}
+	_, err := a.Fetch("")
+	assertLimitError(t, err, "MaxDownloadSize")
+	assertNotExist(t, filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/a.zip")))
+	assertNotExist(t, filepath.Join(TestBzlmodDir, "shared_repos", "some_fingerprint"))
+}
+
+func TestLimits_Extraction(t *testing.T) {
+	zeros := bytes.Repeat([]byte{0}, compressionRatioThreshold+1)
+	testCases := []struct {
+		limit  string
+		limits Limits
+		files  map[string][]byte
+	}{
+		{"MaxFileCount", Limits{MaxFileCount: 2}, map[string][]byte{
+			"a": []byte("a"), "b": []byte("b"), "c": []byte("c"),
+		}},
+		{"MaxExtractedSize", Limits{MaxExtractedSize: 10}, map[string][]byte{
+			"a": []byte("0123456789"), "b": []byte("0"),
+		}},
+		{"MaxCompressionRatio", Limits{MaxCompressionRatio: 100}, map[string][]byte{
+			"zeros": zeros,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.limit, func(t *testing.T) {
+			tempDir := t.TempDir()
+			TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+			defer func() { TestBzlmodDir = "" }()
+			defer withLimits(tc.limits)()
+
+			archivePath := filepath.Join(tempDir, "a.zip")
+			testutil.WriteFileBytes(t, archivePath, testutil.BuildZipArchive(t, tc.files))
+			a := Archive{
+				URLs:   []string{"file://" + filepath.ToSlash(archivePath)},
+				Fprint: "some_fingerprint",
+			}
+
+			_, err := a.Fetch("")
+			assertLimitError(t, err, tc.limit)
+			assertNotExist(t, filepath.Join(TestBzlmodDir, "shared_repos", "some_fingerprint"))
+
+			vendorDir := filepath.Join(tempDir, "vendor")
+			_, err = a.Fetch(vendorDir)
+			assertLimitError(t, err, tc.limit)
+			assertNotExist(t, vendorDir)
+		})
+	}
+}
+
+func TestLimits_WithinLimits(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	defer withLimits(Limits{MaxFileCount: 2, MaxExtractedSize: 10, MaxCompressionRatio: 1})()
+
+	// The compression ratio isn't enforced below the threshold.
+	archivePath := filepath.Join(tempDir, "a.zip")
+	testutil.WriteFileBytes(t, archivePath, testutil.BuildZipArchive(t, map[string][]byte{
+		"a": []byte("0123456789"),
+	}))
+	a := Archive{
+		URLs:   []string{"file://" + filepath.ToSlash(archivePath)},
+		Fprint: "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "a"), "0123456789")
+}
+
+func TestLimits_Validate(t *testing.T) {
+	assert.NoError(t, Limits{}.Validate())
+	assert.NoError(t, DefaultLimits.Validate())
+	assert.EqualError(t, Limits{MaxCompressionRatio: -1}.Validate(), "max_compression_ratio must not be negative, got -1")
+	assert.Error(t, Limits{MaxDownloadSize: -1}.Validate())
+}
@@ -0,0 +1,135 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Ways of computing the fingerprint of a LocalPath.
+const (
+	// FingerprintNone never changes the fingerprint, so the contents are never considered out of date.
+	FingerprintNone = ""
+	// FingerprintMetadata hashes the paths, modes, sizes and modification times of all files.
+	FingerprintMetadata = "metadata"
+	// FingerprintContents hashes the paths, modes and contents of all files.
+	FingerprintContents = "contents"
+)
+
+// DefaultLocalPathIgnore are the patterns ignored in local paths unless others are given: the output symlinks of Bazel
+// and version control metadata.
+var DefaultLocalPathIgnore = []string{"bazel-*", ".git"}
+
+// LocalPath represents a locally available unpacked directory.
+type LocalPath struct {
+	Path string
+	// Fingerprinting is one of the Fingerprint* constants. It defaults to FingerprintNone, except that
+	// FingerprintMetadata is used if there are patches. The fingerprint is computed once per LocalPath, and Bazel only
+	// sees the one written to the lockfile at resolve time: edits made after resolving go unnoticed until the next
+	// resolve.
+	Fingerprinting string `json:",omitempty"`
+	// Ignore lists glob patterns (in the syntax of path.Match) of the files and directories that are neither
+	// fingerprinted nor copied when patching. A pattern without a slash is matched against the name of each entry, and
+	// one with a slash against its path relative to Path.
+	Ignore []string `json:",omitempty"`
+	// Patches are applied to a copy of the directory (an "overlay"), which is then used instead of the directory
+	// itself.
+	Patches []Patch `json:",omitempty"`
+
+	// fprint memoizes Fingerprint, as hashing the tree is expensive.
+	fprintMu sync.Mutex
+	fprint   *string
+}
+
+func init() {
+	RegisterType("local_path", func() Fetcher { return &LocalPath{} })
+}
+
+func (lp *LocalPath) Fetch(vendorDir string) (string, error) {
+	if len(lp.Patches) == 0 {
+		// Return the local path as-is, even in vendoring mode.
+		return lp.Path, nil
+	}
+	return fetchWithSharedRepoDir(lp.Fingerprint(), vendorDir, lp.copyAndPatch)
+}
+
+func (lp *LocalPath) fetchFresh(destDir string) error {
+	return lp.copyAndPatch(destDir)
+}
+
+func (lp *LocalPath) Fingerprint() string {
+	lp.fprintMu.Lock()
+	defer lp.fprintMu.Unlock()
+	if lp.fprint == nil {
+		fprint := lp.computeFingerprint()
+		lp.fprint = &fprint
+	}
+	return *lp.fprint
+}
+
+func (lp *LocalPath) computeFingerprint() string {
+	mode := lp.Fingerprinting
+	if mode == FingerprintNone {
+		if len(lp.Patches) == 0 {
+			// The local path never needs to be re-fetched.
+			return ""
+		}
+		mode = FingerprintMetadata
+	}
+	treeHash, err := hashTree(lp.Path, mode == FingerprintMetadata, lp.ignored)
+	if err != nil {
+		// Fetching will fail anyway; make sure it's retried once the problem is fixed.
+		return common.Hash("localPath", lp.Path, mode, err, lp.Patches)
+	}
+	return common.Hash("localPath", lp.Path, mode, treeHash, lp.Patches)
+}
+
+func (lp *LocalPath) AppendPatches(patches []Patch) error {
+	lp.fprintMu.Lock()
+	defer lp.fprintMu.Unlock()
+	lp.Patches = append(lp.Patches, patches...)
+	lp.fprint = nil
+	return nil
+}
+
+func (lp *LocalPath) CacheEntries() ([]string, error) {
+	if len(lp.Patches) == 0 {
+		// The local path is used in place.
+		return nil, nil
+	}
+	patches, err := patchCacheEntries(lp.Patches)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedRepoCacheEntries(lp.Fingerprint())
+	if err != nil {
+		return nil, err
+	}
+	return append(patches, shared...), nil
+}
+
+// copyAndPatch creates the overlay: a copy of the local path with the patches applied. The copy is never hardlinked,
+// as patching would then modify the original files.
+func (lp *LocalPath) copyAndPatch(destDir string) error {
+	if err := copyTree(lp.Path, destDir, CopyReflink, lp.ignored); err != nil {
+		return err
+	}
+	return applyPatches(destDir, lp.Patches)
+}
+
+// ignored reports whether the entry at the given slash-separated path (relative to lp.Path) matches one of the
+// ignore patterns.
+func (lp *LocalPath) ignored(relpath string) bool {
+	name := relpath[strings.LastIndex(relpath, "/")+1:]
+	for _, pattern := range lp.Ignore {
+		subject := name
+		if strings.Contains(pattern, "/") {
+			subject = relpath
+		}
+		if ok, _ := path.Match(pattern, subject); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalPath_NoFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "contents")
+	lp := LocalPath{Path: dir}
+	assert.Equal(t, "", lp.Fingerprint())
+	fp, err := lp.Fetch("")
+	require.NoError(t, err)
+	assert.Equal(t, dir, fp)
+}
+
+func TestLocalPath_Fingerprint(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "contents")
+	testutil.WriteFile(t, filepath.Join(dir, "bazel-out", "file"), "output")
+	testutil.WriteFile(t, filepath.Join(dir, "sub", "ignored.txt"), "ignored")
+	ignore := []string{"bazel-*", "sub/*.txt"}
+	// The fingerprint is computed once per LocalPath, so each check needs a new one.
+	metadata := func() string {
+		return (&LocalPath{Path: dir, Fingerprinting: FingerprintMetadata, Ignore: ignore}).Fingerprint()
+	}
+	contents := func() string {
+		return (&LocalPath{Path: dir, Fingerprinting: FingerprintContents, Ignore: ignore}).Fingerprint()
+	}
+	oldMetadata := metadata()
+	oldContents := contents()
+	assert.NotEqual(t, "", oldMetadata)
+	assert.NotEqual(t, "", oldContents)
+	assert.NotEqual(t, oldMetadata, oldContents)
+
+	// Ignored files don't matter.
+	testutil.WriteFile(t, filepath.Join(dir, "bazel-out", "file"), "other output")
+	testutil.WriteFile(t, filepath.Join(dir, "sub", "ignored.txt"), "still ignored")
+	assert.Equal(t, oldMetadata, metadata())
+	assert.Equal(t, oldContents, contents())
+
+	// Touching a file only changes the metadata.
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "file"), later, later))
+	assert.NotEqual(t, oldMetadata, metadata())
+	assert.Equal(t, oldContents, contents())
+
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "new contents")
+	assert.NotEqual(t, oldContents, contents())
+}
+
+func TestLocalPath_FingerprintMemoized(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "contents")
+	lp := &LocalPath{Path: dir, Fingerprinting: FingerprintContents}
+	fprint := lp.Fingerprint()
+
+	// Changes made after the fingerprint was computed aren't seen by the same LocalPath...
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "new contents")
+	assert.Equal(t, fprint, lp.Fingerprint())
+	// ...but appending patches changes the fingerprint.
+	require.NoError(t, lp.AppendPatches([]Patch{{"some.patch", 1}}))
+	assert.NotEqual(t, fprint, lp.Fingerprint())
+}
+
+func TestLocalPath_Patches(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	dir := filepath.Join(tempDir, "local")
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "a\nb\n")
+	testutil.WriteFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/main")
+	patchFile := filepath.Join(tempDir, "test.patch")
+	testutil.WriteFile(t, patchFile, `--- a/file
++++ b/file
+@@ -1,2 +1,2 @@
+ a
+-b
++B
+`)
+	lp := &LocalPath{Path: dir, Ignore: []string{".git"}}
+	require.NoError(t, lp.AppendPatches([]Patch{{patchFile, 1}}))
+	// Patching implies fingerprinting, as the overlay needs a place in the cache.
+	fprint := lp.Fingerprint()
+	require.NotEqual(t, "", fprint)
+
+	fp, err := lp.Fetch("")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", fprint), fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "a\nB\n")
+	_, err = os.Stat(filepath.Join(fp, ".git"))
+	assert.True(t, os.IsNotExist(err))
+	// The original is untouched.
+	testutil.AssertFileContents(t, filepath.Join(dir, "file"), "a\nb\n")
+
+	// Changing the original results in a new overlay.
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "a\nb\nc\n")
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "file"), later, later))
+	lp = &LocalPath{Path: dir, Ignore: []string{".git"}, Patches: []Patch{{patchFile, 1}}}
+	assert.NotEqual(t, fprint, lp.Fingerprint())
+	fp, err = lp.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "a\nB\nc\n")
+
+	// In vendoring mode, the overlay goes into the vendor dir.
+	vendorDir := filepath.Join(tempDir, "vendor")
+	fp, err = lp.Fetch(vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, vendorDir, fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "a\nB\nc\n")
+}
@@ -0,0 +1,140 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gofrs/flock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// lockEntry takes an exclusive lock on the cache entry at `path` (a file in the HTTP cache or a shared repo
+// directory), blocking until it's available. The lock is shared across processes, and is held through a separate
+// "<path>.lock" file since the entry itself gets replaced wholesale. Call the returned function to release the lock.
+func lockEntry(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	unlock, _, err := lockCurrentFile(path+".lock", (*flock.Flock).Lock)
+	if err != nil {
+		return nil, fmt.Errorf("can't lock %v: %v", path, err)
+	}
+	return unlock, nil
+}
+
+// lockEntries is like lockEntry, but locks several entries. They're locked in sorted order, so that processes locking
+// overlapping sets of entries can't deadlock.
+func lockEntries(paths []string) (func(), error) {
+	sorted := append([]string(nil), paths...)
+	sort.Strings(sorted)
+	var unlocks []func()
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, path := range sorted {
+		if i > 0 && path == sorted[i-1] {
+			continue
+		}
+		unlock, err := lockEntry(path)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// tryLockEntry is like lockEntry, but returns immediately with ok=false if the lock is held by someone else.
+func tryLockEntry(path string) (unlock func(), ok bool, err error) {
+	return lockCurrentFile(path+".lock", func(lock *flock.Flock) error {
+		if ok, err := lock.TryLock(); err != nil || ok {
+			return err
+		}
+		return errLockHeld
+	})
+}
+
+var errLockHeld = errors.New("lock is held")
+
+// lockCurrentFile locks the file at `lockPath` with `lock`. Clean removes the lock file of an evicted entry while
+// holding the lock, so by the time a waiting process gets the lock, its file may no longer be the one at `lockPath`;
+// in that case, the lock is worthless, and it's taken again on the current file. ok is false if `lock` returned
+// errLockHeld.
+func lockCurrentFile(lockPath string, lock func(*flock.Flock) error) (unlock func(), ok bool, err error) {
+	for {
+		before, err := statOrCreate(lockPath)
+		if err != nil {
+			return nil, false, err
+		}
+		fl := flock.New(lockPath)
+		if err := lock(fl); err == errLockHeld {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+		// The file that was locked was at `lockPath` both before and after it was opened, so it's still the current
+		// one, and Clean won't remove it as long as we hold the lock.
+		if after, err := os.Stat(lockPath); err == nil && os.SameFile(before, after) {
+			return func() { _ = fl.Unlock() }, true, nil
+		}
+		_ = fl.Unlock()
+	}
+}
+
+func statOrCreate(path string) (os.FileInfo, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// tempPrefix starts the names of all temporary files and directories created next to cache entries. Anything with
+// this prefix is garbage from an unfinished (possibly crashed) fetch.
+const tempPrefix = ".tmp-"
+
+// populateAtomically calls `populate` on a temporary directory next to `dir`, writes the fingerprint file, and then
+// moves the result into place. So `dir` is either absent, complete, or left as it was; never half-populated. The files
+// in the result are made read-only, so that they can safely be hardlinked into vendor dirs. The caller must hold the
+// lock on `dir`.
+func populateAtomically(dir string, fprint string, populate func(destDir string) error) error {
+	tempDir, err := ioutil.TempDir(filepath.Dir(dir), tempPrefix+filepath.Base(dir)+"-")
+	if err != nil {
+		return err
+	}
+	// This is a no-op once the rename has happened.
+	defer os.RemoveAll(tempDir)
+	if err := populate(tempDir); err != nil {
+		return err
+	}
+	if err := writeFingerprintFile(tempDir, fprint); err != nil {
+		return fmt.Errorf("can't write fingerprint file: %v", err)
+	}
+	if err := makeFilesReadOnly(tempDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.Rename(tempDir, dir)
+}
+
+// makeFilesReadOnly removes the write permissions of all regular files under `dir`. Directories stay writable, so that
+// the tree can still be removed.
+func makeFilesReadOnly(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if mode := info.Mode(); mode.IsRegular() && mode&0222 != 0 {
+			return os.Chmod(path, mode.Perm()&^0222)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,145 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "some", "entry")
+	unlock, err := lockEntry(path)
+	require.NoError(t, err)
+
+	_, ok, err := tryLockEntry(path)
+	require.NoError(t, err)
+	assert.False(t, ok, "lock should be held")
+
+	unlock()
+	unlock2, ok, err := tryLockEntry(path)
+	require.NoError(t, err)
+	if assert.True(t, ok, "lock should be free") {
+		unlock2()
+	}
+}
+
+func TestLockEntries(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{filepath.Join(dir, "b"), filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	unlock, err := lockEntries(paths)
+	require.NoError(t, err)
+	for _, path := range paths {
+		_, ok, err := tryLockEntry(path)
+		require.NoError(t, err)
+		assert.False(t, ok, "lock on %v should be held", path)
+	}
+
+	unlock()
+	for _, path := range paths[:2] {
+		unlock, ok, err := tryLockEntry(path)
+		require.NoError(t, err)
+		if assert.True(t, ok, "lock on %v should be free", path) {
+			unlock()
+		}
+	}
+}
+
+func TestLockEntry_LockFileRemovedWhileWaiting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry")
+	unlock, err := lockEntry(path)
+	require.NoError(t, err)
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := lockEntry(path)
+		if assert.NoError(t, err) {
+			acquired <- unlock
+		}
+	}()
+	// Give the goroutine time to start waiting, then do what Clean does when evicting the entry.
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.Remove(path+".lock"))
+	unlock()
+
+	unlock2 := <-acquired
+	defer unlock2()
+	// The waiter must have locked the current lock file, rather than the removed one.
+	_, ok, err := tryLockEntry(path)
+	require.NoError(t, err)
+	assert.False(t, ok, "lock should be held")
+}
+
+func TestArchive_ConcurrentFetches(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1":     []byte(`file1contents`),
+		"dir/file2": []byte(`file2contents`),
+	})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(zipArchive)
+	}))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := Archive{
+				URLs:      []string{server.URL + "/a.zip"},
+				Integrity: integrity.MustGenerate("sha256", zipArchive),
+				Fprint:    "some_fingerprint",
+			}
+			fp, err := a.Fetch("")
+			if assert.NoError(t, err) {
+				testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+				testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents")
+			}
+		}()
+	}
+	wg.Wait()
+	// Everyone but the first fetch should have found the shared repo dir ready.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestArchive_LeftoversFromCrashedFetch(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1": []byte(`file1contents`),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+	})
+	defer server.Close()
+
+	// A crashed fetch can leave temporary files and directories around, even ones that look complete.
+	testutil.WriteFile(t, filepath.Join(TestBzlmodDir, "shared_repos", ".tmp-some_fingerprint-123", "bzlmod.fingerprint"), "some_fingerprint")
+	testutil.WriteFile(t, filepath.Join(TestBzlmodDir, "shared_repos", ".tmp-some_fingerprint-123", "file1"), "stale")
+
+	a := Archive{
+		URLs:      []string{server.URL + "/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", "some_fingerprint"), fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1contents")
+}
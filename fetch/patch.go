@@ -1,6 +1,460 @@
 package fetch
 
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	urls "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
 type Patch struct {
 	PatchFile  string
 	PatchStrip int
 }
+
+// applyPatches applies the given patches to the contents of `dir`, in order.
+func applyPatches(dir string, patches []Patch) error {
+	for _, patch := range patches {
+		if err := patch.apply(dir); err != nil {
+			return fmt.Errorf("error applying patch %v: %v", patch.PatchFile, err)
+		}
+	}
+	return nil
+}
+
+func (p Patch) apply(dir string) error {
+	patchFile, unlock, err := p.localPath()
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(patchFile)
+	unlock()
+	if err != nil {
+		return err
+	}
+	filePatches, err := parsePatch(contents)
+	if err != nil {
+		return err
+	}
+	for _, fp := range filePatches {
+		if err := fp.apply(dir, p.PatchStrip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localPath returns the path on the local disk where the patch file can be read from, along with a function to call
+// once it's been read. Patch files with an HTTP(S) URL are downloaded into the HTTP cache first, and stay locked until
+// then.
+func (p Patch) localPath() (string, func(), error) {
+	url, err := urls.Parse(p.PatchFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("can't parse patch file location %v: %v", p.PatchFile, err)
+	}
+	switch url.Scheme {
+	case "":
+		return p.PatchFile, func() {}, nil
+	case "file":
+		return filepath.FromSlash(url.Path), func() {}, nil
+	case "http", "https":
+		// Patch files don't come with an integrity of their own; they're covered by the fingerprint of the fetcher.
+		return cachedDownload(p.PatchFile, nil)
+	default:
+		return "", nil, fmt.Errorf("unsupported patch file location: %v", p.PatchFile)
+	}
+}
+
+const devNull = "/dev/null"
+
+// filePatch is the part of a unified diff that concerns a single file.
+type filePatch struct {
+	// oldName and newName are the names in the "---" and "+++" lines (or the "diff --git" line), before stripping.
+	// Either can be devNull to signify creation or deletion.
+	oldName string
+	newName string
+	// renameFrom and renameTo are set for Git-style renames. Unlike the names above, these are never stripped.
+	renameFrom string
+	renameTo   string
+	// mode is the new mode of the file (from "new file mode" or "new mode" lines), or 0 if unchanged.
+	mode  os.FileMode
+	hunks []hunk
+}
+
+type hunk struct {
+	header   string
+	oldStart int
+	// oldLines and newLines are the lines before and after the change, including line terminators (so the last line
+	// of a file without a trailing newline has no terminator).
+	oldLines []string
+	newLines []string
+}
+
+var (
+	hunkHeaderRegexp = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+	gitHeaderRegexp  = regexp.MustCompile(`^diff --git (\S+) (\S+)$`)
+)
+
+// parsePatch parses the contents of a patch file in the unified diff format (including Git's extensions for file
+// creation, deletion, renames and mode changes). Lines that aren't part of any diff (such as commit messages) are
+// ignored.
+func parsePatch(contents []byte) ([]*filePatch, error) {
+	var lines []string
+	r := bufio.NewReader(bytes.NewReader(contents))
+	for {
+		line, err := r.ReadString('\n')
+		if line != "" {
+			lines = append(lines, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	var patches []*filePatch
+	var cur *filePatch
+	// inGitHeader is true between a "diff --git" line and the first hunk of that file.
+	inGitHeader := false
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			cur = &filePatch{}
+			patches = append(patches, cur)
+			inGitHeader = true
+			if m := gitHeaderRegexp.FindStringSubmatch(line); m != nil {
+				cur.oldName, cur.newName = m[1], m[2]
+			}
+		case inGitHeader && strings.HasPrefix(line, "rename from "):
+			cur.renameFrom = strings.TrimPrefix(line, "rename from ")
+		case inGitHeader && strings.HasPrefix(line, "rename to "):
+			cur.renameTo = strings.TrimPrefix(line, "rename to ")
+		case inGitHeader && strings.HasPrefix(line, "new file mode "):
+			cur.oldName = devNull
+			cur.mode = parseGitMode(strings.TrimPrefix(line, "new file mode "))
+		case inGitHeader && strings.HasPrefix(line, "new mode "):
+			cur.mode = parseGitMode(strings.TrimPrefix(line, "new mode "))
+		case inGitHeader && strings.HasPrefix(line, "deleted file mode "):
+			cur.newName = devNull
+		case inGitHeader && strings.HasPrefix(line, "GIT binary patch"):
+			return nil, fmt.Errorf("binary patches are not supported (%v)", cur.newName)
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if !inGitHeader {
+				cur = &filePatch{}
+				patches = append(patches, cur)
+			}
+			cur.oldName = parsePatchFileName(strings.TrimPrefix(line, "--- "))
+			cur.newName = parsePatchFileName(strings.TrimPrefix(strings.TrimRight(lines[i+1], "\r\n"), "+++ "))
+			i++
+		case strings.HasPrefix(line, "@@ "):
+			if cur == nil {
+				return nil, fmt.Errorf("hunk %v found before any file header", line)
+			}
+			inGitHeader = false
+			h, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, fmt.Errorf("malformed hunk #%d (%v) for %v: %v", len(cur.hunks)+1, line, cur.newName, err)
+			}
+			cur.hunks = append(cur.hunks, h)
+			i = next - 1
+		}
+	}
+	return patches, nil
+}
+
+// parseHunk parses the hunk whose header is at lines[start]. It returns the hunk and the index of the first line after
+// the hunk.
+func parseHunk(lines []string, start int) (hunk, int, error) {
+	header := strings.TrimRight(lines[start], "\r\n")
+	m := hunkHeaderRegexp.FindStringSubmatch(header)
+	if m == nil {
+		return hunk{}, 0, fmt.Errorf("can't parse hunk header")
+	}
+	h := hunk{header: m[0]}
+	h.oldStart, _ = strconv.Atoi(m[1])
+	oldCount, newCount := 1, 1
+	if m[2] != "" {
+		oldCount, _ = strconv.Atoi(m[2])
+	}
+	if m[4] != "" {
+		newCount, _ = strconv.Atoi(m[4])
+	}
+
+	i := start + 1
+	// lastOld and lastNew are set to whether the last line read belongs to the old and new side respectively, so that
+	// a "\ No newline at end of file" marker can be attributed correctly.
+	lastOld, lastNew := false, false
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, `\`) {
+			// "\ No newline at end of file": the previous line has no line terminator.
+			if lastOld {
+				h.oldLines[len(h.oldLines)-1] = strings.TrimRight(h.oldLines[len(h.oldLines)-1], "\r\n")
+			}
+			if lastNew {
+				h.newLines[len(h.newLines)-1] = strings.TrimRight(h.newLines[len(h.newLines)-1], "\r\n")
+			}
+			lastOld, lastNew = false, false
+			continue
+		}
+		if len(h.oldLines) == oldCount && len(h.newLines) == newCount {
+			break
+		}
+		if line == "\n" || line == "\r\n" {
+			// Some tools strip the trailing whitespace off empty context lines.
+			line = " " + line
+		}
+		switch line[0] {
+		case ' ':
+			h.oldLines = append(h.oldLines, line[1:])
+			h.newLines = append(h.newLines, line[1:])
+			lastOld, lastNew = true, true
+		case '-':
+			h.oldLines = append(h.oldLines, line[1:])
+			lastOld, lastNew = true, false
+		case '+':
+			h.newLines = append(h.newLines, line[1:])
+			lastOld, lastNew = false, true
+		default:
+			return hunk{}, 0, fmt.Errorf("unexpected line %q", strings.TrimRight(line, "\r\n"))
+		}
+		if len(h.oldLines) > oldCount || len(h.newLines) > newCount {
+			return hunk{}, 0, fmt.Errorf("hunk is longer than its header says")
+		}
+	}
+	if len(h.oldLines) != oldCount || len(h.newLines) != newCount {
+		return hunk{}, 0, fmt.Errorf("unexpected end of patch")
+	}
+	return h, i, nil
+}
+
+// parsePatchFileName extracts the file name from the rest of a "---" or "+++" line, which might carry a timestamp
+// separated by a tab.
+func parsePatchFileName(s string) string {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func parseGitMode(s string) os.FileMode {
+	mode, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(mode) & os.ModePerm
+}
+
+// stripPath strips the given number of leading components off the slash-separated path `p`.
+func stripPath(p string, strip int) (string, error) {
+	if p == devNull {
+		return p, nil
+	}
+	parts := strings.Split(p, "/")
+	if strip >= len(parts) {
+		return "", fmt.Errorf("can't strip %d components off path %v", strip, p)
+	}
+	return strings.Join(parts[strip:], "/"), nil
+}
+
+// resolvePatchPath turns a path mentioned in a patch into a path under `dir`, refusing paths that escape `dir`.
+func resolvePatchPath(dir string, p string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(p))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("patch refers to a path outside of the repo: %v", p)
+	}
+	return filepath.Join(dir, cleaned), nil
+}
+
+func (fp *filePatch) apply(dir string, strip int) error {
+	oldName, err := stripPath(fp.oldName, strip)
+	if err != nil {
+		return err
+	}
+	newName, err := stripPath(fp.newName, strip)
+	if err != nil {
+		return err
+	}
+	if fp.renameFrom != "" && fp.renameTo != "" {
+		oldName, newName = fp.renameFrom, fp.renameTo
+	}
+
+	switch {
+	case oldName == devNull && newName == devNull:
+		return fmt.Errorf("patch for %v has neither an old nor a new file", fp.newName)
+	case oldName == devNull:
+		// File creation.
+		newPath, err := resolvePatchPath(dir, newName)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(newPath); err == nil {
+			return fmt.Errorf("can't create %v: file already exists", newName)
+		}
+		result, err := fp.applyHunks(newName, nil)
+		if err != nil {
+			return err
+		}
+		mode := fp.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		return writePatchedFile(newPath, result, mode)
+	case newName == devNull:
+		// File deletion. Any hunks must still apply (and leave nothing behind), to make sure we're deleting what the
+		// patch thinks we're deleting.
+		oldPath, err := resolvePatchPath(dir, oldName)
+		if err != nil {
+			return err
+		}
+		lines, err := readLines(oldPath)
+		if err != nil {
+			return fmt.Errorf("can't delete %v: %v", oldName, err)
+		}
+		if len(fp.hunks) > 0 {
+			result, err := fp.applyHunks(oldName, lines)
+			if err != nil {
+				return err
+			}
+			if len(result) > 0 {
+				return fmt.Errorf("can't delete %v: file has contents the patch doesn't account for", oldName)
+			}
+		}
+		return os.Remove(oldPath)
+	}
+
+	oldPath, err := resolvePatchPath(dir, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := resolvePatchPath(dir, newName)
+	if err != nil {
+		return err
+	}
+	if fp.renameFrom == "" && oldPath != newPath {
+		// Plain diffs often name the original file something like "foo.orig"; go with whichever one actually exists.
+		if _, err := os.Lstat(oldPath); errors.Is(err, os.ErrNotExist) {
+			oldPath = newPath
+		} else {
+			newPath = oldPath
+		}
+	}
+	info, err := os.Lstat(oldPath)
+	if err != nil {
+		return fmt.Errorf("can't patch %v: %v", oldName, err)
+	}
+	lines, err := readLines(oldPath)
+	if err != nil {
+		return err
+	}
+	result, err := fp.applyHunks(oldName, lines)
+	if err != nil {
+		return err
+	}
+	mode := fp.mode
+	if mode == 0 {
+		mode = info.Mode() & os.ModePerm
+	}
+	if oldPath != newPath {
+		if _, err := os.Lstat(newPath); err == nil {
+			return fmt.Errorf("can't rename %v to %v: file already exists", oldName, newName)
+		}
+		if err := os.Remove(oldPath); err != nil {
+			return err
+		}
+	}
+	return writePatchedFile(newPath, result, mode)
+}
+
+// applyHunks applies all hunks of this filePatch to the given lines and returns the result. `name` is only used for
+// error messages.
+func (fp *filePatch) applyHunks(name string, lines []string) ([]string, error) {
+	result := make([]string, 0, len(lines))
+	// `pos` is the index into `lines` of the first line not yet copied into `result`. `offset` is how far away from
+	// the position stated in its header the last hunk was found, which is a good guess for the next one.
+	pos, offset := 0, 0
+	for i, h := range fp.hunks {
+		expected := h.oldStart - 1 + offset
+		if len(h.oldLines) == 0 {
+			// Pure insertions state the line *after* which to insert.
+			expected = h.oldStart + offset
+		}
+		at := findHunk(lines, h.oldLines, pos, expected)
+		if at < 0 {
+			return nil, fmt.Errorf("hunk #%d (%v) for %v failed to apply", i+1, h.header, name)
+		}
+		offset = at - (expected - offset)
+		result = append(result, lines[pos:at]...)
+		result = append(result, h.newLines...)
+		pos = at + len(h.oldLines)
+	}
+	return append(result, lines[pos:]...), nil
+}
+
+// findHunk finds where in `lines` the sequence `old` occurs, starting the search at `expected` and moving outwards,
+// never looking before `min`. Returns -1 if there's no such place.
+func findHunk(lines []string, old []string, min int, expected int) int {
+	if expected < min {
+		expected = min
+	}
+	if expected > len(lines) {
+		expected = len(lines)
+	}
+	for delta := 0; expected-delta >= min || expected+delta <= len(lines); delta++ {
+		if at := expected - delta; at >= min && matchesAt(lines, old, at) {
+			return at
+		}
+		if at := expected + delta; delta > 0 && at <= len(lines) && matchesAt(lines, old, at) {
+			return at
+		}
+	}
+	return -1
+}
+
+func matchesAt(lines []string, old []string, at int) bool {
+	if at+len(old) > len(lines) {
+		return false
+	}
+	for i, line := range old {
+		if lines[at+i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// readLines reads the file at `path` and splits it into lines, keeping the line terminators.
+func readLines(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for len(contents) > 0 {
+		i := bytes.IndexByte(contents, '\n')
+		if i < 0 {
+			i = len(contents) - 1
+		}
+		lines = append(lines, string(contents[:i+1]))
+		contents = contents[i+1:]
+	}
+	return lines, nil
+}
+
+func writePatchedFile(path string, lines []string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), mode); err != nil {
+		return err
+	}
+	// WriteFile doesn't touch the mode of existing files.
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,226 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func applyTestPatch(t *testing.T, dir string, patch string, strip int) error {
+	patchFile := filepath.Join(t.TempDir(), "test.patch")
+	testutil.WriteFile(t, patchFile, patch)
+	return applyPatches(dir, []Patch{{patchFile, strip}})
+}
+
+func TestPatch_Modify(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "a\nb\nc\nd\ne\nf\ng\nh\n")
+	// Hunk headers refer to line numbers in the original file, even after earlier hunks have added lines.
+	require.NoError(t, applyTestPatch(t, dir, `some commit message that should be ignored
+--- a/file	2021-01-01 00:00:00.000000000 +0000
++++ b/file	2021-01-01 00:00:00.000000000 +0000
+@@ -1,2 +1,4 @@
+ a
++a1
++a2
+ b
+@@ -6,1 +8,1 @@
+-f
++F
+@@ -7 +9 @@
+-g
++G
+`, 1))
+	testutil.AssertFileContents(t, filepath.Join(dir, "file"), "a\na1\na2\nb\nc\nd\ne\nF\nG\nh\n")
+}
+
+func TestPatch_Offset(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "x\ny\nz\na\nb\nc\n")
+	// The hunk claims to be at line 1, but the file has since gained 3 extra lines at the top.
+	require.NoError(t, applyTestPatch(t, dir, `--- file
++++ file
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+`, 0))
+	testutil.AssertFileContents(t, filepath.Join(dir, "file"), "x\ny\nz\na\nB\nc\n")
+}
+
+func TestPatch_Strip(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "sub", "file"), "a\n")
+	require.NoError(t, applyTestPatch(t, dir, `--- x/y/sub/file
++++ x/y/sub/file
+@@ -1 +1 @@
+-a
++b
+`, 2))
+	testutil.AssertFileContents(t, filepath.Join(dir, "sub", "file"), "b\n")
+
+	// Stripping more components than there are is an error.
+	assert.Error(t, applyTestPatch(t, dir, `--- file
++++ file
+@@ -1 +1 @@
+-b
++c
+`, 1))
+}
+
+func TestPatch_NoNewlineAtEndOfFile(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "a\nb")
+	require.NoError(t, applyTestPatch(t, dir, `--- a/file
++++ b/file
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`, 1))
+	testutil.AssertFileContents(t, filepath.Join(dir, "file"), "a\nb\n")
+
+	require.NoError(t, applyTestPatch(t, dir, `--- a/file
++++ b/file
+@@ -1,2 +1,2 @@
+ a
+-b
++c
+\ No newline at end of file
+`, 1))
+	testutil.AssertFileContents(t, filepath.Join(dir, "file"), "a\nc")
+}
+
+func TestPatch_GitCreateDeleteRename(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "doomed"), "bye\n")
+	testutil.WriteFile(t, filepath.Join(dir, "old", "name"), "1\n2\n3\n")
+	testutil.WriteFile(t, filepath.Join(dir, "unchanged"), "same\n")
+	require.NoError(t, applyTestPatch(t, dir, `From 1234567 Mon Sep 17 00:00:00 2001
+Subject: [PATCH] do all the things
+
+diff --git a/new/script.sh b/new/script.sh
+new file mode 100755
+index 0000000..1111111
+--- /dev/null
++++ b/new/script.sh
+@@ -0,0 +1,2 @@
++#!/bin/sh
++echo hi
+diff --git a/doomed b/doomed
+deleted file mode 100644
+index 2222222..0000000
+--- a/doomed
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+diff --git a/old/name b/new/name
+similarity index 80%
+rename from old/name
+rename to new/name
+index 3333333..4444444 100644
+--- a/old/name
++++ b/new/name
+@@ -1,3 +1,3 @@
+ 1
+-2
++two
+ 3
+diff --git a/empty b/empty
+new file mode 100644
+index 0000000..e69de29
+`, 1))
+
+	testutil.AssertFileContents(t, filepath.Join(dir, "new", "script.sh"), "#!/bin/sh\necho hi\n")
+	info, err := os.Stat(filepath.Join(dir, "new", "script.sh"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	}
+	_, err = os.Stat(filepath.Join(dir, "doomed"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "old", "name"))
+	assert.True(t, os.IsNotExist(err))
+	testutil.AssertFileContents(t, filepath.Join(dir, "new", "name"), "1\ntwo\n3\n")
+	testutil.AssertFileContents(t, filepath.Join(dir, "empty"), "")
+	testutil.AssertFileContents(t, filepath.Join(dir, "unchanged"), "same\n")
+}
+
+func TestPatch_HunkFails(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "file"), "a\nb\nc\n")
+	err := applyTestPatch(t, dir, `--- a/file
++++ b/file
+@@ -1 +1 @@
+-a
++A
+@@ -3 +3 @@
+-not c
++C
+`, 1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "hunk #2 (@@ -3 +3 @@) for file failed to apply")
+	}
+}
+
+func TestPatch_OutsideOfRepo(t *testing.T) {
+	dir := t.TempDir()
+	err := applyTestPatch(t, dir, `--- /dev/null
++++ b/../evil
+@@ -0,0 +1 @@
++boo
+`, 1)
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dir), "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchive_Patches(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+
+	zipArchive := testutil.BuildZipArchive(t, map[string][]byte{
+		"file1":     []byte("file1contents\n"),
+		"dir/file2": []byte("file2contents\n"),
+	})
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/a.zip": zipArchive,
+		"/patches/1.patch": []byte(`--- a/file1
++++ b/file1
+@@ -1 +1 @@
+-file1contents
++file1patched
+`),
+		"/patches/2.patch": []byte(`--- dir/file2
++++ dir/file2
+@@ -1 +1,2 @@
+ file2contents
++more file2contents
+`),
+	})
+	defer server.Close()
+
+	a := Archive{
+		URLs:      []string{server.URL + "/a.zip"},
+		Integrity: integrity.MustGenerate("sha256", zipArchive),
+		Patches: []Patch{
+			{server.URL + "/patches/1.patch", 1},
+			{server.URL + "/patches/2.patch", 0},
+		},
+		Fprint: "some_fingerprint",
+	}
+
+	fp, err := a.Fetch("")
+	require.NoError(t, err)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file1"), "file1patched\n")
+	testutil.AssertFileContents(t, filepath.Join(fp, "dir", "file2"), "file2contents\nmore file2contents\n")
+	// The patch files should have gone through the HTTP cache.
+	_, err = os.Stat(filepath.Join(TestBzlmodDir, "http_cache", common.Hash(server.URL+"/patches/1.patch")))
+	assert.NoError(t, err)
+}
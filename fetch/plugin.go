@@ -0,0 +1,170 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	integrities "github.com/bazelbuild/bzlmod/common/integrity"
+	urls "net/url"
+	"os"
+	"os/exec"
+)
+
+// pluginPrefix is the prefix of the names of plugin executables; the rest of the name is the URL scheme they handle.
+const pluginPrefix = "bzlmod-fetcher-"
+
+// Plugin represents contents fetched by an external executable, for URL schemes that bzlmod doesn't support itself.
+// The executable is named "bzlmod-fetcher-<scheme>" and is looked up on the PATH. Like a Git remote helper, it's run
+// with the argument "fetch", is given a JSON request on stdin, and writes a JSON result to stdout:
+//
+//	request: {"url": "...", "integrity": "...", "strip_prefix": "...", "dest_dir": "...", "vendor": false, "offline": false}
+//	result:  {"integrity": "..."}
+//
+// The plugin must place the contents (with the strip prefix already stripped) into dest_dir, which exists and is
+// empty; "vendor" tells whether that's a vendor dir rather than a directory in the bzlmod cache, and "offline" whether
+// the network must not be accessed. If the request has an integrity, the result must report the integrity of what was
+// fetched, which then has to match. Patches are applied by bzlmod afterwards. A failed fetch is signaled with a
+// non-zero exit code, and an error message on stderr.
+type Plugin struct {
+	URL         string
+	Integrity   string
+	StripPrefix string
+	Patches     []Patch
+
+	// Fprint is used as the name of the shared repo directory, like Archive.Fprint.
+	Fprint string
+}
+
+func init() {
+	RegisterType("plugin", func() Fetcher { return &Plugin{} })
+}
+
+// IsPluginURL reports whether the given URL has a scheme that bzlmod doesn't support itself, and which is therefore
+// handled by a plugin.
+func IsPluginURL(rawurl string) bool {
+	u, err := urls.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "", "http", "https", "file":
+		return false
+	}
+	// A single letter is a Windows drive letter rather than a scheme.
+	return len(u.Scheme) > 1
+}
+
+func (p *Plugin) Fetch(vendorDir string) (string, error) {
+	return fetchWithSharedRepoDir(p.Fprint, vendorDir, func(destDir string) error {
+		return p.fetchAndPatch(destDir, vendorDir != "" && destDir == vendorDir)
+	})
+}
+
+func (p *Plugin) fetchFresh(destDir string) error {
+	// The directory isn't in the bzlmod cache, so the plugin should treat it like a vendor dir.
+	return p.fetchAndPatch(destDir, true)
+}
+
+func (p *Plugin) Fingerprint() string {
+	return p.Fprint
+}
+
+func (p *Plugin) AppendPatches(patches []Patch) error {
+	p.Patches = append(p.Patches, patches...)
+	return nil
+}
+
+func (p *Plugin) CacheEntries() ([]string, error) {
+	patches, err := patchCacheEntries(p.Patches)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedRepoCacheEntries(p.Fprint)
+	if err != nil {
+		return nil, err
+	}
+	return append(patches, shared...), nil
+}
+
+type pluginRequest struct {
+	URL         string `json:"url"`
+	Integrity   string `json:"integrity"`
+	StripPrefix string `json:"strip_prefix"`
+	DestDir     string `json:"dest_dir"`
+	Vendor      bool   `json:"vendor"`
+	Offline     bool   `json:"offline"`
+}
+
+type pluginResult struct {
+	Integrity string `json:"integrity"`
+}
+
+func (p *Plugin) fetchAndPatch(destDir string, vendor bool) error {
+	u, err := urls.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	plugin, err := exec.LookPath(pluginPrefix + u.Scheme)
+	if err != nil {
+		return fmt.Errorf("no fetcher plugin for URL scheme %q: %v", u.Scheme, err)
+	}
+	if err := os.RemoveAll(destDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return fmt.Errorf("can't create directory %v: %v", destDir, err)
+	}
+
+	request, err := json.Marshal(pluginRequest{
+		URL:         p.URL,
+		Integrity:   p.Integrity,
+		StripPrefix: p.StripPrefix,
+		DestDir:     destDir,
+		Vendor:      vendor,
+		Offline:     httpclient.Offline,
+	})
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(plugin, "fetch")
+	cmd.Stdin = bytes.NewReader(request)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("fetcher plugin %v failed for %v: %v: %s", plugin, p.URL, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var result pluginResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return fmt.Errorf("fetcher plugin %v returned malformed output for %v: %v", plugin, p.URL, err)
+	}
+	if err := p.checkIntegrity(result.Integrity); err != nil {
+		return fmt.Errorf("fetcher plugin %v: %v", plugin, err)
+	}
+	return applyPatches(destDir, p.Patches)
+}
+
+// checkIntegrity makes sure that the integrity reported by the plugin matches the expected one, by having at least one
+// digest in common.
+func (p *Plugin) checkIntegrity(actual string) error {
+	if p.Integrity == "" {
+		return nil
+	}
+	expected, err := integrities.ParseDigests(p.Integrity)
+	if err != nil {
+		return err
+	}
+	reported, err := integrities.ParseDigests(actual)
+	if err != nil {
+		return fmt.Errorf("invalid integrity %q reported for %v: %v", actual, p.URL, err)
+	}
+	for _, e := range expected {
+		for _, r := range reported {
+			if e.Algorithm == r.Algorithm && bytes.Equal(e.Value, r.Value) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%v failed integrity check: expected %v, got %q", p.URL, p.Integrity, actual)
+}
@@ -0,0 +1,135 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// installPlugin puts a plugin with the given shell script as its body on the PATH, and returns the file that the
+// plugin's request is saved to (next to the plugin). The script can refer to the destination dir as $dest.
+func installPlugin(t *testing.T, scheme string, script string) (string, func()) {
+	binDir := t.TempDir()
+	requestFile := filepath.Join(binDir, "request.json")
+	testutil.WriteFile(t, filepath.Join(binDir, pluginPrefix+scheme), `#!/bin/sh
+[ "$1" = fetch ] || exit 2
+cat > `+requestFile+`
+dest=$(sed -n 's/.*"dest_dir":"\([^"]*\)".*/\1/p' `+requestFile+`)
+`+script)
+	require.NoError(t, os.Chmod(filepath.Join(binDir, pluginPrefix+scheme), 0755))
+	oldPath := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", binDir+string(os.PathListSeparator)+oldPath))
+	return requestFile, func() { _ = os.Setenv("PATH", oldPath) }
+}
+
+func TestIsPluginURL(t *testing.T) {
+	for url, expected := range map[string]bool{
+		"corp://artifacts/a/1.0":    true,
+		"s3://bucket/a.zip":         true,
+		"https://example.com/a.zip": false,
+		"http://example.com/a.zip":  false,
+		"file:///tmp/a.zip":         false,
+		"/tmp/a.zip":                false,
+		"C:/tmp/a.zip":              false,
+	} {
+		assert.Equal(t, expected, IsPluginURL(url), url)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	requestFile, cleanup := installPlugin(t, "corp", `
+printf 'a\nb\n' > "$dest/file"
+echo '{"integrity": "`+integrity.MustGenerate("sha256", []byte("artifact"))+`"}'
+`)
+	defer cleanup()
+	patchFile := filepath.Join(tempDir, "test.patch")
+	testutil.WriteFile(t, patchFile, `--- a/file
++++ b/file
+@@ -1,2 +1,2 @@
+ a
+-b
++B
+`)
+
+	p := &Plugin{
+		URL:       "corp://artifacts/a/1.0",
+		Integrity: integrity.MustGenerate("sha384", []byte("artifact")) + " " + integrity.MustGenerate("sha256", []byte("artifact")),
+		Patches:   []Patch{{patchFile, 1}},
+		Fprint:    "some_fingerprint",
+	}
+	fp, err := p.Fetch("")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", "some_fingerprint"), fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "a\nB\n")
+	testutil.AssertFileContents(t, filepath.Join(fp, "bzlmod.fingerprint"), "some_fingerprint")
+
+	request, err := ioutil.ReadFile(requestFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(request), `"url":"corp://artifacts/a/1.0"`)
+	assert.Contains(t, string(request), `"vendor":false`)
+
+	// In vendoring mode, the shared repo dir is copied instead of asking the plugin again.
+	require.NoError(t, os.Remove(requestFile))
+	vendorDir := filepath.Join(tempDir, "vendor")
+	fp, err = p.Fetch(vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, vendorDir, fp)
+	testutil.AssertFileContents(t, filepath.Join(fp, "file"), "a\nB\n")
+	_, err = os.Stat(requestFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// Without a shared repo dir, the plugin fetches straight into the vendor dir.
+	require.NoError(t, os.RemoveAll(TestBzlmodDir))
+	require.NoError(t, os.RemoveAll(vendorDir))
+	fp, err = p.Fetch(vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, vendorDir, fp)
+	request, err = ioutil.ReadFile(requestFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(request), `"vendor":true`)
+}
+
+func TestPlugin_Errors(t *testing.T) {
+	TestBzlmodDir = t.TempDir()
+	defer func() { TestBzlmodDir = "" }()
+	_, cleanup := installPlugin(t, "corp", `
+case "$(cat "$(dirname "$0")/request.json")" in
+  *fail*) echo "no such artifact" >&2; exit 1;;
+  *garbage*) echo "garbage";;
+  *) echo '{"integrity": "`+integrity.MustGenerate("sha256", []byte("other"))+`"}';;
+esac
+`)
+	defer cleanup()
+
+	_, err := (&Plugin{URL: "corp://fail", Fprint: "fail"}).Fetch("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed for corp://fail: exit status 1: no such artifact")
+	}
+	_, err = (&Plugin{URL: "corp://garbage", Fprint: "garbage"}).Fetch("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "returned malformed output for corp://garbage")
+	}
+	_, err = (&Plugin{
+		URL:       "corp://mismatch",
+		Integrity: integrity.MustGenerate("sha256", []byte("artifact")),
+		Fprint:    "mismatch",
+	}).Fetch("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "corp://mismatch failed integrity check")
+	}
+	_, err = (&Plugin{URL: "nope://thing", Fprint: "nope"}).Fetch("")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `no fetcher plugin for URL scheme "nope"`)
+	}
+	// Nothing is left behind in the shared repo dir.
+	_, err = os.Stat(filepath.Join(TestBzlmodDir, "shared_repos", "fail"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,89 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// TreeHash computes a deterministic hash over the contents of the fetched repo in `dir`: the path, type and
+// executable bit of every regular file and symlink, the contents of every file, and the target of every symlink. The
+// fingerprint file is left out, and so are directories (like Git, we only care about what's in them), as well as all
+// other permission bits, which depend on the umask of whoever extracted the repo. The result is in the same format as
+// an integrity value ("sha256-<base64>").
+func TreeHash(dir string) (string, error) {
+	return hashTree(dir, false, func(relpath string) bool { return relpath == "bzlmod.fingerprint" })
+}
+
+// hashTree implements TreeHash, skipping the entries (given as slash-separated paths relative to `dir`) for which
+// `skip` returns true; a skipped directory is skipped with everything in it. If `metadataOnly` is set, the sizes and
+// modification times of files are hashed instead of their contents, which is much faster but less precise.
+func hashTree(dir string, metadataOnly bool, skip func(relpath string) bool) (string, error) {
+	h := sha256.New()
+	// filepath.Walk visits entries in lexical order, which makes the hash independent of the order on disk.
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		relpath = filepath.ToSlash(relpath)
+		if relpath != "." && skip(relpath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		mode := info.Mode()
+		switch {
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(h, "symlink %q %q\n", relpath, filepath.ToSlash(target))
+		case mode.IsRegular():
+			kind := "file"
+			if mode&0111 != 0 {
+				kind = "executable"
+			}
+			if metadataOnly {
+				_, _ = fmt.Fprintf(h, "%v %q %v %v\n", kind, relpath, info.Size(), info.ModTime().UnixNano())
+				return nil
+			}
+			contentHash, err := fileHash(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(h, "%v %q %x\n", kind, relpath, contentHash)
+		default:
+			return fmt.Errorf("%v: unsupported file type %v", relpath, mode&os.ModeType)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error hashing %v: %v", dir, err)
+	}
+	return "sha256-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,109 @@
+package fetch
+
+import (
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, dir string) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aaa"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b"), []byte("bbb"), 0755))
+	require.NoError(t, os.Symlink("sub/b", filepath.Join(dir, "link")))
+}
+
+func TestTreeHash(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir)
+	hash, err := TreeHash(dir)
+	require.NoError(t, err)
+	assert.Regexp(t, `^sha256-[A-Za-z0-9+/]{43}=$`, hash)
+
+	t.Run("deterministic", func(t *testing.T) {
+		other := t.TempDir()
+		writeTree(t, other)
+		// The fingerprint file, directories and non-executable permission bits don't matter.
+		require.NoError(t, writeFingerprintFile(other, "fprint"))
+		require.NoError(t, os.Mkdir(filepath.Join(other, "empty"), 0755))
+		require.NoError(t, os.Chmod(filepath.Join(other, "a"), 0600))
+		otherHash, err := TreeHash(other)
+		require.NoError(t, err)
+		assert.Equal(t, hash, otherHash)
+	})
+
+	changes := map[string]func(dir string) error{
+		"contents": func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "a"), []byte("aab"), 0644)
+		},
+		"executable bit": func(dir string) error {
+			return os.Chmod(filepath.Join(dir, "a"), 0755)
+		},
+		"renamed": func(dir string) error {
+			return os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "c"))
+		},
+		"added": func(dir string) error {
+			return ioutil.WriteFile(filepath.Join(dir, "sub", "c"), nil, 0644)
+		},
+		"removed": func(dir string) error {
+			return os.Remove(filepath.Join(dir, "sub", "b"))
+		},
+		"symlink target": func(dir string) error {
+			if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+				return err
+			}
+			return os.Symlink("a", filepath.Join(dir, "link"))
+		},
+		"symlink replaced by file": func(dir string) error {
+			if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, "link"), []byte("bbb"), 0755)
+		},
+	}
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			other := t.TempDir()
+			writeTree(t, other)
+			require.NoError(t, change(other))
+			otherHash, err := TreeHash(other)
+			require.NoError(t, err)
+			assert.NotEqual(t, hash, otherHash)
+		})
+	}
+}
+
+func TestFetchedDir(t *testing.T) {
+	tempDir := t.TempDir()
+	TestBzlmodDir = filepath.Join(tempDir, "bzlmod")
+	defer func() { TestBzlmodDir = "" }()
+	vendorDir := filepath.Join(tempDir, "vendor")
+
+	dir, err := FetchedDir("fprint", "")
+	require.NoError(t, err)
+	assert.Equal(t, "", dir)
+
+	testutil.WriteFile(t, filepath.Join(TestBzlmodDir, "shared_repos", "fprint", "bzlmod.fingerprint"), "fprint")
+	dir, err = FetchedDir("fprint", "")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(TestBzlmodDir, "shared_repos", "fprint"), dir)
+
+	// In vendoring mode, only the vendor dir counts.
+	dir, err = FetchedDir("fprint", vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, "", dir)
+
+	testutil.WriteFile(t, filepath.Join(vendorDir, "bzlmod.fingerprint"), "other_fprint")
+	dir, err = FetchedDir("fprint", vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, "", dir)
+
+	testutil.WriteFile(t, filepath.Join(vendorDir, "bzlmod.fingerprint"), "fprint")
+	dir, err = FetchedDir("fprint", vendorDir)
+	require.NoError(t, err)
+	assert.Equal(t, vendorDir, dir)
+}
@@ -3,10 +3,13 @@ module github.com/bazelbuild/bzlmod
 go 1.15
 
 require (
+	github.com/gofrs/flock v0.8.1
 	github.com/hashicorp/go-version v1.2.1
+	github.com/klauspost/compress v1.13.6
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.3.0
+	github.com/ulikunitz/xz v0.5.10
 	go.starlark.net v0.0.0-20201014215153-dff0ae5b4820
 )
@@ -1,11 +1,22 @@
 package lockfile
 
-import "github.com/bazelbuild/bzlmod/fetch"
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/gofrs/flock"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
 
 const FileName = "bzlmod.lock"
 
 type Repo struct {
 	Fetcher fetch.Wrapper
+	// TreeHash is the fetch.TreeHash of the repo's contents, recorded by the first fetch. It's empty until then, and
+	// for repos whose contents aren't managed by bzlmod (such as unpatched local paths).
+	TreeHash string `json:",omitempty"`
 }
 
 type Workspace struct {
@@ -16,3 +27,65 @@ type Workspace struct {
 func NewWorkspace() *Workspace {
 	return &Workspace{Repos: make(map[string]*Repo)}
 }
+
+// Load reads the lockfile at the given path.
+func Load(path string) (*Workspace, error) {
+	p, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ws := NewWorkspace()
+	if err := json.Unmarshal(p, ws); err != nil {
+		return nil, fmt.Errorf("error parsing lockfile %v: %v", path, err)
+	}
+	for name, repo := range ws.Repos {
+		if repo == nil || repo.Fetcher.Unwrap() == nil {
+			return nil, fmt.Errorf("error parsing lockfile %v: repo %v has no fetcher", path, name)
+		}
+	}
+	return ws, nil
+}
+
+// Save writes the lockfile to the given path. The file is replaced atomically, so that concurrent readers never see
+// a partially written lockfile.
+func (ws *Workspace) Save(path string) error {
+	p, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(p); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Update applies `update` to the lockfile at the given path and saves the result. Other updates (from concurrent
+// fetches, say) are locked out from before the lockfile is read until it's saved, so that none of them are lost. The
+// lock is held through a separate "<path>.lock" file, as Save replaces the lockfile itself.
+func Update(path string, update func(ws *Workspace) error) error {
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("can't lock %v: %v", path, err)
+	}
+	defer func() { _ = lock.Unlock() }()
+	ws, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := update(ws); err != nil {
+		return err
+	}
+	return ws.Save(path)
+}
@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files grabbed from HTTP registries are cached, so that they're still available in offline mode. Outside of offline
+// mode the cache is only ever written to, since the contents of a registry can change.
+
+// notFoundSuffix marks a cache entry recording that the file doesn't exist in the registry. This matters when there are
+// multiple registries, as we need to know to skip to the next one.
+const notFoundSuffix = ".notfound"
+
+func registryCachePath(url string) (string, error) {
+	bzlmodDir, err := fetch.BzlmodDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(bzlmodDir, "registry_cache", common.Hash(url)), nil
+}
+
+// grabCachedURL grabs the file at the given URL, or from the cache in offline mode.
+func grabCachedURL(url string) ([]byte, error) {
+	fp, err := registryCachePath(url)
+	if err != nil {
+		return nil, err
+	}
+	if httpclient.Offline {
+		if _, err := os.Stat(fp + notFoundSuffix); err == nil {
+			return nil, ErrNotFound
+		}
+		p, err := ioutil.ReadFile(fp)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v isn't in the registry cache", httpclient.ErrOffline, url)
+		}
+		// Mark the entry as recently used, so that it's not the first to go when the cache is cleaned.
+		now := time.Now()
+		_ = os.Chtimes(fp, now, now)
+		return p, nil
+	}
+
+	p, err := grabURL(url)
+	if errors.Is(err, ErrNotFound) {
+		_ = writeCacheEntry(fp+notFoundSuffix, nil)
+		_ = os.Remove(fp)
+	} else if err == nil {
+		// Failing to cache the file shouldn't fail the operation.
+		_ = writeCacheEntry(fp, p)
+		_ = os.Remove(fp + notFoundSuffix)
+	}
+	return p, err
+}
+
+func grabURL(url string) ([]byte, error) {
+	resp, err := httpclient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't GET %v: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("couldn't GET %v: got %v", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// writeCacheEntry atomically replaces the cache entry at `fp` with the given contents.
+func writeCacheEntry(fp string, p []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fp), ".tmp-"+filepath.Base(fp)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fp)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
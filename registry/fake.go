@@ -5,6 +5,7 @@ import (
 	"github.com/bazelbuild/bzlmod/common"
 	"github.com/bazelbuild/bzlmod/fetch"
 	urls "net/url"
+	"sort"
 	"testing"
 )
 
@@ -16,12 +17,13 @@ type moduleBazelAndFetcher struct {
 type Fake struct {
 	name        string
 	moduleBazel map[common.ModuleKey]moduleBazelAndFetcher
+	metadata    map[string]*ModuleMetadata
 }
 
 var fakes = make(map[string]*Fake)
 
 func NewFake(name string) *Fake {
-	fake := &Fake{name, make(map[common.ModuleKey]moduleBazelAndFetcher)}
+	fake := &Fake{name, make(map[common.ModuleKey]moduleBazelAndFetcher), make(map[string]*ModuleMetadata)}
 	fakes[name] = fake
 	return fake
 }
@@ -39,6 +41,20 @@ func (f *Fake) AddModule(t *testing.T, name string, version string, moduleBazel
 		moduleBazel: []byte(moduleBazel),
 		fetcher:     fetcher,
 	}
+	metadata := f.metadata[name]
+	if metadata == nil {
+		metadata = &ModuleMetadata{YankedVersions: make(map[string]string)}
+		f.metadata[name] = metadata
+	}
+	metadata.Versions = append(metadata.Versions, version)
+}
+
+// YankVersion marks a version of a module that was already added as yanked, for the given reason.
+func (f *Fake) YankVersion(t *testing.T, name string, version string, reason string) {
+	if _, exists := f.moduleBazel[common.ModuleKey{name, version}]; !exists {
+		t.Fatalf("no entry exists for %v@%v", name, version)
+	}
+	f.metadata[name].YankedVersions[version] = reason
 }
 
 func (f *Fake) GetModuleBazel(key common.ModuleKey) ([]byte, error) {
@@ -57,6 +73,31 @@ func (f *Fake) GetFetcher(key common.ModuleKey) (fetch.Fetcher, error) {
 	return module.fetcher, nil
 }
 
+func (f *Fake) GetModuleMetadata(name string) (*ModuleMetadata, error) {
+	metadata, ok := f.metadata[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, name)
+	}
+	// Return a copy, so that callers can't modify the fake.
+	result := &ModuleMetadata{
+		Versions:       append([]string(nil), metadata.Versions...),
+		YankedVersions: make(map[string]string),
+	}
+	for version, reason := range metadata.YankedVersions {
+		result.YankedVersions[version] = reason
+	}
+	return result, nil
+}
+
+func (f *Fake) ListModules() ([]string, error) {
+	var names []string
+	for name := range f.metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func fakeScheme(url *urls.URL) (Registry, error) {
 	fake := fakes[url.Opaque]
 	if fake == nil {
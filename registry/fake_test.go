@@ -10,9 +10,9 @@ import (
 
 func TestFake(t *testing.T) {
 	fake := NewFake("fake")
-	fake.AddModule(t, "A", "1.0", "foo", &fetch.LocalPath{"A/1.0"})
-	fake.AddModule(t, "A", "2.0", "bar", &fetch.LocalPath{"A/2.0"})
-	fake.AddModule(t, "B", "1.0", "baz", &fetch.LocalPath{"B/1.0"})
+	fake.AddModule(t, "A", "1.0", "foo", &fetch.LocalPath{Path: "A/1.0"})
+	fake.AddModule(t, "A", "2.0", "bar", &fetch.LocalPath{Path: "A/2.0"})
+	fake.AddModule(t, "B", "1.0", "baz", &fetch.LocalPath{Path: "B/1.0"})
 
 	bytes, err := fake.GetModuleBazel(common.ModuleKey{"A", "1.0"})
 	if assert.NoError(t, err) {
@@ -20,7 +20,7 @@ func TestFake(t *testing.T) {
 	}
 	fetcher, err := fake.GetFetcher(common.ModuleKey{"A", "1.0"})
 	if assert.NoError(t, err) {
-		assert.Equal(t, &fetch.LocalPath{"A/1.0"}, fetcher)
+		assert.Equal(t, &fetch.LocalPath{Path: "A/1.0"}, fetcher)
 	}
 
 	bytes, err = fake.GetModuleBazel(common.ModuleKey{"A", "2.0"})
@@ -29,7 +29,7 @@ func TestFake(t *testing.T) {
 	}
 	fetcher, err = fake.GetFetcher(common.ModuleKey{"A", "2.0"})
 	if assert.NoError(t, err) {
-		assert.Equal(t, &fetch.LocalPath{"A/2.0"}, fetcher)
+		assert.Equal(t, &fetch.LocalPath{Path: "A/2.0"}, fetcher)
 	}
 
 	bytes, err = fake.GetModuleBazel(common.ModuleKey{"B", "1.0"})
@@ -38,7 +38,7 @@ func TestFake(t *testing.T) {
 	}
 	fetcher, err = fake.GetFetcher(common.ModuleKey{"B", "1.0"})
 	if assert.NoError(t, err) {
-		assert.Equal(t, &fetch.LocalPath{"B/1.0"}, fetcher)
+		assert.Equal(t, &fetch.LocalPath{Path: "B/1.0"}, fetcher)
 	}
 
 	bytes, err = fake.GetModuleBazel(common.ModuleKey{"B", "2.0"})
@@ -48,3 +48,27 @@ func TestFake(t *testing.T) {
 		assert.True(t, errors.Is(err, ErrNotFound))
 	}
 }
+
+func TestFake_Metadata(t *testing.T) {
+	fake := NewFake("fake")
+	fake.AddModule(t, "B", "1.0", "", nil)
+	fake.AddModule(t, "A", "1.0", "", nil)
+	fake.AddModule(t, "A", "2.0", "", nil)
+	fake.YankVersion(t, "A", "2.0", "broken")
+
+	metadata, err := fake.GetModuleMetadata("A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ModuleMetadata{
+			Versions:       []string{"1.0", "2.0"},
+			YankedVersions: map[string]string{"2.0": "broken"},
+		}, metadata)
+		assert.Equal(t, "1.0", metadata.LatestVersion())
+	}
+	_, err = fake.GetModuleMetadata("C")
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	names, err := fake.ListModules()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"A", "B"}, names)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/bazelbuild/bzlmod/common"
 	"github.com/bazelbuild/bzlmod/fetch"
 	"io/ioutil"
-	"net/http"
 	urls "net/url"
 	"os"
 	"path"
@@ -39,18 +38,7 @@ func (i *Index) grabFile(relPath string) ([]byte, error) {
 	case "http", "https":
 		url := *i.url
 		url.Path = path.Join(url.Path, relPath)
-		resp, err := http.Get(url.String())
-		if err != nil {
-			return nil, fmt.Errorf("couldn't GET %v: %v", url.String(), err)
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusNotFound {
-			return nil, ErrNotFound
-		}
-		if resp.StatusCode >= 300 {
-			return nil, fmt.Errorf("couldn't GET %v: got %v", url.String(), resp.Status)
-		}
-		return ioutil.ReadAll(resp.Body)
+		return grabCachedURL(url.String())
 	default:
 		return nil, fmt.Errorf("unrecognized scheme: %v", i.url.Scheme)
 	}
@@ -62,7 +50,7 @@ func (i *Index) GetModuleBazel(key common.ModuleKey) ([]byte, error) {
 		return nil, fmt.Errorf("%w: %v", ErrNotFound, key)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("error getting MODULE.bazel file for %v: %v", key, err)
+		return nil, fmt.Errorf("error getting MODULE.bazel file for %v: %w", key, err)
 	}
 	return p, nil
 }
@@ -75,6 +63,37 @@ func (i *Index) readAndParseJSON(relPath string, v interface{}) error {
 	return json.Unmarshal(p, v)
 }
 
+func (i *Index) GetModuleMetadata(name string) (*ModuleMetadata, error) {
+	metadata := &ModuleMetadata{}
+	err := i.readAndParseJSON(path.Join("modules", name, "metadata.json"), metadata)
+	if errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata.json file for %v from registry %v: %w", name, i.URL(), err)
+	}
+	return metadata, nil
+}
+
+func (i *Index) ListModules() ([]string, error) {
+	if i.url.Scheme != "file" {
+		// HTTP servers don't generally allow listing directories.
+		return nil, fmt.Errorf("%w: %v", ErrListingNotSupported, i.URL())
+	}
+	modulesDir := filepath.Join(filepath.FromSlash(i.url.Path), "modules")
+	infos, err := ioutil.ReadDir(modulesDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing modules of registry %v: %v", i.URL(), err)
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
 type bazelRegistryJSON struct {
 	Mirrors []string `json:"mirrors"`
 }
@@ -82,51 +101,83 @@ type bazelRegistryJSON struct {
 type sourceJSON struct {
 	URL         string   `json:"url"`
 	Integrity   string   `json:"integrity"`
-	StripPrefix string   `json:"strip_prefix"`
-	PatchFiles  []string `json:"patch_files"`
-	PatchStrip  int      `json:"patch_strip"`
+	StripPrefix string   `json:"strip_prefix,omitempty"`
+	PatchFiles  []string `json:"patch_files,omitempty"`
+	PatchStrip  int      `json:"patch_strip,omitempty"`
+	// Type is either the type of the archive, or "file" for a single file that isn't extracted.
+	Type string `json:"type,omitempty"`
+	// FileName and Executable only apply to single files.
+	FileName   string `json:"file_name,omitempty"`
+	Executable bool   `json:"executable,omitempty"`
 }
 
 func (i *Index) GetFetcher(key common.ModuleKey) (fetch.Fetcher, error) {
 	bazelRegistryJSON := bazelRegistryJSON{}
 	if err := i.readAndParseJSON("bazel_registry.json", &bazelRegistryJSON); err != nil {
-		return nil, fmt.Errorf("error reading bazel_registry.json of registry %v: %v", i.URL(), err)
+		return nil, fmt.Errorf("error reading bazel_registry.json of registry %v: %w", i.URL(), err)
 	}
 	sourceJSON := sourceJSON{}
 	if err := i.readAndParseJSON(path.Join("modules", key.Name, key.Version, "source.json"), &sourceJSON); err != nil {
-		return nil, fmt.Errorf("error reading source.json file for %v from registry %v: %v", key, i.URL(), err)
+		return nil, fmt.Errorf("error reading source.json file for %v from registry %v: %w", key, i.URL(), err)
 	}
 	sourceURL, err := urls.Parse(sourceJSON.URL)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing URL of %v from registry %v: %v", key, i.URL(), err)
 	}
-	fetcher := &fetch.Archive{
-		// We use the module's name, version, and origin registry as the fingerprint. We don't use things such as
-		// mirrors in the fingerprint since, for example, adding a mirror should not invalidate an existing download.
-		Fprint: common.Hash("regModule", key.Name, key.Version, i.URL()),
+	// We use the module's name, version, and origin registry as the fingerprint. We don't use things such as mirrors in
+	// the fingerprint since, for example, adding a mirror should not invalidate an existing download.
+	fprint := common.Hash("regModule", key.Name, key.Version, i.URL())
+	patches := i.patches(key, sourceJSON)
+	if fetch.IsPluginURL(sourceJSON.URL) {
+		// Mirrors don't apply, as they're HTTP servers.
+		return &fetch.Plugin{
+			URL:         sourceJSON.URL,
+			Integrity:   sourceJSON.Integrity,
+			StripPrefix: sourceJSON.StripPrefix,
+			Patches:     patches,
+			Fprint:      fprint,
+		}, nil
+	}
+	mirrors := append(append([]string(nil), UserMirrors...), bazelRegistryJSON.Mirrors...)
+	sourceURLs, err := mirrorURLs(mirrors, sourceURL, key, sourceJSON.Integrity)
+	if err != nil {
+		return nil, fmt.Errorf("error computing mirror URLs of %v from registry %v: %v", key, i.URL(), err)
 	}
-	for _, mirror := range bazelRegistryJSON.Mirrors {
-		// TODO: support more sophisticated mirror formats?
-		mirrorURL, err := urls.Parse(mirror)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing mirror URL %v from registry %v: %v", mirror, i.URL(), err)
+	sourceURLs = append(sourceURLs, sourceJSON.URL)
+	if sourceJSON.Type == "file" {
+		if len(patches) > 0 {
+			return nil, fmt.Errorf("source.json file for %v from registry %v has patches, which single files don't support", key, i.URL())
 		}
-		mirrorURL.Path = path.Join(mirrorURL.Path, sourceURL.Host, sourceURL.Path)
-		mirrorURL.RawQuery = sourceURL.RawQuery
-		fetcher.URLs = append(fetcher.URLs, mirrorURL.String())
+		return &fetch.File{
+			URLs:       sourceURLs,
+			Integrity:  sourceJSON.Integrity,
+			FileName:   sourceJSON.FileName,
+			Executable: sourceJSON.Executable,
+			Fprint:     fprint,
+		}, nil
 	}
-	fetcher.URLs = append(fetcher.URLs, sourceJSON.URL)
-	fetcher.Integrity = sourceJSON.Integrity
-	fetcher.StripPrefix = sourceJSON.StripPrefix
+	return &fetch.Archive{
+		URLs:        sourceURLs,
+		Integrity:   sourceJSON.Integrity,
+		StripPrefix: sourceJSON.StripPrefix,
+		Patches:     patches,
+		Type:        sourceJSON.Type,
+		Fprint:      fprint,
+	}, nil
+}
+
+// patches returns the patches listed in the given source.json of the given module, which live in the registry.
+func (i *Index) patches(key common.ModuleKey, sourceJSON sourceJSON) []fetch.Patch {
+	var patches []fetch.Patch
 	for _, patchFileName := range sourceJSON.PatchFiles {
 		patchFileURL := *i.url
 		patchFileURL.Path = path.Join(patchFileURL.Path, "modules", key.Name, key.Version, "patches", patchFileName)
-		fetcher.Patches = append(fetcher.Patches, fetch.Patch{
+		patches = append(patches, fetch.Patch{
 			PatchFile:  patchFileURL.String(),
 			PatchStrip: sourceJSON.PatchStrip,
 		})
 	}
-	return fetcher, nil
+	return patches
 }
 
 func indexScheme(url *urls.URL) (Registry, error) {
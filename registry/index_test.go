@@ -1,8 +1,12 @@
 package registry
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
+	"github.com/bazelbuild/bzlmod/common/integrity"
 	"github.com/bazelbuild/bzlmod/common/testutil"
 	"github.com/bazelbuild/bzlmod/fetch"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +33,8 @@ func setUpServerAndLocalFiles(t *testing.T, dir string, files map[string][]byte)
 }
 
 func TestIndex_GetModuleBazel(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
 	dir := t.TempDir()
 	server := setUpServerAndLocalFiles(t, dir, map[string][]byte{
 		"/modules/A/1.0/MODULE.bazel": []byte("kek"),
@@ -61,7 +67,70 @@ func TestIndex_GetModuleBazel(t *testing.T) {
 	}
 }
 
+func TestIndex_GetModuleMetadata(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	dir := t.TempDir()
+	server := setUpServerAndLocalFiles(t, dir, map[string][]byte{
+		"/modules/A/metadata.json": []byte(`{
+  "homepage": "https://a.example.com",
+  "maintainers": [{"name": "Alice", "email": "alice@example.com", "github": "alice"}],
+  "versions": ["1.0", "1.1", "2.0"],
+  "yanked_versions": {"2.0": "has a security issue"}
+}`),
+		"/modules/A/1.0/MODULE.bazel": []byte("kek"),
+		"/modules/B/1.0/MODULE.bazel": []byte("lel"),
+	})
+	defer server.Close()
+
+	fi, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+	hi, err := New(server.URL)
+	require.NoError(t, err)
+
+	for _, reg := range []Registry{fi, hi} {
+		metadata, err := reg.GetModuleMetadata("A")
+		if assert.NoError(t, err, reg.URL()) {
+			assert.Equal(t, &ModuleMetadata{
+				Homepage:       "https://a.example.com",
+				Maintainers:    []Maintainer{{"Alice", "alice@example.com", "alice"}},
+				Versions:       []string{"1.0", "1.1", "2.0"},
+				YankedVersions: map[string]string{"2.0": "has a security issue"},
+			}, metadata, reg.URL())
+			assert.Equal(t, "1.1", metadata.LatestVersion(), reg.URL())
+		}
+
+		_, err = reg.GetModuleMetadata("B")
+		assert.True(t, errors.Is(err, ErrNotFound), reg.URL())
+	}
+
+	names, err := fi.ListModules()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"A", "B"}, names)
+	}
+	_, err = hi.ListModules()
+	assert.True(t, errors.Is(err, ErrListingNotSupported))
+}
+
+func TestIndex_RetriesTransientFailures(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	server := testutil.FlakyHttpServer(map[string][]byte{
+		"/modules/A/1.0/MODULE.bazel": []byte("kek"),
+	}, 2)
+	defer server.Close()
+
+	reg, err := New(server.URL)
+	require.NoError(t, err)
+	bytes, err := reg.GetModuleBazel(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("kek"), bytes)
+	}
+}
+
 func TestIndex_GetFetcher(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
 	dir := t.TempDir()
 	server := setUpServerAndLocalFiles(t, dir, map[string][]byte{
 		"/bazel_registry.json": []byte(`{
@@ -83,7 +152,8 @@ func TestIndex_GetFetcher(t *testing.T) {
 }`),
 		"/modules/B/1.0/source.json": []byte(`{
   "url": "https://example.com/archive.jar?with=query",
-  "integrity": "sha256-bluh"
+  "integrity": "sha256-bluh",
+  "type": "zip"
 }`),
 	})
 	defer server.Close()
@@ -134,8 +204,163 @@ func TestIndex_GetFetcher(t *testing.T) {
 					"https://example.com/archive.jar?with=query",
 				},
 				Integrity: "sha256-bluh",
+				Type:      "zip",
 				Fprint:    common.Hash("regModule", "B", "1.0", reg.URL()),
 			}, fetcher, reg.URL())
 		}
 	}
 }
+
+func TestIndex_GetFetcher_Plugin(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "bazel_registry.json"), `{
+  "mirrors": ["https://mirror.bazel.build/"]
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.0", "source.json"), `{
+  "url": "corp://artifacts/a/1.0",
+  "integrity": "sha256-blah",
+  "strip_prefix": "a-1.0",
+  "patch_files": ["fix.patch"],
+  "patch_strip": 1
+}`)
+	reg, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+
+	fetcher, err := reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &fetch.Plugin{
+			URL:         "corp://artifacts/a/1.0",
+			Integrity:   "sha256-blah",
+			StripPrefix: "a-1.0",
+			Patches:     []fetch.Patch{{"file://" + filepath.ToSlash(dir) + "/modules/A/1.0/patches/fix.patch", 1}},
+			Fprint:      common.Hash("regModule", "A", "1.0", reg.URL()),
+		}, fetcher)
+	}
+}
+
+func TestIndex_GetFetcher_File(t *testing.T) {
+	dir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(dir, "bazel_registry.json"), `{
+  "mirrors": ["https://mirror.bazel.build/"]
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.0", "source.json"), `{
+  "url": "https://example.com/dl/tool-1.0",
+  "integrity": "sha256-blah",
+  "type": "file",
+  "file_name": "tool",
+  "executable": true
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "B", "1.0", "source.json"), `{
+  "url": "https://example.com/dl/b.jar",
+  "integrity": "sha256-bleh",
+  "type": "file",
+  "patch_files": ["fix.patch"]
+}`)
+	reg, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+
+	fetcher, err := reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &fetch.File{
+			URLs:       []string{"https://mirror.bazel.build/example.com/dl/tool-1.0", "https://example.com/dl/tool-1.0"},
+			Integrity:  "sha256-blah",
+			FileName:   "tool",
+			Executable: true,
+			Fprint:     common.Hash("regModule", "A", "1.0", reg.URL()),
+		}, fetcher)
+	}
+
+	_, err = reg.GetFetcher(common.ModuleKey{"B", "1.0"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "has patches, which single files don't support")
+	}
+}
+
+func TestIndex_GetFetcher_MirrorTemplates(t *testing.T) {
+	dir := t.TempDir()
+	sha256Integrity := integrity.MustGenerate("sha256", []byte("archive"))
+	sha256Hash := sha256.Sum256([]byte("archive"))
+	testutil.WriteFile(t, filepath.Join(dir, "bazel_registry.json"), `{
+  "mirrors": [
+    "https://m.corp/{module}/{version}/{filename}",
+    "https://cas.corp/sha256/{sha256}",
+    "https://plain.corp/"
+  ]
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.0", "source.json"), `{
+  "url": "https://example.com/dl/a-1.0.zip",
+  "integrity": "`+integrity.MustGenerate("sha384", []byte("archive"))+` `+sha256Integrity+`"
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "B", "1.0", "source.json"), `{
+  "url": "https://example.com/dl/b-1.0.zip",
+  "integrity": "`+integrity.MustGenerate("sha384", []byte("archive"))+`"
+}`)
+	reg, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+
+	UserMirrors = []string{"https://user.corp/{host}/{path}"}
+	defer func() { UserMirrors = nil }()
+
+	fetcher, err := reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"https://user.corp/example.com/dl/a-1.0.zip",
+			"https://m.corp/A/1.0/a-1.0.zip",
+			"https://cas.corp/sha256/" + hex.EncodeToString(sha256Hash[:]),
+			"https://plain.corp/example.com/dl/a-1.0.zip",
+			"https://example.com/dl/a-1.0.zip",
+		}, fetcher.(*fetch.Archive).URLs)
+	}
+
+	// There's no SHA-256 digest to fill in, so that mirror is skipped.
+	fetcher, err = reg.GetFetcher(common.ModuleKey{"B", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"https://user.corp/example.com/dl/b-1.0.zip",
+			"https://m.corp/B/1.0/b-1.0.zip",
+			"https://plain.corp/example.com/dl/b-1.0.zip",
+			"https://example.com/dl/b-1.0.zip",
+		}, fetcher.(*fetch.Archive).URLs)
+	}
+
+	UserMirrors = []string{"https://user.corp/{hots}/{path}"}
+	_, err = reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown placeholder(s) {hots}")
+	}
+}
+
+func TestIndex_Offline(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	server := testutil.StaticHttpServer(map[string][]byte{
+		"/modules/A/1.0/MODULE.bazel": []byte("kek"),
+		"/modules/B/1.0/MODULE.bazel": []byte("lel"),
+	})
+	defer server.Close()
+	reg, err := New(server.URL)
+	require.NoError(t, err)
+
+	// Grab some files while online, so that they're cached.
+	_, err = reg.GetModuleBazel(common.ModuleKey{"A", "1.0"})
+	require.NoError(t, err)
+	_, err = reg.GetModuleBazel(common.ModuleKey{"C", "1.0"})
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	httpclient.Offline = true
+	defer func() { httpclient.Offline = false }()
+
+	bytes, err := reg.GetModuleBazel(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("kek"), bytes)
+	}
+	// We remember that C doesn't exist in this registry.
+	_, err = reg.GetModuleBazel(common.ModuleKey{"C", "1.0"})
+	assert.True(t, errors.Is(err, ErrNotFound))
+	// B was never grabbed, so it's not available.
+	_, err = reg.GetModuleBazel(common.ModuleKey{"B", "1.0"})
+	if assert.True(t, errors.Is(err, httpclient.ErrOffline)) {
+		assert.Contains(t, err.Error(), "{B 1.0}")
+		assert.Contains(t, err.Error(), server.URL+"/modules/B/1.0/MODULE.bazel")
+	}
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/integrity"
+	urls "net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// UserMirrors are mirror templates from the user's configuration. They apply to archives from all registries, and are
+// tried before the mirrors of the registry itself.
+var UserMirrors []string
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// mirrorURLs returns the URLs of the source archive `sourceURL` of the module `key` on the given mirrors.
+//
+// A mirror is either a URL template, or a plain URL onto which the host and path of the source URL are appended. In a
+// template, the following placeholders are substituted:
+//
+//	{host}     the host (and port) of the source URL
+//	{path}     the path of the source URL, without the leading slash
+//	{filename} the last component of the path of the source URL
+//	{module}   the name of the module
+//	{version}  the version of the module
+//	{sha256}   the SHA-256 digest of the archive in hex, from its integrity
+//
+// Templates containing {sha256} are skipped if the integrity has no SHA-256 digest.
+func mirrorURLs(mirrors []string, sourceURL *urls.URL, key common.ModuleKey, integ string) ([]string, error) {
+	var result []string
+	for _, mirror := range mirrors {
+		if !strings.Contains(mirror, "{") {
+			mirrorURL, err := urls.Parse(mirror)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing mirror URL %v: %v", mirror, err)
+			}
+			mirrorURL.Path = path.Join(mirrorURL.Path, sourceURL.Host, sourceURL.Path)
+			mirrorURL.RawQuery = sourceURL.RawQuery
+			result = append(result, mirrorURL.String())
+			continue
+		}
+
+		values := map[string]string{
+			"{host}":     sourceURL.Host,
+			"{path}":     strings.TrimPrefix(sourceURL.EscapedPath(), "/"),
+			"{filename}": path.Base(sourceURL.EscapedPath()),
+			"{module}":   urls.PathEscape(key.Name),
+			"{version}":  urls.PathEscape(key.Version),
+		}
+		if strings.Contains(mirror, "{sha256}") {
+			digests, err := integrity.ParseDigests(integ)
+			if err != nil {
+				return nil, err
+			}
+			for _, digest := range digests {
+				if digest.Algorithm == "sha256" {
+					values["{sha256}"] = digest.Hex()
+					break
+				}
+			}
+			if values["{sha256}"] == "" {
+				continue
+			}
+		}
+		var unknown []string
+		expanded := placeholderRegexp.ReplaceAllStringFunc(mirror, func(placeholder string) string {
+			value, ok := values[placeholder]
+			if !ok {
+				unknown = append(unknown, placeholder)
+			}
+			return value
+		})
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("unknown placeholder(s) %v in mirror %v", strings.Join(unknown, ", "), mirror)
+		}
+		if _, err := urls.Parse(expanded); err != nil {
+			return nil, fmt.Errorf("error parsing URL %v expanded from mirror %v: %v", expanded, mirror, err)
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewVersion describes a version of a module to be added to an index registry.
+type NewVersion struct {
+	Key         common.ModuleKey
+	ModuleBazel []byte
+	URL         string
+	Integrity   string
+	StripPrefix string
+	// Type is the type of the archive, if it can't be detected from the URL.
+	Type string
+	// PatchFiles are paths to local patch files, which are copied into the registry.
+	PatchFiles []string
+	PatchStrip int
+}
+
+// AddVersion adds the given module version to the index registry in the local directory `dir`, using the layout that
+// Index reads: the MODULE.bazel file, source.json and patches go into modules/<name>/<version>, and the version is
+// appended to modules/<name>/metadata.json. The registry is created if it doesn't exist yet. Fails if the version
+// already exists.
+func AddVersion(dir string, v NewVersion) (err error) {
+	moduleDir := filepath.Join(dir, "modules", v.Key.Name)
+	versionDir := filepath.Join(moduleDir, v.Key.Version)
+	if _, err := os.Stat(versionDir); err == nil {
+		return fmt.Errorf("%v already exists in registry %v", &v.Key, dir)
+	}
+	if err := os.MkdirAll(versionDir, 0777); err != nil {
+		return err
+	}
+	// Don't leave a half-written version behind.
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(versionDir)
+		}
+	}()
+
+	if err := ensureBazelRegistryJSON(dir); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, "MODULE.bazel"), v.ModuleBazel, 0644); err != nil {
+		return err
+	}
+	source := sourceJSON{
+		URL:         v.URL,
+		Integrity:   v.Integrity,
+		StripPrefix: v.StripPrefix,
+		PatchStrip:  v.PatchStrip,
+		Type:        v.Type,
+	}
+	for _, patchFile := range v.PatchFiles {
+		name := filepath.Base(patchFile)
+		for _, existing := range source.PatchFiles {
+			if existing == name {
+				return fmt.Errorf("more than one patch file is named %v", name)
+			}
+		}
+		contents, err := ioutil.ReadFile(patchFile)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(versionDir, "patches"), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(versionDir, "patches", name), contents, 0644); err != nil {
+			return err
+		}
+		source.PatchFiles = append(source.PatchFiles, name)
+	}
+	if err := writeJSON(filepath.Join(versionDir, "source.json"), source); err != nil {
+		return err
+	}
+	return addVersionToMetadata(filepath.Join(moduleDir, "metadata.json"), v.Key.Version)
+}
+
+// ensureBazelRegistryJSON creates an empty bazel_registry.json file in the registry if it doesn't have one, as Index
+// requires it.
+func ensureBazelRegistryJSON(dir string) error {
+	fp := filepath.Join(dir, "bazel_registry.json")
+	if _, err := os.Stat(fp); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeJSON(fp, bazelRegistryJSON{Mirrors: []string{}})
+}
+
+func addVersionToMetadata(fp string, version string) error {
+	metadata := ModuleMetadata{
+		Maintainers:    []Maintainer{},
+		YankedVersions: map[string]string{},
+	}
+	p, err := ioutil.ReadFile(fp)
+	if err == nil {
+		if err := json.Unmarshal(p, &metadata); err != nil {
+			return fmt.Errorf("error parsing %v: %v", fp, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, existing := range metadata.Versions {
+		if existing == version {
+			return nil
+		}
+	}
+	// Insert the version after all those that come before it, so that a sorted list stays sorted.
+	i := len(metadata.Versions)
+	for i > 0 && versionLess(version, metadata.Versions[i-1]) {
+		i--
+	}
+	metadata.Versions = append(metadata.Versions, "")
+	copy(metadata.Versions[i+1:], metadata.Versions[i:])
+	metadata.Versions[i] = version
+	return writeJSON(fp, metadata)
+}
+
+func writeJSON(fp string, v interface{}) error {
+	p, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fp, append(p, '\n'), 0644)
+}
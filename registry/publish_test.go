@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"fmt"
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddVersion(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	dir := filepath.Join(t.TempDir(), "reg")
+	patchFile := filepath.Join(t.TempDir(), "fix.patch")
+	testutil.WriteFile(t, patchFile, "a patch")
+
+	require.NoError(t, AddVersion(dir, NewVersion{
+		Key:         common.ModuleKey{"A", "1.0"},
+		ModuleBazel: []byte(`module(name="A", version="1.0")`),
+		URL:         "https://example.com/a-1.0.zip",
+		Integrity:   "sha256-blah",
+		StripPrefix: "a-1.0",
+		PatchFiles:  []string{patchFile},
+		PatchStrip:  1,
+	}))
+	require.NoError(t, AddVersion(dir, NewVersion{
+		Key:         common.ModuleKey{"A", "2.0"},
+		ModuleBazel: []byte(`module(name="A", version="2.0")`),
+		URL:         "https://example.com/a-2.0.zip",
+		Integrity:   "sha256-bleh",
+	}))
+	testutil.AssertFileContents(t, filepath.Join(dir, "modules", "A", "2.0", "source.json"), `{
+  "url": "https://example.com/a-2.0.zip",
+  "integrity": "sha256-bleh"
+}
+`)
+
+	// The result can be read as an index registry.
+	reg, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+	moduleBazel, err := reg.GetModuleBazel(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte(`module(name="A", version="1.0")`), moduleBazel)
+	}
+	fetcher, err := reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &fetch.Archive{
+			URLs:        []string{"https://example.com/a-1.0.zip"},
+			Integrity:   "sha256-blah",
+			StripPrefix: "a-1.0",
+			Patches:     []fetch.Patch{{reg.URL() + "/modules/A/1.0/patches/fix.patch", 1}},
+			Fprint:      common.Hash("regModule", "A", "1.0", reg.URL()),
+		}, fetcher)
+	}
+	testutil.AssertFileContents(t, filepath.Join(dir, "modules", "A", "1.0", "patches", "fix.patch"), "a patch")
+	metadata, err := reg.GetModuleMetadata("A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"1.0", "2.0"}, metadata.Versions)
+	}
+
+	// Existing versions aren't overwritten.
+	err = AddVersion(dir, NewVersion{
+		Key:         common.ModuleKey{"A", "1.0"},
+		ModuleBazel: []byte("something else"),
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "A@1.0 already exists in registry")
+	}
+	testutil.AssertFileContents(t, filepath.Join(dir, "modules", "A", "1.0", "MODULE.bazel"), `module(name="A", version="1.0")`)
+
+	// Nothing is left behind by a failure.
+	err = AddVersion(dir, NewVersion{
+		Key:        common.ModuleKey{"A", "3.0"},
+		PatchFiles: []string{filepath.Join(dir, "nonexistent.patch")},
+	})
+	assert.Error(t, err)
+	_, err = reg.GetModuleBazel(common.ModuleKey{"A", "3.0"})
+	assert.Error(t, err)
+}
+
+func TestAddVersion_KeepsVersionsSorted(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	dir := filepath.Join(t.TempDir(), "reg")
+
+	for _, version := range []string{"1.10", "1.2", "2.0", "1.2.1", "0.9"} {
+		require.NoError(t, AddVersion(dir, NewVersion{
+			Key:         common.ModuleKey{"A", version},
+			ModuleBazel: []byte(fmt.Sprintf("module(name=\"A\", version=%q)", version)),
+			URL:         "https://example.com/a-" + version + ".zip",
+			Integrity:   "sha256-blah",
+		}))
+	}
+	reg, err := New("file://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+	metadata, err := reg.GetModuleMetadata("A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"0.9", "1.2", "1.2.1", "1.10", "2.0"}, metadata.Versions)
+	}
+}
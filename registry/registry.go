@@ -18,6 +18,39 @@ type Registry interface {
 	// GetFetcher returns the Fetcher object which can be used to fetch the module with the given key. Returns an error
 	// wrapping ErrNotFound if no such module exists in the registry.
 	GetFetcher(key common.ModuleKey) (fetch.Fetcher, error)
+	// GetModuleMetadata retrieves the metadata of the module with the given name, such as the versions available in the
+	// registry. Returns an error wrapping ErrNotFound if no such module exists in the registry.
+	GetModuleMetadata(name string) (*ModuleMetadata, error)
+	// ListModules returns the sorted names of all modules in the registry. Returns an error wrapping
+	// ErrListingNotSupported if the registry can't be enumerated.
+	ListModules() ([]string, error)
+}
+
+// ModuleMetadata describes a module in a registry, independently of any particular version.
+type ModuleMetadata struct {
+	Homepage    string       `json:"homepage"`
+	Maintainers []Maintainer `json:"maintainers"`
+	// Versions lists the versions of the module in the registry, in the order given by the registry (usually
+	// ascending).
+	Versions []string `json:"versions"`
+	// YankedVersions maps versions that shouldn't be used anymore to the reason why.
+	YankedVersions map[string]string `json:"yanked_versions"`
+}
+
+// LatestVersion returns the last version listed in the metadata that isn't yanked, or an empty string if there's none.
+func (m *ModuleMetadata) LatestVersion() string {
+	for i := len(m.Versions) - 1; i >= 0; i-- {
+		if _, yanked := m.YankedVersions[m.Versions[i]]; !yanked {
+			return m.Versions[i]
+		}
+	}
+	return ""
+}
+
+type Maintainer struct {
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	GitHub string `json:"github"`
 }
 
 var schemes = make(map[string]func(url *urls.URL) (Registry, error))
@@ -37,6 +70,8 @@ func New(rawurl string) (Registry, error) {
 
 var ErrNotFound = errors.New("module not found")
 
+var ErrListingNotSupported = errors.New("registry doesn't support listing modules")
+
 // GetModuleBazel gets the MODULE.bazel file contents for the module with the given key, using the list of
 // registries with an optional override `regOverride` (use an empty string for no override).
 // Returns the file contents, and the registry that actually has that module.
@@ -0,0 +1,266 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-version"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	urls "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Server serves the index registry in a local directory over HTTP, in the layout that Index reads. Archives that the
+// registry references with file:// URLs are served as well, under /archives/<name>/<version>/<file name>; the URLs in
+// source.json files are rewritten to point there, so that the registry can be used from other machines.
+type Server struct {
+	Dir string
+	// GenerateMetadata makes the server generate the metadata.json file of modules that don't have one, listing the
+	// versions that have a directory with a MODULE.bazel file.
+	GenerateMetadata bool
+}
+
+// contentTypes maps file name extensions to the content type that files with them are served with. Longer extensions
+// come first, as with archive types.
+var contentTypes = []struct {
+	ext         string
+	contentType string
+}{
+	{".json", "application/json"},
+	{".bazel", "text/plain; charset=utf-8"},
+	{".patch", "text/x-diff; charset=utf-8"},
+	{".diff", "text/x-diff; charset=utf-8"},
+	{".tar.gz", "application/gzip"},
+	{".tar.xz", "application/x-xz"},
+	{".tar.bz2", "application/x-bzip2"},
+	{".tar.zst", "application/zstd"},
+	{".tgz", "application/gzip"},
+	{".txz", "application/x-xz"},
+	{".tbz", "application/x-bzip2"},
+	{".tbz2", "application/x-bzip2"},
+	{".tzst", "application/zstd"},
+	{".tar", "application/x-tar"},
+	{".zip", "application/zip"},
+	{".jar", "application/java-archive"},
+}
+
+func contentType(name string) string {
+	for _, ct := range contentTypes {
+		if strings.HasSuffix(name, ct.ext) {
+			return ct.contentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	relPath := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	parts := strings.Split(relPath, "/")
+	for _, part := range parts {
+		// Hidden files (such as a .git directory) aren't part of the registry.
+		if strings.HasPrefix(part, ".") {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	var err error
+	switch {
+	case len(parts) == 4 && parts[0] == "archives":
+		err = s.serveArchive(w, r, parts[1], parts[2], parts[3])
+	case len(parts) == 4 && parts[0] == "modules" && parts[3] == "source.json":
+		err = s.serveSourceJSON(w, r, parts[1], parts[2])
+	case len(parts) == 3 && parts[0] == "modules" && parts[2] == "metadata.json":
+		err = s.serveFile(w, r, relPath)
+		if errors.Is(err, os.ErrNotExist) && s.GenerateMetadata {
+			err = s.serveGeneratedMetadata(w, r, parts[1])
+		}
+	default:
+		err = s.serveFile(w, r, relPath)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+	} else if err != nil {
+		log.Printf("error serving %v: %v\n", r.URL.Path, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// serveContent serves the given contents with the content type, ETag and Last-Modified headers that go with them.
+// Conditional and range requests are handled by http.ServeContent.
+func serveContent(w http.ResponseWriter, r *http.Request, name string, etag string, modTime time.Time, content io.ReadSeeker) {
+	w.Header().Set("Content-Type", contentType(name))
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, name, modTime, content)
+}
+
+// serveLocalFile serves the file at the given local path. Directories are treated as nonexistent, so that the layout of
+// the registry can't be listed.
+func serveLocalFile(w http.ResponseWriter, r *http.Request, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.ErrNotExist
+	}
+	// Like nginx, derive the ETag from the modification time and size, so that files don't need to be hashed.
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	serveContent(w, r, info.Name(), etag, info.ModTime(), f)
+	return nil
+}
+
+// serveBytes serves generated contents, whose ETag is derived from the contents themselves.
+func serveBytes(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, p []byte) {
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(p))
+	serveContent(w, r, name, etag, modTime, bytes.NewReader(p))
+}
+
+func (s *Server) localPath(relPath string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(relPath))
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, relPath string) error {
+	return serveLocalFile(w, r, s.localPath(relPath))
+}
+
+// readSourceJSON reads the given source.json file, both as generic JSON (so that it can be rewritten without losing
+// any fields), and as the URL it contains.
+func (s *Server) readSourceJSON(relPath string) (map[string]json.RawMessage, *urls.URL, os.FileInfo, error) {
+	fp := s.localPath(relPath)
+	info, err := os.Stat(fp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing %v: %v", fp, err)
+	}
+	var rawurl string
+	if err := json.Unmarshal(fields["url"], &rawurl); err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing the URL in %v: %v", fp, err)
+	}
+	url, err := urls.Parse(rawurl)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing the URL in %v: %v", fp, err)
+	}
+	return fields, url, info, nil
+}
+
+func (s *Server) serveSourceJSON(w http.ResponseWriter, r *http.Request, name string, version string) error {
+	relPath := path.Join("modules", name, version, "source.json")
+	fields, url, info, err := s.readSourceJSON(relPath)
+	if err != nil {
+		return err
+	}
+	if url.Scheme != "file" {
+		return s.serveFile(w, r, relPath)
+	}
+	// Point the URL to where we serve the archive.
+	archiveURL := urls.URL{
+		Scheme: "http",
+		Host:   r.Host,
+		Path:   path.Join("/archives", name, version, path.Base(url.Path)),
+	}
+	if r.TLS != nil {
+		archiveURL.Scheme = "https"
+	}
+	if fields["url"], err = json.Marshal(archiveURL.String()); err != nil {
+		return err
+	}
+	p, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return err
+	}
+	serveBytes(w, r, "source.json", info.ModTime(), append(p, '\n'))
+	return nil
+}
+
+// serveArchive serves the archive that the source.json file of the given module version references with a file:// URL.
+// Only such archives are served; no other local files are exposed.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, name string, version string, fileName string) error {
+	_, url, _, err := s.readSourceJSON(path.Join("modules", name, version, "source.json"))
+	if err != nil {
+		return err
+	}
+	if url.Scheme != "file" || path.Base(url.Path) != fileName {
+		return os.ErrNotExist
+	}
+	return serveLocalFile(w, r, filepath.FromSlash(url.Path))
+}
+
+func (s *Server) serveGeneratedMetadata(w http.ResponseWriter, r *http.Request, name string) error {
+	moduleDir := s.localPath(path.Join("modules", name))
+	moduleInfo, err := os.Stat(moduleDir)
+	if err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(moduleDir)
+	if err != nil {
+		return err
+	}
+	metadata := ModuleMetadata{
+		Maintainers:    []Maintainer{},
+		Versions:       []string{},
+		YankedVersions: map[string]string{},
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(moduleDir, info.Name(), "MODULE.bazel")); err == nil {
+			metadata.Versions = append(metadata.Versions, info.Name())
+		}
+	}
+	sortVersions(metadata.Versions)
+	p, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Adding or removing a version directory changes the modification time of the module directory.
+	serveBytes(w, r, "metadata.json", moduleInfo.ModTime(), append(p, '\n'))
+	return nil
+}
+
+// sortVersions sorts the given versions in ascending order. Versions that can't be parsed come first, in lexicographic
+// order.
+func sortVersions(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool { return versionLess(versions[i], versions[j]) })
+}
+
+// versionLess reports whether version `a` comes before version `b` in the order of sortVersions.
+func versionLess(a string, b string) bool {
+	va, erra := version.NewVersion(a)
+	vb, errb := version.NewVersion(b)
+	switch {
+	case erra != nil && errb != nil:
+		return a < b
+	case erra != nil || errb != nil:
+		return erra != nil
+	default:
+		return va.LessThan(vb)
+	}
+}
@@ -0,0 +1,108 @@
+package registry
+
+import (
+	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/testutil"
+	"github.com/bazelbuild/bzlmod/fetch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+	dir := t.TempDir()
+	archive := filepath.Join(t.TempDir(), "a-1.0.zip")
+	testutil.WriteFile(t, archive, "zip contents")
+	testutil.WriteFile(t, filepath.Join(dir, "bazel_registry.json"), `{"mirrors": []}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.0", "MODULE.bazel"), `module(name="A", version="1.0")`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.0", "source.json"), `{
+  "url": "file://`+filepath.ToSlash(archive)+`",
+  "integrity": "sha256-blah",
+  "strip_prefix": "a-1.0"
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.10", "MODULE.bazel"), `module(name="A", version="1.10")`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.10", "source.json"), `{
+  "url": "https://example.com/a-1.10.zip",
+  "integrity": "sha256-bleh"
+}`)
+	testutil.WriteFile(t, filepath.Join(dir, "modules", "A", "1.9", "MODULE.bazel"), `module(name="A", version="1.9")`)
+	testutil.WriteFile(t, filepath.Join(dir, ".git", "config"), "secret")
+	server := httptest.NewServer(&Server{Dir: dir, GenerateMetadata: true})
+	defer server.Close()
+
+	reg, err := New(server.URL)
+	require.NoError(t, err)
+	moduleBazel, err := reg.GetModuleBazel(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte(`module(name="A", version="1.0")`), moduleBazel)
+	}
+	// Local archives are served by the server as well.
+	fetcher, err := reg.GetFetcher(common.ModuleKey{"A", "1.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, &fetch.Archive{
+			URLs:        []string{server.URL + "/archives/A/1.0/a-1.0.zip"},
+			Integrity:   "sha256-blah",
+			StripPrefix: "a-1.0",
+			Fprint:      common.Hash("regModule", "A", "1.0", reg.URL()),
+		}, fetcher)
+	}
+	fetcher, err = reg.GetFetcher(common.ModuleKey{"A", "1.10"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"https://example.com/a-1.10.zip"}, fetcher.(*fetch.Archive).URLs)
+	}
+	metadata, err := reg.GetModuleMetadata("A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, &ModuleMetadata{
+			Maintainers:    []Maintainer{},
+			Versions:       []string{"1.0", "1.9", "1.10"},
+			YankedVersions: map[string]string{},
+		}, metadata)
+	}
+
+	resp, err := http.Get(server.URL + "/archives/A/1.0/a-1.0.zip")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "zip contents", string(body))
+	assert.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	assert.NotEmpty(t, resp.Header.Get("Last-Modified"))
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// Conditional requests are honored.
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/archives/A/1.0/a-1.0.zip", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/modules/A/1.0/source.json")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	// Nothing else is exposed.
+	for _, p := range []string{
+		"/archives/A/1.10/a-1.10.zip",
+		"/archives/A/1.0/other.zip",
+		"/modules/A",
+		"/modules/B/metadata.json",
+		"/.git/config",
+		"/modules/../.git/config",
+	} {
+		resp, err := http.Get(server.URL + p)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, p)
+	}
+}
@@ -1,12 +1,17 @@
 package resolve
 
 import (
+	"errors"
 	"fmt"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
 	integrities "github.com/bazelbuild/bzlmod/common/integrity"
 	"github.com/bazelbuild/bzlmod/fetch"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bazelbuild/bzlmod/registry"
 
@@ -14,8 +19,11 @@ import (
 )
 
 type wsSettings struct {
-	vendorDir  string
-	registries []string
+	vendorDir   string
+	registries  []string
+	httpOptions httpclient.Options
+	// allowedYankedVersions lists the yanked versions (as "<name>@<version>") that may still be selected.
+	allowedYankedVersions []string
 }
 
 // Merges all given wsSettings objects, in ascending order of priority (later trumps earlier).
@@ -34,6 +42,10 @@ func mergeWsSettings(settings ...*wsSettings) *wsSettings {
 		if len(next.registries) > 0 {
 			merged.registries = next.registries
 		}
+		if len(next.allowedYankedVersions) > 0 {
+			merged.allowedYankedVersions = next.allowedYankedVersions
+		}
+		merged.httpOptions = merged.httpOptions.Merge(next.httpOptions)
 	}
 	return merged
 }
@@ -71,6 +83,16 @@ func extractStringSlice(list *starlark.List) ([]string, error) {
 	return r, nil
 }
 
+// checkAllowedYankedVersions makes sure that each entry of an allow-list of yanked versions is a module key.
+func checkAllowedYankedVersions(entries []string) error {
+	for _, entry := range entries {
+		if i := strings.Index(entry, "@"); i <= 0 || i == len(entry)-1 {
+			return fmt.Errorf("got %q in allow_yanked_versions, want \"<name>@<version>\"", entry)
+		}
+	}
+	return nil
+}
+
 func extractPatchSlice(list *starlark.List, patchStrip int) ([]fetch.Patch, error) {
 	if list == nil {
 		if patchStrip > 0 {
@@ -126,10 +148,17 @@ func wsSettingsFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 		return nil, fmt.Errorf("%v: can only be called once", b.Name())
 	}
 	wsSettings := &wsSettings{}
-	var registries *starlark.List
+	var registries, allowedYankedVersions *starlark.List
+	var connectTimeout, readTimeout, initialBackoff, maxBackoff string
 	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
 		"vendor_dir?", &wsSettings.vendorDir,
 		"registries?", &registries,
+		"http_connect_timeout?", &connectTimeout,
+		"http_read_timeout?", &readTimeout,
+		"http_max_attempts?", &wsSettings.httpOptions.MaxAttempts,
+		"http_initial_backoff?", &initialBackoff,
+		"http_max_backoff?", &maxBackoff,
+		"allow_yanked_versions?", &allowedYankedVersions,
 	); err != nil {
 		return nil, err
 	}
@@ -138,6 +167,36 @@ func wsSettingsFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	if err != nil {
 		return nil, err
 	}
+	wsSettings.allowedYankedVersions, err = extractStringSlice(allowedYankedVersions)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAllowedYankedVersions(wsSettings.allowedYankedVersions); err != nil {
+		return nil, fmt.Errorf("%v: %v", b.Name(), err)
+	}
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"http_connect_timeout", connectTimeout, &wsSettings.httpOptions.ConnectTimeout},
+		{"http_read_timeout", readTimeout, &wsSettings.httpOptions.ReadTimeout},
+		{"http_initial_backoff", initialBackoff, &wsSettings.httpOptions.InitialBackoff},
+		{"http_max_backoff", maxBackoff, &wsSettings.httpOptions.MaxBackoff},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if *d.dest, err = time.ParseDuration(d.value); err != nil || *d.dest <= 0 {
+			return nil, fmt.Errorf("%v: got %q for %v, want a positive duration such as \"30s\"", b.Name(), d.value, d.name)
+		}
+	}
+	// Like for the flag, 0 leaves the option unset.
+	if wsSettings.httpOptions.MaxAttempts < 0 {
+		return nil, fmt.Errorf("%v: got %v for http_max_attempts, want a positive number (or 0 for the default)",
+			b.Name(), wsSettings.httpOptions.MaxAttempts)
+	}
 	getThreadState(t).wsSettings = wsSettings
 	return starlark.None, nil
 }
@@ -159,7 +218,11 @@ func bazelDepFn(t *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kw
 	if repoName == "" {
 		repoName = depKey.Name
 	}
-	getThreadState(t).module.Deps[repoName] = depKey
+	module := getThreadState(t).module
+	if module == nil {
+		return nil, fmt.Errorf("%v: module() must be called first", b.Name())
+	}
+	module.Deps[repoName] = depKey
 	return starlark.None, nil // TODO: return a smart value for module rules
 }
 
@@ -260,6 +323,7 @@ func archiveOverrideFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tu
 		"strip_prefix?", &override.StripPrefix,
 		"patch_files?", &patchFiles,
 		"patch_strip?", &patchStrip,
+		"type?", &override.Type,
 	); err != nil {
 		return nil, err
 	}
@@ -295,18 +359,60 @@ func gitOverrideFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple,
 	return &starlarkOverrideHolder{override}, nil
 }
 
+func fileOverrideFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%v: unexpected positional arguments", b.Name())
+	}
+	var override FileOverride
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"url", &override.URL,
+		"integrity", &override.Integrity,
+		"file_name?", &override.FileName,
+		"executable?", &override.Executable,
+	); err != nil {
+		return nil, err
+	}
+	return &starlarkOverrideHolder{override}, nil
+}
+
 func localPathOverrideFn(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	if len(args) > 0 {
 		return nil, fmt.Errorf("%v: unexpected positional arguments", b.Name())
 	}
 	var (
-		err      error
-		override LocalPathOverride
+		err        error
+		override   LocalPathOverride
+		ignore     *starlark.List
+		patchFiles *starlark.List
+		patchStrip int
 	)
-	err = starlark.UnpackArgs(b.Name(), args, kwargs, "path", &override.Path)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"path", &override.Path,
+		"fingerprint?", &override.Fingerprinting,
+		"ignore?", &ignore,
+		"patch_files?", &patchFiles,
+		"patch_strip?", &patchStrip,
+	); err != nil {
+		return nil, err
+	}
+	switch override.Fingerprinting {
+	case fetch.FingerprintNone, fetch.FingerprintMetadata, fetch.FingerprintContents:
+	default:
+		return nil, fmt.Errorf("%v: fingerprint must be one of %q, %q and %q, got %q", b.Name(),
+			fetch.FingerprintNone, fetch.FingerprintMetadata, fetch.FingerprintContents, override.Fingerprinting)
+	}
+	override.Patches, err = extractPatchSlice(patchFiles, patchStrip)
 	if err != nil {
 		return nil, err
 	}
+	if ignore != nil {
+		if override.Ignore, err = extractStringSlice(ignore); err != nil {
+			return nil, err
+		}
+	} else if override.Fingerprinting != fetch.FingerprintNone || override.Patches != nil {
+		// The ignore patterns only matter for fingerprinting and patching; leave them out of the lockfile otherwise.
+		override.Ignore = fetch.DefaultLocalPathIgnore
+	}
 	return &starlarkOverrideHolder{override}, nil
 }
 
@@ -326,15 +432,55 @@ func newStarlarkEnv(isRootModule bool) starlark.StringDict {
 		"multiple_version_override": starlark.NewBuiltin("multiple_version_override", noOpUnlessRootModule(multipleVersionOverrideFn)),
 		"archive_override":          starlark.NewBuiltin("archive_override", noOpUnlessRootModule(archiveOverrideFn)),
 		"git_override":              starlark.NewBuiltin("git_override", noOpUnlessRootModule(gitOverrideFn)),
+		"file_override":             starlark.NewBuiltin("file_override", noOpUnlessRootModule(fileOverrideFn)),
 		"local_path_override":       starlark.NewBuiltin("local_path_override", noOpUnlessRootModule(localPathOverrideFn)),
 	}
 }
 
+// Registries returns the list of registries used by the workspace in `wsDir`: `registries` if it's not empty, or else
+// the ones specified in `workspace_settings` of its MODULE.bazel file (if there is one), or else the default.
+func Registries(wsDir string, registries []string) ([]string, error) {
+	var rootSettings *wsSettings
+	moduleBazel, err := ioutil.ReadFile(filepath.Join(wsDir, "MODULE.bazel"))
+	if err == nil {
+		thread := &starlark.Thread{
+			Name: "reading workspace settings",
+			// Stdout is reserved for the output of the command that asked.
+			Print: func(thread *starlark.Thread, msg string) { _, _ = fmt.Fprintln(os.Stderr, msg) },
+		}
+		tstate := initThreadState(thread)
+		if _, err = starlark.ExecFile(thread, "/MODULE.bazel", moduleBazel, newStarlarkEnv(true)); err != nil {
+			return nil, err
+		}
+		rootSettings = tstate.wsSettings
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return mergeWsSettings(rootSettings, &wsSettings{registries: registries}).registries, nil
+}
+
+// ParseModuleKey evaluates the given MODULE.bazel file as that of a non-root module, and returns the name and version
+// declared by its module() directive.
+func ParseModuleKey(moduleBazel []byte) (common.ModuleKey, error) {
+	thread := &starlark.Thread{
+		Name:  "reading module key",
+		Print: func(thread *starlark.Thread, msg string) { _, _ = fmt.Fprintln(os.Stderr, msg) },
+	}
+	tstate := initThreadState(thread)
+	if _, err := starlark.ExecFile(thread, "/MODULE.bazel", moduleBazel, newStarlarkEnv(false)); err != nil {
+		return common.ModuleKey{}, err
+	}
+	if tstate.module == nil {
+		return common.ModuleKey{}, fmt.Errorf("the MODULE.bazel file has no module() directive")
+	}
+	return tstate.module.Key, nil
+}
+
 // Run discovery. This step involves downloading and evaluating the MODULE.bazel files of all transitive
 // bazel_deps.
 // `wsDir` is the workspace directory, and `registries` is the list of registries to use (takes precedence
-// over the registries specified in `workspace_settings`).
-func runDiscovery(wsDir string, vendorDir string, registries []string) (*context, error) {
+// over the registries specified in `workspace_settings`); the same goes for `allowedYankedVersions`.
+func runDiscovery(wsDir string, vendorDir string, registries []string, allowedYankedVersions []string) (*context, error) {
 	thread := &starlark.Thread{
 		Name:  "discovery of root",
 		Print: func(thread *starlark.Thread, msg string) { fmt.Println(msg) },
@@ -349,18 +495,25 @@ func runDiscovery(wsDir string, vendorDir string, registries []string) (*context
 		return nil, err
 	}
 
+	if err := checkAllowedYankedVersions(allowedYankedVersions); err != nil {
+		return nil, err
+	}
 	wsSettings := mergeWsSettings(tstate.wsSettings, &wsSettings{
-		vendorDir:  vendorDir,
-		registries: registries,
+		vendorDir:             vendorDir,
+		registries:            registries,
+		allowedYankedVersions: allowedYankedVersions,
 	})
+	// Flags for the HTTP options are applied separately (as httpclient.FlagOptions), and take precedence over these.
+	httpclient.WorkspaceOptions = wsSettings.httpOptions
 	ctx := &context{
 		rootModuleName: tstate.module.Key.Name,
 		depGraph: DepGraph{
 			common.ModuleKey{tstate.module.Key.Name, ""}: tstate.module,
 		},
-		overrideSet:          tstate.overrideSet,
-		moduleBazelIntegrity: integrities.MustGenerate("sha256", moduleBazel),
-		vendorDir:            wsSettings.vendorDir,
+		overrideSet:           tstate.overrideSet,
+		moduleBazelIntegrity:  integrities.MustGenerate("sha256", moduleBazel),
+		vendorDir:             wsSettings.vendorDir,
+		allowedYankedVersions: wsSettings.allowedYankedVersions,
 	}
 	if _, exists := ctx.overrideSet[ctx.rootModuleName]; exists {
 		return nil, fmt.Errorf("invalid override found for root module")
@@ -382,7 +535,7 @@ func processModuleDeps(module *Module, overrideSet OverrideSet, depGraph DepGrap
 			if o.Version != "" {
 				depKey.Version = o.Version
 			}
-		case LocalPathOverride, ArchiveOverride, GitOverride:
+		case LocalPathOverride, ArchiveOverride, GitOverride, FileOverride:
 			depKey.Version = ""
 		}
 		module.Deps[depRepoName] = depKey
@@ -445,19 +598,49 @@ type getModuleBazelResult struct {
 // registry of the module (if the module is from a registry) or the fetcher for the module (if otherwise).
 func getModuleBazel(key common.ModuleKey, overrideSet OverrideSet, registries []string) (result getModuleBazelResult, err error) {
 	override := overrideSet[key.Name]
-	switch override.(type) {
+	switch o := override.(type) {
+	case FileOverride:
+		result.fetcher = &fetch.File{
+			URLs:       []string{o.URL},
+			Integrity:  o.Integrity,
+			FileName:   o.FileName,
+			Executable: o.Executable,
+			Fprint:     common.Hash("fileOverride", o.URL, o.Integrity, o.FileName, o.Executable),
+		}
+		// A single file has no MODULE.bazel file of its own, and hence no deps.
+		result.moduleBazel = []byte(fmt.Sprintf("module(name=%q)\n", key.Name))
+		return
 	case LocalPathOverride, ArchiveOverride, GitOverride:
 		// For these overrides, there's no registry involved; we can concoct our own fetcher.
 		switch o := override.(type) {
 		case LocalPathOverride:
-			result.fetcher = &fetch.LocalPath{Path: o.Path}
+			result.fetcher = &fetch.LocalPath{
+				Path:           o.Path,
+				Fingerprinting: o.Fingerprinting,
+				Ignore:         o.Ignore,
+				Patches:        o.Patches,
+			}
 		case ArchiveOverride:
+			// Everything that affects the fetched contents goes into the fingerprint, so that changing any of it
+			// invalidates the shared repo dir.
+			fprint := common.Hash("urlOverride", o.URL, o.Integrity, o.StripPrefix, o.Type, o.Patches)
+			if fetch.IsPluginURL(o.URL) {
+				result.fetcher = &fetch.Plugin{
+					URL:         o.URL,
+					Integrity:   o.Integrity,
+					StripPrefix: o.StripPrefix,
+					Patches:     o.Patches,
+					Fprint:      fprint,
+				}
+				break
+			}
 			result.fetcher = &fetch.Archive{
 				URLs:        []string{o.URL},
 				Integrity:   o.Integrity,
 				StripPrefix: o.StripPrefix,
 				Patches:     o.Patches,
-				Fprint:      common.Hash("urlOverride", o.URL, o.Patches),
+				Type:        o.Type,
+				Fprint:      fprint,
 			}
 		case GitOverride:
 			result.fetcher = &fetch.Git{
@@ -3,6 +3,7 @@ package resolve
 import (
 	"fmt"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/common/httpclient"
 	integrities "github.com/bazelbuild/bzlmod/common/integrity"
 	"github.com/bazelbuild/bzlmod/common/testutil"
 	"github.com/bazelbuild/bzlmod/fetch"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestDiscovery_SimpleDiamond(t *testing.T) {
@@ -34,7 +36,7 @@ bazel_dep(name="D", version="0.1")
 module(name="D", version="0.1")
 `, nil)
 
-	v, err := runDiscovery(wsDir, "", []string{reg.URL()})
+	v, err := runDiscovery(wsDir, "", []string{reg.URL()}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,20 +95,120 @@ bazel_dep(name="C", version="2.0")
 	reg2.AddModule(t, "C", "2.0", `module(name="C", version="2.0")`, nil)
 
 	// If no registries are specified by flags, we use what's in workspace_settings (which is reg1).
-	v, err := runDiscovery(wsDir, "", nil)
+	v, err := runDiscovery(wsDir, "", nil, nil)
 	if assert.NoError(t, err) {
 		assert.Contains(t, v.depGraph, common.ModuleKey{"C", "1.0"})
 		assert.NotContains(t, v.depGraph, common.ModuleKey{"C", "2.0"})
 	}
 
 	// Otherwise, the flags take precedence.
-	v, err = runDiscovery(wsDir, "", []string{reg2.URL()})
+	v, err = runDiscovery(wsDir, "", []string{reg2.URL()}, nil)
 	if assert.NoError(t, err) {
 		assert.Contains(t, v.depGraph, common.ModuleKey{"C", "2.0"})
 		assert.NotContains(t, v.depGraph, common.ModuleKey{"C", "1.0"})
 	}
 }
 
+func TestRegistries(t *testing.T) {
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(registries=["https://reg1/", "https://reg2/"])
+`)
+	registries, err := Registries(wsDir, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"https://reg1/", "https://reg2/"}, registries)
+	}
+	registries, err = Registries(wsDir, []string{"https://flag/"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"https://flag/"}, registries)
+	}
+	// Outside of a workspace, the default applies.
+	registries, err = Registries(t.TempDir(), nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"https://bcr.bazel.build/"}, registries)
+	}
+}
+
+func TestParseModuleKey(t *testing.T) {
+	key, err := ParseModuleKey([]byte(`
+module(name="A", version="1.0")
+bazel_dep(name="B", version="2.0")
+local_path_override(module_name="B", path="ignored")
+`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, common.ModuleKey{"A", "1.0"}, key)
+	}
+	_, err = ParseModuleKey([]byte(`print("hi")`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no module() directive")
+	}
+	_, err = ParseModuleKey([]byte(`bazel_dep(name="B", version="2.0")`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bazel_dep: module() must be called first")
+	}
+}
+
+func TestDiscovery_HTTPSettings(t *testing.T) {
+	defer func() { httpclient.WorkspaceOptions = httpclient.Options{} }()
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(http_read_timeout="2m", http_max_attempts=3)
+`)
+	_, err := runDiscovery(wsDir, "", nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, httpclient.Options{ReadTimeout: 2 * time.Minute, MaxAttempts: 3}, httpclient.WorkspaceOptions)
+
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(http_connect_timeout="soon")
+`)
+	_, err = runDiscovery(wsDir, "", nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `got "soon" for http_connect_timeout`)
+	}
+
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(http_max_attempts=-1)
+`)
+	_, err = runDiscovery(wsDir, "", nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `got -1 for http_max_attempts, want a positive number (or 0 for the default)`)
+	}
+}
+
+func TestDiscovery_AllowYankedVersions(t *testing.T) {
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(allow_yanked_versions=["B@1.0"])
+`)
+	v, err := runDiscovery(wsDir, "", nil, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"B@1.0"}, v.allowedYankedVersions)
+	}
+	// Flags take precedence.
+	v, err = runDiscovery(wsDir, "", nil, []string{"C@2.0"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"C@2.0"}, v.allowedYankedVersions)
+	}
+	_, err = runDiscovery(wsDir, "", nil, []string{"C"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `got "C" in allow_yanked_versions`)
+	}
+
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+workspace_settings(allow_yanked_versions=["@1.0"])
+`)
+	_, err = runDiscovery(wsDir, "", nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `got "@1.0" in allow_yanked_versions, want "<name>@<version>"`)
+	}
+}
+
 func TestDiscovery_LocalPathOverride(t *testing.T) {
 	wsDir := t.TempDir()
 	wsDirA := filepath.Join(wsDir, "A")
@@ -124,7 +226,7 @@ module(name="B", version="not-sure-yet")
 module(name="B", version="1.0")
 `, nil)
 
-	v, err := runDiscovery(wsDirA, "", []string{reg.URL()})
+	v, err := runDiscovery(wsDirA, "", []string{reg.URL()}, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "A", v.rootModuleName)
 	assert.Equal(t, OverrideSet{
@@ -146,6 +248,109 @@ module(name="B", version="1.0")
 	}, v.depGraph)
 }
 
+func TestDiscovery_LocalPathOverride_FingerprintAndPatches(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+
+	wsDir := t.TempDir()
+	wsDirA := filepath.Join(wsDir, "A")
+	wsDirB := filepath.Join(wsDir, "B")
+	wsDirC := filepath.Join(wsDir, "C")
+	patchFile := filepath.Join(wsDir, "b.patch")
+	testutil.WriteFile(t, filepath.Join(wsDirA, "MODULE.bazel"), fmt.Sprintf(`
+module(name="A")
+bazel_dep(name="B", version="1.0")
+bazel_dep(name="C", version="1.0")
+override_dep(module_name="B", override=local_path_override(
+  path="%v",
+  fingerprint="contents",
+  patch_files=["%v"],
+  patch_strip=1,
+))
+override_dep(module_name="C", override=local_path_override(
+  path="%v",
+  fingerprint="metadata",
+  ignore=["out"],
+))
+`, wsDirB, patchFile, wsDirC))
+	testutil.WriteFile(t, filepath.Join(wsDirB, "MODULE.bazel"), `
+module(name="B", version="1.0")
+`)
+	testutil.WriteFile(t, filepath.Join(wsDirC, "MODULE.bazel"), `
+module(name="C", version="1.0")
+`)
+	// The patch applies to the MODULE.bazel file too, and discovery sees the patched version.
+	testutil.WriteFile(t, patchFile, `--- a/MODULE.bazel
++++ b/MODULE.bazel
+@@ -1,2 +1,2 @@
+ 
+-module(name="B", version="1.0")
++module(name="B", version="1.0-patched")
+`)
+	reg := registry.NewFake("fake")
+
+	v, err := runDiscovery(wsDirA, "", []string{reg.URL()}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, OverrideSet{
+		"A": LocalPathOverride{Path: wsDirA},
+		"B": LocalPathOverride{
+			Path:           wsDirB,
+			Fingerprinting: "contents",
+			Ignore:         fetch.DefaultLocalPathIgnore,
+			Patches:        []fetch.Patch{{patchFile, 1}},
+		},
+		"C": LocalPathOverride{Path: wsDirC, Fingerprinting: "metadata", Ignore: []string{"out"}},
+	}, v.overrideSet)
+	assert.Equal(t, "1.0-patched", v.depGraph[common.ModuleKey{"B", ""}].Key.Version)
+}
+
+func TestDiscovery_LocalPathOverride_BadFingerprint(t *testing.T) {
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+bazel_dep(name="B", version="1.0")
+override_dep(module_name="B", override=local_path_override(path="/b", fingerprint="mtime"))
+`)
+	_, err := runDiscovery(wsDir, "", nil, nil)
+	assert.EqualError(t, err, `local_path_override: fingerprint must be one of "", "metadata" and "contents", got "mtime"`)
+}
+
+func TestDiscovery_FileOverride(t *testing.T) {
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+bazel_dep(name="B", version="1.0")
+override_dep(module_name="B", override=file_override(
+  url="https://example.com/dl/b-tool",
+  integrity="sha256-blah",
+  file_name="tool",
+  executable=True,
+))
+`)
+	reg := registry.NewFake("fake")
+
+	// Nothing needs to be fetched during discovery, as a single file has no deps.
+	v, err := runDiscovery(wsDir, "", []string{reg.URL()}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, FileOverride{
+		URL:        "https://example.com/dl/b-tool",
+		Integrity:  "sha256-blah",
+		FileName:   "tool",
+		Executable: true,
+	}, v.overrideSet["B"])
+	assert.Equal(t, &Module{
+		Key:  common.ModuleKey{"B", ""},
+		Deps: map[string]common.ModuleKey{},
+		Fetcher: &fetch.File{
+			URLs:       []string{"https://example.com/dl/b-tool"},
+			Integrity:  "sha256-blah",
+			FileName:   "tool",
+			Executable: true,
+			Fprint:     common.Hash("fileOverride", "https://example.com/dl/b-tool", "sha256-blah", "tool", true),
+		},
+	}, v.depGraph[common.ModuleKey{"B", ""}])
+}
+
 func TestDiscovery_ArchiveOverride(t *testing.T) {
 	fetch.TestBzlmodDir = t.TempDir()
 	defer func() { fetch.TestBzlmodDir = "" }()
@@ -181,7 +386,7 @@ bazel_dep(name="B", version="1.0")
 override_dep(module_name="B", override=archive_override(url="%v/b.zip", integrity="%v"))
 `, server.URL, zipIntegrity))
 
-	v, err := runDiscovery(wsDir, "", []string{reg.URL()})
+	v, err := runDiscovery(wsDir, "", []string{reg.URL()}, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "A", v.rootModuleName)
 	assert.Equal(t, OverrideSet{
@@ -206,7 +411,7 @@ override_dep(module_name="B", override=archive_override(url="%v/b.zip", integrit
 			Fetcher: &fetch.Archive{
 				URLs:      []string{server.URL + "/b.zip"},
 				Integrity: zipIntegrity,
-				Fprint:    common.Hash("urlOverride", server.URL+"/b.zip", []string{}),
+				Fprint:    common.Hash("urlOverride", server.URL+"/b.zip", zipIntegrity, "", "", []string{}),
 			},
 		},
 		common.ModuleKey{"D", "1.0"}: &Module{
@@ -217,7 +422,64 @@ override_dep(module_name="B", override=archive_override(url="%v/b.zip", integrit
 	}, v.depGraph)
 }
 
-// TODO: GitOverride test
+func TestDiscovery_GitOverride(t *testing.T) {
+	fetch.TestBzlmodDir = t.TempDir()
+	defer func() { fetch.TestBzlmodDir = "" }()
+
+	reg := registry.NewFake("fake")
+	reg.AddModule(t, "B", "1.0", `
+module(name="B", version="1.0")
+bazel_dep(name="C", version="1.0")
+`, nil)
+	reg.AddModule(t, "C", "1.0", `
+module(name="C", version="1.0")
+`, nil)
+	reg.AddModule(t, "D", "1.0", `
+module(name="D", version="1.0")
+`, nil)
+
+	repoDir := filepath.Join(t.TempDir(), "b.git")
+	commits := testutil.BuildGitRepo(t, repoDir, map[string][]byte{
+		"MODULE.bazel": []byte(`
+module(name="B", version="3.0")
+bazel_dep(name="D", version="1.0")
+`),
+	})
+	repoURL := "file://" + filepath.ToSlash(repoDir)
+
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), fmt.Sprintf(`
+module(name="A")
+bazel_dep(name="B", version="1.0")
+override_dep(module_name="B", override=git_override(repo="%v", commit="%v"))
+`, repoURL, commits[0]))
+
+	v, err := runDiscovery(wsDir, "", []string{reg.URL()}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, DepGraph{
+		common.ModuleKey{"A", ""}: &Module{
+			Key: common.ModuleKey{"A", ""},
+			Deps: map[string]common.ModuleKey{
+				"B": {"B", ""},
+			},
+		},
+		common.ModuleKey{"B", ""}: &Module{
+			Key: common.ModuleKey{"B", "3.0"},
+			Deps: map[string]common.ModuleKey{
+				"D": {"D", "1.0"},
+			},
+			Fetcher: &fetch.Git{
+				Repo:   repoURL,
+				Commit: commits[0],
+			},
+		},
+		common.ModuleKey{"D", "1.0"}: &Module{
+			Key:  common.ModuleKey{"D", "1.0"},
+			Deps: map[string]common.ModuleKey{},
+			Reg:  reg,
+		},
+	}, v.depGraph)
+}
 
 func TestDiscovery_SingleVersionOverride(t *testing.T) {
 	wsDir := t.TempDir()
@@ -239,7 +501,7 @@ module(name="B", version="1.0")
 `, nil)
 	// Note that there's no B@3.0 at all. But it should be fine since it was overridden.
 
-	v, err := runDiscovery(wsDir, "", []string{reg.URL()})
+	v, err := runDiscovery(wsDir, "", []string{reg.URL()}, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "A", v.rootModuleName)
 	assert.Equal(t, OverrideSet{
@@ -281,7 +543,7 @@ bazel_dep(name="B", version="4.0", repo_name="B4")
 override_dep(module_name="B", override=multiple_version_override(versions=["3.3", "4.4"], registry="%v"))
 `, reg.URL()))
 
-	v, err := runDiscovery(wsDir, "", nil)
+	v, err := runDiscovery(wsDir, "", nil, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "A", v.rootModuleName)
 	assert.Equal(t, OverrideSet{
@@ -346,7 +608,7 @@ override_dep(module_name="C", override=single_version_override(registry="%v"))
 override_dep(module_name="D", override=single_version_override(registry="%v"))
 `, reg2.URL(), reg3.URL()))
 
-	v, err := runDiscovery(wsDir, "", []string{reg1.URL()})
+	v, err := runDiscovery(wsDir, "", []string{reg1.URL()}, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "A", v.rootModuleName)
 	assert.Equal(t, OverrideSet{
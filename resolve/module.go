@@ -51,7 +51,10 @@ type MultipleVersionOverride struct {
 }
 
 type LocalPathOverride struct {
-	Path string
+	Path           string
+	Fingerprinting string
+	Ignore         []string
+	Patches        []fetch.Patch
 }
 
 type ArchiveOverride struct {
@@ -59,6 +62,14 @@ type ArchiveOverride struct {
 	Integrity   string
 	StripPrefix string
 	Patches     []fetch.Patch
+	Type        string
+}
+
+type FileOverride struct {
+	URL        string
+	Integrity  string
+	FileName   string
+	Executable bool
 }
 
 type GitOverride struct {
@@ -1,13 +1,11 @@
 package resolve
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/bazelbuild/bzlmod/common"
 	"github.com/bazelbuild/bzlmod/fetch"
 	"github.com/bazelbuild/bzlmod/lockfile"
 	"html/template"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -18,10 +16,12 @@ type context struct {
 	overrideSet          OverrideSet
 	moduleBazelIntegrity string
 	vendorDir            string
+	// allowedYankedVersions lists the yanked versions (as "<name>@<version>") that may be selected anyway.
+	allowedYankedVersions []string
 }
 
-func Resolve(wsDir string, vendorDir string, registries []string) error {
-	ctx, err := runDiscovery(wsDir, vendorDir, registries)
+func Resolve(wsDir string, vendorDir string, registries []string, allowedYankedVersions []string) error {
+	ctx, err := runDiscovery(wsDir, vendorDir, registries, allowedYankedVersions)
 	if err != nil {
 		return fmt.Errorf("error during discovery: %v", err)
 	}
@@ -78,20 +78,30 @@ func writeLockFile(wsDir string, ctx *context) error {
 	ws := lockfile.NewWorkspace()
 	ws.VendorDir = ctx.vendorDir
 
+	// Keep the tree hashes recorded by earlier fetches, as long as the repo is still fetched the same way. A missing or
+	// broken old lockfile just means there's nothing to keep.
+	lockFilePath := filepath.Join(wsDir, lockfile.FileName)
+	oldWs, err := lockfile.Load(lockFilePath)
+	if err != nil {
+		oldWs = lockfile.NewWorkspace()
+	}
+
 	for _, module := range ctx.depGraph {
 		if module.RepoName == "" {
 			continue
 		}
-		ws.Repos[module.RepoName] = &lockfile.Repo{
+		repo := &lockfile.Repo{
 			Fetcher: fetch.Wrap(module.Fetcher),
 		}
+		if oldRepo := oldWs.Repos[module.RepoName]; oldRepo != nil {
+			if fprint := module.Fetcher.Fingerprint(); fprint != "" && oldRepo.Fetcher.Fingerprint() == fprint {
+				repo.TreeHash = oldRepo.TreeHash
+			}
+		}
+		ws.Repos[module.RepoName] = repo
 	}
 
-	bytes, err := json.MarshalIndent(ws, "", "  ")
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(filepath.Join(wsDir, lockfile.FileName), bytes, 0644)
+	return ws.Save(lockFilePath)
 }
 
 const workspaceTemplate = `# This file is automatically generated by bzlmod
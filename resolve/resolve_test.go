@@ -25,30 +25,30 @@ bazel_dep(name="E", version="3.0", repo_name="EfromA")
 	reg.AddModule(t, "B", "1.0", `
 module(name="B", version="1.0")
 bazel_dep(name="D", version="0.1", repo_name="DfromB")
-`, &fetch.LocalPath{"B/1.0"})
+`, &fetch.LocalPath{Path: "B/1.0"})
 	reg.AddModule(t, "C", "2.0", `
 module(name="C", version="2.0")
 bazel_dep(name="D", version="0.2", repo_name="DfromC")
-`, &fetch.LocalPath{"C/1.0"})
+`, &fetch.LocalPath{Path: "C/1.0"})
 	reg.AddModule(t, "D", "0.1", `
 module(name="D", version="0.1")
 bazel_dep(name="F", version="10.0")
-`, &fetch.LocalPath{"D/0.1"})
+`, &fetch.LocalPath{Path: "D/0.1"})
 	reg.AddModule(t, "D", "0.2", `
 module(name="D", version="0.2")
 bazel_dep(name="E", version="2.0")
-`, &fetch.LocalPath{"D/0.2"})
+`, &fetch.LocalPath{Path: "D/0.2"})
 	reg.AddModule(t, "E", "2.0", `
 module(name="E", version="2.0")
-`, &fetch.LocalPath{"E/2.0"})
+`, &fetch.LocalPath{Path: "E/2.0"})
 	reg.AddModule(t, "E", "3.0", `
 module(name="E", version="3.0")
-`, &fetch.LocalPath{"E/3.0"})
+`, &fetch.LocalPath{Path: "E/3.0"})
 	reg.AddModule(t, "F", "10.0", `
 module(name="F", version="10.0")
-`, &fetch.LocalPath{"F/10.0"})
+`, &fetch.LocalPath{Path: "F/10.0"})
 
-	require.NoError(t, Resolve(wsDir, "", []string{reg.URL()}))
+	require.NoError(t, Resolve(wsDir, "", []string{reg.URL()}, nil))
 
 	lockFile, err := ioutil.ReadFile(filepath.Join(wsDir, "bzlmod.lock"))
 	if assert.NoError(t, err) {
@@ -57,30 +57,26 @@ module(name="F", version="10.0")
   "Repos": {
     "BfromA": {
       "Fetcher": {
-        "LocalPath": {
-          "Path": "B/1.0"
-        }
+        "type": "local_path",
+        "Path": "B/1.0"
       }
     },
     "C": {
       "Fetcher": {
-        "LocalPath": {
-          "Path": "C/1.0"
-        }
+        "type": "local_path",
+        "Path": "C/1.0"
       }
     },
     "D": {
       "Fetcher": {
-        "LocalPath": {
-          "Path": "D/0.2"
-        }
+        "type": "local_path",
+        "Path": "D/0.2"
       }
     },
     "EfromA": {
       "Fetcher": {
-        "LocalPath": {
-          "Path": "E/3.0"
-        }
+        "type": "local_path",
+        "Path": "E/3.0"
       }
     }
   }
@@ -157,7 +153,7 @@ module(name="B", version="1.0")
 		Fprint:    "something",
 	})
 
-	require.NoError(t, Resolve(wsDir, "", []string{reg.URL()}))
+	require.NoError(t, Resolve(wsDir, "", []string{reg.URL()}, nil))
 
 	lockFile, err := ioutil.ReadFile(filepath.Join(wsDir, "bzlmod.lock"))
 	require.NoError(t, err)
@@ -167,5 +163,40 @@ module(name="B", version="1.0")
 		{"https://registry.com/a.patch", 1},
 		{"https://patches.com/a.patch", 2},
 		{"https://patches.com/b.patch", 2},
-	}, ws.Repos["B"].Fetcher.Archive.Patches)
+	}, ws.Repos["B"].Fetcher.Unwrap().(*fetch.Archive).Patches)
+}
+
+func TestResolve_KeepsTreeHashes(t *testing.T) {
+	wsDir := t.TempDir()
+	testutil.WriteFile(t, filepath.Join(wsDir, "MODULE.bazel"), `
+module(name="A")
+bazel_dep(name="B", version="1.0")
+bazel_dep(name="C", version="1.0")
+`)
+	reg := registry.NewFake("fake")
+	reg.AddModule(t, "B", "1.0", `
+module(name="B", version="1.0")
+`, &fetch.Archive{URLs: []string{"https://registry.com/b.zip"}, Fprint: "b-fprint"})
+	reg.AddModule(t, "C", "1.0", `
+module(name="C", version="1.0")
+`, &fetch.Archive{URLs: []string{"https://registry.com/c.zip"}, Fprint: "c-fprint"})
+
+	old := lockfile.NewWorkspace()
+	old.Repos["B"] = &lockfile.Repo{
+		Fetcher:  fetch.Wrap(&fetch.Archive{URLs: []string{"https://registry.com/b.zip"}, Fprint: "b-fprint"}),
+		TreeHash: "sha256-b",
+	}
+	old.Repos["C"] = &lockfile.Repo{
+		Fetcher:  fetch.Wrap(&fetch.Archive{URLs: []string{"https://registry.com/c.zip"}, Fprint: "old-c-fprint"}),
+		TreeHash: "sha256-c",
+	}
+	require.NoError(t, old.Save(filepath.Join(wsDir, "bzlmod.lock")))
+
+	require.NoError(t, Resolve(wsDir, "", []string{reg.URL()}, nil))
+
+	ws, err := lockfile.Load(filepath.Join(wsDir, "bzlmod.lock"))
+	require.NoError(t, err)
+	assert.Equal(t, "sha256-b", ws.Repos["B"].TreeHash)
+	// C's fingerprint changed, so the old hash no longer applies.
+	assert.Equal(t, "", ws.Repos["C"].TreeHash)
 }
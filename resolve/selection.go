@@ -1,9 +1,12 @@
 package resolve
 
 import (
+	"errors"
 	"fmt"
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/registry"
 	"github.com/hashicorp/go-version"
+	"sort"
 )
 
 func runSelection(ctx *context) error {
@@ -73,6 +76,40 @@ func runSelection(ctx *context) error {
 		}
 	}
 
+	return checkYankedVersions(ctx)
+}
+
+// checkYankedVersions makes sure that none of the selected versions was yanked from the registry it comes from, unless
+// it's explicitly allowed.
+func checkYankedVersions(ctx *context) error {
+	allowed := make(map[string]bool)
+	for _, entry := range ctx.allowedYankedVersions {
+		allowed[entry] = true
+	}
+	var keys []common.ModuleKey
+	for key, module := range ctx.depGraph {
+		// Modules without a registry come from overrides, and aren't subject to yanking.
+		if key.Version != "" && module.Reg != nil {
+			keys = append(keys, key)
+		}
+	}
+	// Report the first yanked version deterministically.
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	for _, key := range keys {
+		reg := ctx.depGraph[key].Reg
+		metadata, err := reg.GetModuleMetadata(key.Name)
+		if errors.Is(err, registry.ErrNotFound) {
+			// Registries aren't required to have metadata, in which case nothing is yanked.
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error checking whether %v is yanked: %v", &key, err)
+		}
+		reason, yanked := metadata.YankedVersions[key.Version]
+		if yanked && !allowed[key.String()] {
+			return fmt.Errorf("%v was selected, but it's yanked in registry %v (reason: %v); "+
+				"add it to allow_yanked_versions to use it anyway", &key, reg.URL(), reason)
+		}
+	}
 	return nil
 }
 
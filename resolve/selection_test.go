@@ -2,6 +2,7 @@ package resolve
 
 import (
 	"github.com/bazelbuild/bzlmod/common"
+	"github.com/bazelbuild/bzlmod/registry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -76,3 +77,61 @@ func TestSelection_SimpleDiamond(t *testing.T) {
 	}
 	assert.Equal(t, expectedDepGraph, depGraph)
 }
+
+func TestSelection_YankedVersions(t *testing.T) {
+	reg := registry.NewFake("fake")
+	reg.AddModule(t, "B", "1.0", "", nil)
+	reg.AddModule(t, "B", "1.1", "", nil)
+	reg.AddModule(t, "C", "1.0", "", nil)
+	reg.YankVersion(t, "B", "1.0", "miscompiles everything")
+	reg.YankVersion(t, "B", "1.1", "deletes your home directory")
+	newDepGraph := func() DepGraph {
+		return DepGraph{
+			common.ModuleKey{"A", ""}: &Module{
+				Key: common.ModuleKey{"A", "1.0"},
+				Deps: map[string]common.ModuleKey{
+					"B": {"B", "1.1"},
+					"C": {"C", "1.0"},
+				},
+			},
+			common.ModuleKey{"B", "1.1"}: &Module{
+				Key:  common.ModuleKey{"B", "1.1"},
+				Deps: map[string]common.ModuleKey{},
+				Reg:  reg,
+			},
+			common.ModuleKey{"C", "1.0"}: &Module{
+				Key: common.ModuleKey{"C", "1.0"},
+				Deps: map[string]common.ModuleKey{
+					"B": {"B", "1.0"},
+				},
+				Reg: reg,
+			},
+			common.ModuleKey{"B", "1.0"}: &Module{
+				Key:  common.ModuleKey{"B", "1.0"},
+				Deps: map[string]common.ModuleKey{},
+				Reg:  reg,
+			},
+		}
+	}
+
+	// Only the selected version matters; B@1.0 is yanked too, but it's not selected.
+	ctx := &context{
+		rootModuleName: "A",
+		depGraph:       newDepGraph(),
+		overrideSet:    OverrideSet{},
+	}
+	err := runSelection(ctx)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "B@1.1 was selected, but it's yanked in registry fake:fake (reason: deletes your home directory)")
+	}
+
+	ctx = &context{
+		rootModuleName:        "A",
+		depGraph:              newDepGraph(),
+		overrideSet:           OverrideSet{},
+		allowedYankedVersions: []string{"B@1.1"},
+	}
+	require.NoError(t, runSelection(ctx))
+	assert.Contains(t, ctx.depGraph, common.ModuleKey{"B", "1.1"})
+	assert.NotContains(t, ctx.depGraph, common.ModuleKey{"B", "1.0"})
+}